@@ -0,0 +1,124 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sfi2k7/mc/internal/storage"
+	"github.com/spf13/cobra"
+)
+
+// backupMetricsExtension is appended to the backup file path to name the
+// metrics file when --metrics-file is not given
+const backupMetricsExtension = ".prom"
+
+// backupTimeLayout formats the time in generated backup file names
+const backupTimeLayout = "20060102T150405Z"
+
+// backupFlags holds the command line options of the backup command
+type backupFlags struct {
+	database    string
+	collection  string
+	query       string
+	dest        string
+	codec       string
+	preset      string
+	level       int
+	metricsFile string
+}
+
+func newBackupCmd() *cobra.Command {
+	var flags backupFlags
+
+	backupCmd := &cobra.Command{
+		Use:   "backup -d DATABASE -c COLLECTION --dest PATH",
+		Short: "Export a collection with a manifest and metrics in one step",
+		Long: `Backup exports a collection, compressing the document stream straight into the
+destination file, then writes a SHA-256 manifest and Prometheus textfile
+metrics next to it. It is export with the settings a routine backup wants.
+
+When --dest is an existing directory or ends in a slash, the file is named
+DATABASE.COLLECTION.TIMESTAMP.mcbz inside it. Only local paths are supported;
+object storage URLs such as s3:// are rejected.`,
+		Annotations: map[string]string{needsConnection: "true"},
+		Args:        cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runBackup(cmd, flags)
+		},
+	}
+
+	backupCmd.Flags().StringVarP(&flags.database, "database", "d", "", "MongoDB database name")
+	backupCmd.Flags().StringVarP(&flags.collection, "collection", "c", "", "MongoDB collection name")
+	backupCmd.Flags().StringVar(&flags.query, "query", "{}", "Query filter in JSON format")
+	backupCmd.Flags().StringVar(&flags.dest, "dest", "", "Backup file, or directory to create a timestamped backup file in")
+	backupCmd.Flags().StringVar(&flags.codec, "codec", storage.Codec, "Compression codec; only zstd is supported")
+	backupCmd.Flags().StringVar(&flags.preset, "compression", "balanced", "Compression preset: fast, balanced or max")
+	backupCmd.Flags().IntVar(&flags.level, "level", 0, "zstd compression level 1-22 (overrides the preset level)")
+	backupCmd.Flags().StringVar(&flags.metricsFile, "metrics-file", "", "Write Prometheus textfile metrics to this file (default: the backup file path with "+backupMetricsExtension+" appended)")
+
+	backupCmd.MarkFlagRequired("database")
+	backupCmd.MarkFlagRequired("collection")
+	backupCmd.MarkFlagRequired("dest")
+
+	return backupCmd
+}
+
+func runBackup(cmd *cobra.Command, flags backupFlags) error {
+	if flags.codec != storage.Codec {
+		return usageErrorf("unsupported codec %q (only %s is supported)", flags.codec, storage.Codec)
+	}
+	outputFile, err := backupPath(flags)
+	if err != nil {
+		return err
+	}
+
+	exportOpts := exportFlags{
+		database:     flags.database,
+		collection:   flags.collection,
+		query:        flags.query,
+		preset:       flags.preset,
+		level:        flags.level,
+		manifest:     true,
+		parallelScan: 1,
+		fileMode:     "0644",
+	}
+	if err := resolveQuery(cmd, &exportOpts); err != nil {
+		return err
+	}
+
+	metricsFile := flags.metricsFile
+	if metricsFile == "" {
+		metricsFile = outputFile + backupMetricsExtension
+	}
+	metrics := newRunMetrics("backup", flags.database, flags.collection)
+	err = finishMetrics(metricsFile, metrics, runExport(exportOpts, outputFile, metrics))
+	if err != nil {
+		return err
+	}
+	logger.Info("Backup completed", "file", outputFile, "metrics", metricsFile)
+	return nil
+}
+
+// backupPath resolves --dest to the path of the backup file
+func backupPath(flags backupFlags) (string, error) {
+	dest := flags.dest
+	if strings.Contains(dest, "://") {
+		return "", usageErrorf("unsupported destination %q: only local paths are supported", dest)
+	}
+
+	info, err := os.Stat(dest)
+	isDir := err == nil && info.IsDir()
+	if !isDir && !strings.HasSuffix(dest, string(filepath.Separator)) && !strings.HasSuffix(dest, "/") {
+		return dest, nil
+	}
+	if !isDir {
+		if err := os.MkdirAll(dest, 0777); err != nil {
+			return "", fmt.Errorf("failed to create backup directory: %w", writeError(dest, err))
+		}
+	}
+	name := fmt.Sprintf("%s.%s.%s%s", flags.database, flags.collection, time.Now().UTC().Format(backupTimeLayout), storage.FileExtension)
+	return filepath.Join(dest, name), nil
+}
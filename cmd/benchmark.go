@@ -0,0 +1,184 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/sfi2k7/mc/internal/storage"
+	"github.com/sfi2k7/mc/internal/utils"
+	"github.com/spf13/cobra"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// benchmarkCase is a single codec/level combination to measure
+type benchmarkCase struct {
+	codec string
+	level int
+	// windowLog is the zstd window log, 0 for the level default
+	windowLog int
+	run       func(w io.Writer, data []byte) error
+}
+
+func newBenchmarkCmd() *cobra.Command {
+	var (
+		sampleSize int64
+		windowLogs []int
+	)
+
+	benchmarkCmd := &cobra.Command{
+		Use:   "benchmark FILE",
+		Short: "Compare compression codecs and levels on a sample of an MCBZ file",
+		Long: `Benchmark reads a sample of documents from an MCBZ file and reports the
+compressed size and throughput of each codec and level combination.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			filePath := args[0]
+			return runBenchmark(filePath, sampleSize, windowLogs)
+		},
+	}
+
+	benchmarkCmd.Flags().Int64Var(&sampleSize, "sample-size", 16<<20, "Maximum number of document bytes to sample")
+	benchmarkCmd.Flags().IntSliceVar(&windowLogs, "window-log", nil, "Also measure zstd levels 3 and 19 with these window logs (comma-separated, 10-29)")
+
+	return benchmarkCmd
+}
+
+func runBenchmark(filePath string, sampleSize int64, windowLogs []int) error {
+	for _, windowLog := range windowLogs {
+		if windowLog == 0 {
+			return usageErrorf("invalid window log 0 (expected %d-%d)", storage.MinWindowLog, storage.MaxWindowLog)
+		}
+		if err := storage.ValidateWindowLog(windowLog); err != nil {
+			return usageError(err)
+		}
+	}
+
+	sample, docs, err := readSample(filePath, sampleSize)
+	if err != nil {
+		return err
+	}
+	if len(sample) == 0 {
+		return fmt.Errorf("file contains no documents to benchmark")
+	}
+
+	logger.Info("Benchmarking sample", "docs", docs, "size", utils.FormatByteSize(int64(len(sample))))
+
+	cases := []benchmarkCase{
+		{codec: "none", run: func(w io.Writer, data []byte) error {
+			_, err := w.Write(data)
+			return err
+		}},
+	}
+	for level := 1; level <= 9; level++ {
+		level := level
+		cases = append(cases, benchmarkCase{codec: "gzip", level: level, run: func(w io.Writer, data []byte) error {
+			gz, err := gzip.NewWriterLevel(w, level)
+			if err != nil {
+				return err
+			}
+			if _, err := gz.Write(data); err != nil {
+				return err
+			}
+			return gz.Close()
+		}})
+	}
+	for _, level := range []int{1, 3, 7, 19} {
+		cases = append(cases, zstdCase(level, 0))
+	}
+	for _, windowLog := range windowLogs {
+		cases = append(cases, zstdCase(3, windowLog), zstdCase(19, windowLog))
+	}
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "CODEC\tLEVEL\tWINDOW\tSIZE\tRATIO\tTHROUGHPUT")
+	for _, c := range cases {
+		var out bytes.Buffer
+		start := time.Now()
+		if err := c.run(&out, sample); err != nil {
+			return fmt.Errorf("%s level %d failed: %w", c.codec, c.level, err)
+		}
+		elapsed := time.Since(start)
+
+		level := "-"
+		if c.codec != "none" {
+			level = fmt.Sprintf("%d", c.level)
+		}
+		window := "-"
+		if c.windowLog != 0 {
+			window = utils.FormatByteSize(1 << c.windowLog)
+		}
+		throughput := float64(len(sample)) / elapsed.Seconds()
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%.2f:1\t%s/s\n",
+			c.codec,
+			level,
+			window,
+			utils.FormatByteSize(int64(out.Len())),
+			float64(len(sample))/float64(out.Len()),
+			utils.FormatByteSize(int64(throughput)))
+	}
+
+	return table.Flush()
+}
+
+// zstdCase measures the compressor at a level and window log
+func zstdCase(level, windowLog int) benchmarkCase {
+	return benchmarkCase{codec: "zstd", level: level, windowLog: windowLog, run: func(w io.Writer, data []byte) error {
+		compressor, err := storage.NewCompressor(w, storage.CompressionOptions{Level: level, WindowLog: windowLog})
+		if err != nil {
+			return err
+		}
+		if _, err := compressor.Write(data); err != nil {
+			return err
+		}
+		return compressor.Close()
+	}}
+}
+
+// readSample reads documents from the file until sampleSize bytes have been
+// collected, returning them in the data region's length-prefixed layout
+func readSample(filePath string, sampleSize int64) ([]byte, int, error) {
+	fileReader, err := storage.NewFileReader(filePath)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer fileReader.Close()
+
+	if _, err := fileReader.ReadHeader(); err != nil {
+		return nil, 0, headerError(err)
+	}
+
+	var sample bytes.Buffer
+	docs := 0
+	lengthBytes := make([]byte, 4)
+	for int64(sample.Len()) < sampleSize {
+		batch, err := fileReader.ReadBatch(batchSize)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to read batch: %w", err)
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		for _, doc := range batch {
+			if int64(sample.Len()) >= sampleSize {
+				break
+			}
+			data, err := bson.Marshal(doc)
+			if err != nil {
+				return nil, 0, err
+			}
+			binary.LittleEndian.PutUint32(lengthBytes, uint32(len(data)))
+			sample.Write(lengthBytes)
+			sample.Write(data)
+			docs++
+		}
+	}
+
+	return sample.Bytes(), docs, nil
+}
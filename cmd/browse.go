@@ -0,0 +1,291 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/sfi2k7/mc/internal/db"
+	"github.com/sfi2k7/mc/internal/storage"
+	"github.com/sfi2k7/mc/internal/utils"
+	"github.com/spf13/cobra"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// browseHelp lists the commands understood at the browse prompt
+const browseHelp = `Commands:
+  n, Enter   next page
+  p          previous page
+  g N        go to document N
+  / ID       find the document with this _id (ObjectId hex, extended JSON value or string)
+  h          show the file header
+  ?          show this help
+  q          quit`
+
+func newBrowseCmd() *cobra.Command {
+	var (
+		pageSize  int
+		canonical bool
+	)
+
+	browseCmd := &cobra.Command{
+		Use:   "browse FILE",
+		Short: "Page through the documents of an MCBZ file interactively",
+		Long: `Browse shows the documents of an MCBZ file a page at a time and reads
+commands from standard input: move between pages, jump to a document number,
+or find a document by _id. The file is only read. Files have no index, so
+moving backwards and searching read the file again from the start.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if pageSize < 1 {
+				return usageErrorf("--page-size must be at least 1")
+			}
+			b := &browser{path: args[0], pageSize: int64(pageSize), canonical: canonical}
+			defer b.close()
+			return b.run()
+		},
+	}
+
+	browseCmd.Flags().IntVar(&pageSize, "page-size", 5, "Number of documents shown per page")
+	browseCmd.Flags().BoolVar(&canonical, "canonical", false, "Show documents in canonical extended JSON, keeping every BSON type")
+
+	return browseCmd
+}
+
+// browser holds the state of a browse session. The reader only moves
+// forward; next is the number of the document it returns next, counting
+// from 0, and start is the first document of the current page.
+type browser struct {
+	path      string
+	pageSize  int64
+	canonical bool
+	reader    *storage.FileReader
+	metadata  storage.Metadata
+	next      int64
+	start     int64
+}
+
+func (b *browser) run() error {
+	if err := b.rewind(); err != nil {
+		return err
+	}
+	b.printHeader()
+	fmt.Println("")
+	fmt.Println(browseHelp)
+	fmt.Println("")
+	if err := b.showPage(); err != nil {
+		return err
+	}
+
+	input := bufio.NewScanner(os.Stdin)
+	for {
+		fmt.Print("browse> ")
+		if !input.Scan() {
+			fmt.Println("")
+			return input.Err()
+		}
+		command, arg, _ := strings.Cut(strings.TrimSpace(input.Text()), " ")
+		arg = strings.TrimSpace(arg)
+
+		var err error
+		switch command {
+		case "", "n":
+			b.start += b.pageSize
+			err = b.showPage()
+		case "p":
+			if b.start == 0 {
+				fmt.Println("Already at the first page")
+				continue
+			}
+			b.start -= b.pageSize
+			if b.start < 0 {
+				b.start = 0
+			}
+			err = b.showPage()
+		case "g":
+			n, convErr := strconv.ParseInt(arg, 10, 64)
+			if convErr != nil || n < 1 {
+				fmt.Println("Usage: g N, with N from 1")
+				continue
+			}
+			b.start = n - 1
+			err = b.showPage()
+		case "/":
+			err = b.find(arg)
+		case "h":
+			b.printHeader()
+		case "?":
+			fmt.Println(browseHelp)
+		case "q":
+			return nil
+		default:
+			fmt.Printf("Unknown command %q; ? shows the commands\n", command)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// rewind reopens the file so documents are read from the first one again
+func (b *browser) rewind() error {
+	b.close()
+	reader, err := storage.NewFileReader(b.path)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %w", err)
+	}
+	metadata, err := reader.ReadHeader()
+	if err != nil {
+		reader.Close()
+		return headerError(err)
+	}
+	b.reader, b.metadata, b.next = reader, metadata, 0
+	return nil
+}
+
+// seek positions the reader at document pos, rewinding if it is already
+// past it. It stops early at the end of the file.
+func (b *browser) seek(pos int64) error {
+	if pos < b.next {
+		if err := b.rewind(); err != nil {
+			return err
+		}
+	}
+	for b.next < pos {
+		n := pos - b.next
+		if n > int64(batchSize) {
+			n = int64(batchSize)
+		}
+		batch, err := b.reader.ReadBatch(int(n))
+		if err != nil {
+			return fmt.Errorf("failed to read batch: %w", err)
+		}
+		if len(batch) == 0 {
+			break
+		}
+		b.next += int64(len(batch))
+	}
+	return nil
+}
+
+// read returns up to n documents from the current position
+func (b *browser) read(n int64) ([]bson.D, error) {
+	var docs []bson.D
+	for int64(len(docs)) < n {
+		batch, err := b.reader.ReadBatch(int(n) - len(docs))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read batch: %w", err)
+		}
+		if len(batch) == 0 {
+			break
+		}
+		docs = append(docs, batch...)
+	}
+	b.next += int64(len(docs))
+	return docs, nil
+}
+
+// showPage prints the page starting at b.start. Past the end of the file
+// it moves b.start back to the last page.
+func (b *browser) showPage() error {
+	if err := b.seek(b.start); err != nil {
+		return err
+	}
+	var docs []bson.D
+	if b.next == b.start {
+		var err error
+		if docs, err = b.read(b.pageSize); err != nil {
+			return err
+		}
+	}
+	if len(docs) == 0 {
+		fmt.Printf("End of file after %d documents\n", b.next)
+		b.start = 0
+		if b.next > 0 {
+			b.start = (b.next - 1) / b.pageSize * b.pageSize
+		}
+		return nil
+	}
+	for i, doc := range docs {
+		if err := b.printDocument(b.start+int64(i), doc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// find scans the file from the start for a document with the given _id
+// and shows the page starting at it
+func (b *browser) find(arg string) error {
+	if arg == "" {
+		fmt.Println("Usage: / ID")
+		return nil
+	}
+	id, err := db.ParseIDBound(arg)
+	if err != nil {
+		return err
+	}
+	if err := b.seek(0); err != nil {
+		return err
+	}
+	for {
+		pos := b.next
+		batch, err := b.read(int64(batchSize))
+		if err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			fmt.Printf("No document with _id %s\n", arg)
+			return nil
+		}
+		for i, doc := range batch {
+			if db.MatchID(doc, id) {
+				b.start = pos + int64(i)
+				return b.showPage()
+			}
+		}
+	}
+}
+
+// printDocument prints a document with its number, counting from 1
+func (b *browser) printDocument(pos int64, doc bson.D) error {
+	data, err := bson.MarshalExtJSON(doc, b.canonical, false)
+	if err != nil {
+		return fmt.Errorf("failed to format document %d: %w", pos+1, err)
+	}
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, data, "", "  "); err != nil {
+		return fmt.Errorf("failed to format document %d: %w", pos+1, err)
+	}
+	fmt.Printf("--- Document %d ---\n%s\n", pos+1, indented.String())
+	return nil
+}
+
+// printHeader prints a short summary of the file metadata; inspect shows
+// all of it
+func (b *browser) printHeader() {
+	fmt.Println("Source:", b.metadata.Database+"."+b.metadata.Collection)
+	fmt.Println("Documents:", b.metadata.DocumentCount)
+	if b.metadata.Format == storage.FormatOplog {
+		fmt.Println("Format: oplog entries")
+	}
+	if b.metadata.Part > 0 {
+		fmt.Println("Volume:", b.metadata.Part)
+	}
+	fmt.Println("Original size:", utils.FormatByteSize(b.metadata.OriginalSize))
+	if b.metadata.Writer != "" {
+		fmt.Println("Written by:", b.metadata.Writer)
+	}
+}
+
+// close releases the reader of the session
+func (b *browser) close() {
+	if b.reader != nil {
+		b.reader.Close()
+		b.reader = nil
+	}
+}
@@ -0,0 +1,155 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"syscall"
+
+	"github.com/sfi2k7/mc/internal/storage"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Error codes reported with a failure in JSON log output, so callers can
+// branch on the reason without matching messages
+const (
+	ErrorCodeUsage      = "usage"
+	ErrorCodeConnection = "connection"
+	ErrorCodeFileFormat = "file-format"
+	ErrorCodeTimeout    = "timeout"
+	ErrorCodeWrite      = "write-error"
+	ErrorCodeNotFound   = "not-found"
+	// ErrorCodePartial marks a run that finished but left some documents
+	// out, e.g. an import with --continue-on-error that had rejections
+	ErrorCodePartial = "partial"
+	// ErrorCodeOther covers every failure not classified above
+	ErrorCodeOther = "other"
+)
+
+// Process exit codes, one per error code; see ExitCode
+const (
+	ExitOther      = 1
+	ExitUsage      = 2
+	ExitConnection = 3
+	ExitFile       = 4
+	ExitTimeout    = 5
+	ExitWrite      = 6
+	ExitPartial    = 7
+)
+
+// exitCodes maps error codes to process exit codes. A missing input file
+// and an unreadable one share ExitFile.
+var exitCodes = map[string]int{
+	ErrorCodeUsage:      ExitUsage,
+	ErrorCodeConnection: ExitConnection,
+	ErrorCodeFileFormat: ExitFile,
+	ErrorCodeNotFound:   ExitFile,
+	ErrorCodeTimeout:    ExitTimeout,
+	ErrorCodeWrite:      ExitWrite,
+	ErrorCodePartial:    ExitPartial,
+}
+
+// ExitCode returns the process exit code for an error returned by Execute
+func ExitCode(err error) int {
+	code, _ := ErrorDetails(err)
+	if exit, ok := exitCodes[code]; ok {
+		return exit
+	}
+	return ExitOther
+}
+
+// codedError attaches an error code and the phase of the run in which it
+// happened to an error
+type codedError struct {
+	code  string
+	phase string
+	err   error
+}
+
+func (e *codedError) Error() string { return e.err.Error() }
+
+func (e *codedError) Unwrap() error { return e.err }
+
+// ErrorDetails classifies an error returned by Execute, returning its code
+// and the phase it happened in: setup, connect, read-header, write or run
+func ErrorDetails(err error) (code, phase string) {
+	var coded *codedError
+	switch {
+	case errors.As(err, &coded):
+		return coded.code, coded.phase
+	case isTimeout(err):
+		return ErrorCodeTimeout, "run"
+	case mongo.IsNetworkError(err):
+		return ErrorCodeConnection, "run"
+	case errors.Is(err, fs.ErrNotExist):
+		return ErrorCodeNotFound, "run"
+	case errors.Is(err, storage.ErrCorruptBatch) || errors.Is(err, storage.ErrDataRegionMismatch):
+		return ErrorCodeFileFormat, "run"
+	default:
+		return ErrorCodeOther, "run"
+	}
+}
+
+// isTimeout reports whether an operation ran out of time
+func isTimeout(err error) bool {
+	return errors.Is(err, context.DeadlineExceeded) || mongo.IsTimeout(err)
+}
+
+// ReportError logs the final error of a run. JSON output adds the error
+// code and phase; text output is the message alone.
+func ReportError(err error) {
+	if !logger.JSON() {
+		logger.Error(err.Error())
+		return
+	}
+	code, phase := ErrorDetails(err)
+	logger.Error(err.Error(), "code", code, "phase", phase)
+}
+
+// usageError marks an error as caused by invalid flags or arguments
+func usageError(err error) error {
+	return &codedError{code: ErrorCodeUsage, phase: "setup", err: err}
+}
+
+// usageErrorf formats an error caused by invalid flags or arguments
+func usageErrorf(format string, args ...interface{}) error {
+	return usageError(fmt.Errorf(format, args...))
+}
+
+// connectError reports a failure to connect to the server
+func connectError(err error) error {
+	return &codedError{code: ErrorCodeConnection, phase: "connect", err: fmt.Errorf("failed to connect to MongoDB: %w", err)}
+}
+
+// headerError turns a ReadHeader failure into a user-facing message
+func headerError(err error) error {
+	var wrapped error
+	switch {
+	case errors.Is(err, storage.ErrInvalidMagic):
+		wrapped = fmt.Errorf("invalid file format: the file may be corrupted or not an MCBZ file: %w", err)
+	case errors.Is(err, storage.ErrUnsupportedVersion):
+		wrapped = fmt.Errorf("unsupported file version: this file was created with a newer version of mc: %w", err)
+	case errors.Is(err, storage.ErrMetadataTooLarge):
+		wrapped = fmt.Errorf("invalid file header: %w", err)
+	default:
+		wrapped = fmt.Errorf("failed to read header: %w", err)
+	}
+	return &codedError{code: ErrorCodeFileFormat, phase: "read-header", err: wrapped}
+}
+
+// writeError explains the common causes of a failed write to path: a full
+// disk and missing permissions. Other messages are kept unchanged.
+func writeError(path string, err error) error {
+	// Exports pass their failures through here, including server ones
+	if isTimeout(err) || mongo.IsNetworkError(err) {
+		return err
+	}
+	switch {
+	case errors.Is(err, syscall.ENOSPC):
+		err = fmt.Errorf("disk full while writing %s: %w", path, err)
+	case errors.Is(err, fs.ErrPermission):
+		err = fmt.Errorf("cannot write to %s: permission denied (try a different output path): %w", path, err)
+	}
+	return &codedError{code: ErrorCodeWrite, phase: "write", err: err}
+}
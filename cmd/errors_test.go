@@ -0,0 +1,37 @@
+package cmd
+
+import (
+	"io"
+	"testing"
+
+	"github.com/sfi2k7/mc/internal/utils"
+)
+
+func TestUsageExitCodes(t *testing.T) {
+	rootCmd.SetOut(io.Discard)
+	rootCmd.SetErr(io.Discard)
+	defer rootCmd.SetOut(nil)
+	defer rootCmd.SetErr(nil)
+
+	tests := [][]string{
+		{"bogus"},
+		{"export", "--bogus"},
+		{"inspect"},
+		{"inspect", "a.mcbz", "b.mcbz"},
+		{"import", "-c", "coll", "in.mcbz"},
+		{"export", "-d", "db", "-c", "coll"},
+		{"export", "-d", "db", "-c", "coll", "--parallel-scan", "2", "--natural", "out.mcbz"},
+		{"export", "-d", "db", "-c", "coll", "--query", "{x", "out.mcbz"},
+	}
+	for _, args := range tests {
+		rootCmd.SetArgs(args)
+		err := Execute(utils.NewLogger())
+		if err == nil {
+			t.Errorf("%v: expected an error", args)
+			continue
+		}
+		if code := ExitCode(err); code != ExitUsage {
+			t.Errorf("%v: exit code %d, want %d (%v)", args, code, ExitUsage, err)
+		}
+	}
+}
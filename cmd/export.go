@@ -2,37 +2,160 @@
 package cmd
 
 import (
+	"bufio"
 	"context"
+	"errors"
 	"fmt"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/sfi2k7/mc/internal/db"
 	"github.com/sfi2k7/mc/internal/storage"
+	"github.com/sfi2k7/mc/internal/transform"
 	"github.com/sfi2k7/mc/internal/utils"
 	"github.com/spf13/cobra"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
+// diskSpaceCompressionRatio is the compression assumed when estimating the
+// output size; real exports usually compress better
+const diskSpaceCompressionRatio = 2
+
+// idMapExtension is appended to the output path to name the --remap-ids
+// mapping file
+const idMapExtension = ".idmap.jsonl"
+
+// exportFlags holds the command line options of the export command
+type exportFlags struct {
+	database         string
+	collection       string
+	query            string
+	queryFile        string
+	relaxedJSON      bool
+	coerceDates      bool
+	appendMode       bool
+	jqExpr           string
+	preset           string
+	level            int
+	windowLog        int
+	compressMetadata bool
+	manifest         bool
+	countTimeout     time.Duration
+	countThreshold   int64
+	trainDict        bool
+	dictSamples      int
+	explain          bool
+	estimateSize     bool
+	estimateSamples  int
+	structureOnly    bool
+	skipBadDocs      bool
+	splitSize        string
+	sortField        string
+	parallelScan     int
+	queueDepth       int
+	dedupBatches     bool
+	ignoreSpace      bool
+	natural          bool
+	metricsFile      string
+	sinceOplog       string
+	remapIDs         string
+	remapRefFields   []string
+	fileMode         string
+	noFooterSeek     bool
+	partitionBy      string
+	maxOpenParts     int
+	sinceField       string
+	watermarkFile    string
+}
+
+// exportWriter is implemented by the single-file and split-volume writers
+type exportWriter interface {
+	db.BatchWriter
+	SetDictionary(dict []byte) error
+	WriteHeader(metadata storage.Metadata) error
+	WriteFooter(metadata storage.Metadata) error
+	Metadata() storage.Metadata
+	BytesWritten() int64
+	WroteTrailer() bool
+	Close() error
+}
+
 func newExportCmd() *cobra.Command {
-	var (
-		database   string
-		collection string
-		query      string
-	)
+	var flags exportFlags
 
 	exportCmd := &cobra.Command{
 		Use:   "export -d DATABASE -c COLLECTION [flags] OUTPUT_FILE",
 		Short: "Export a MongoDB collection to a file",
-		Long:  `Export a MongoDB collection to a compressed BSON file.`,
-		Args:  cobra.ExactArgs(1),
+		Long: `Export a MongoDB collection to a compressed BSON file.
+
+An OUTPUT_FILE without an extension gets the .mcbz extension.`,
+		Annotations: map[string]string{needsConnection: "true"},
+		Args:        cobra.MaximumNArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := resolveQuery(cmd, &flags); err != nil {
+				return err
+			}
+			if flags.explain {
+				return runExplain(flags)
+			}
+			if flags.estimateSize {
+				return runEstimateSize(flags, args)
+			}
+			if len(args) == 0 {
+				return usageErrorf("requires an OUTPUT_FILE argument")
+			}
 			outputFile := args[0]
-			return runExport(database, collection, query, outputFile)
+			metrics := newRunMetrics("export", flags.database, flags.collection)
+			return finishMetrics(flags.metricsFile, metrics, runExport(flags, outputFile, metrics))
 		},
 	}
 
-	exportCmd.Flags().StringVarP(&database, "database", "d", "", "MongoDB database name")
-	exportCmd.Flags().StringVarP(&collection, "collection", "c", "", "MongoDB collection name")
-	exportCmd.Flags().StringVar(&query, "query", "{}", "Query filter in JSON format")
+	exportCmd.Flags().StringVarP(&flags.database, "database", "d", "", "MongoDB database name")
+	exportCmd.Flags().StringVarP(&flags.collection, "collection", "c", "", "MongoDB collection name")
+	exportCmd.Flags().StringVar(&flags.query, "query", "{}", "Query filter in JSON format")
+	exportCmd.Flags().StringVar(&flags.queryFile, "query-file", "", "Read the query filter from a file, which may be gzip or zstd compressed")
+	exportCmd.Flags().BoolVar(&flags.relaxedJSON, "relaxed-json", false, "Allow comments and trailing commas in the query filter")
+	exportCmd.Flags().BoolVar(&flags.coerceDates, "coerce-dates", false, "Treat ISO-8601 strings compared with $gt, $lt, $eq, $in and similar operators in the query as dates")
+	exportCmd.Flags().BoolVar(&flags.appendMode, "append", false, "Append to an existing export file instead of overwriting it")
+	exportCmd.Flags().StringVar(&flags.preset, "compression", "balanced", "Compression preset: fast, balanced or max")
+	exportCmd.Flags().IntVar(&flags.level, "level", 0, "zstd compression level 1-22 (overrides the preset level)")
+	exportCmd.Flags().IntVar(&flags.windowLog, "window-log", 0, "zstd window of 2^N bytes, 10-29 (0 for the level default); larger windows help data that repeats far apart, but export needs about twice the window in memory and import needs the window once")
+	exportCmd.Flags().BoolVar(&flags.compressMetadata, "compress-metadata", false, "Store the header metadata zstd-compressed")
+	exportCmd.Flags().BoolVar(&flags.trainDict, "train-dict", false, "Train a zstd dictionary from sample documents and store it in the file; each run is one compressed stream, so it pays off for small exports and repeated small --append runs, while the stored dictionary adds up to 64 KiB")
+	exportCmd.Flags().IntVar(&flags.dictSamples, "dict-samples", 1000, "Number of documents sampled for --train-dict")
+	exportCmd.Flags().Int64Var(&flags.countThreshold, "count-estimate-threshold", 0, "With a query, skip counting matching documents when the collection is estimated to hold more than this many, and show progress without a total (0 always counts)")
+	exportCmd.Flags().DurationVar(&flags.countTimeout, "count-timeout", 0, "Maximum time for the document count; on expiry the export continues without a progress total (0 for no limit)")
+	exportCmd.Flags().BoolVar(&flags.dedupBatches, "content-hash-dedup", false, "Store a batch identical to the previous one as a reference (files using it need this version of mc to read)")
+	exportCmd.Flags().BoolVar(&flags.ignoreSpace, "ignore-space", false, "Export even when the output filesystem looks too small for the collection")
+	exportCmd.Flags().StringVar(&flags.metricsFile, "metrics-file", "", "Write Prometheus textfile metrics about the run to this file, even when it fails")
+	exportCmd.Flags().StringVar(&flags.fileMode, "file-mode", "0644", "Octal permissions of created output files; the umask still removes bits, and overwritten files keep their permissions")
+	exportCmd.Flags().BoolVar(&flags.noFooterSeek, "no-footer-seek", false, "Write the header after the data instead of seeking back to the start of the file, for filesystems that mishandle the seek (also used automatically when the seek fails)")
+	exportCmd.Flags().BoolVar(&flags.manifest, "manifest", false, "Write a SHA-256 manifest next to the output file")
+	exportCmd.Flags().BoolVar(&flags.structureOnly, "structure-only", false, "Write only the collection options and indexes, without documents")
+	exportCmd.Flags().StringVar(&flags.partitionBy, "partition-by", "", "Write one file per value of this field, e.g. region=US.mcbz, into the directory OUTPUT_FILE; documents without the field go to FIELD=_missing.mcbz, and values whose file names collide (1 and \"1\", or US and us) are kept apart: the lowest BSON type, then the lowest value, keeps the plain name and the others get a ~HASH suffix derived from their type and value. Partitions are written under temporary names until the export finishes and removed if it fails")
+	exportCmd.Flags().IntVar(&flags.maxOpenParts, "max-open-partitions", 64, "Files kept open by --partition-by; beyond that the least recently used one is finished and reopened for append when needed")
+	exportCmd.Flags().StringVar(&flags.splitSize, "split-size", "", "Roll over to a new numbered volume when the output reaches this size, e.g. 2GB")
+	exportCmd.Flags().IntVar(&flags.parallelScan, "parallel-scan", 1, "Split the _id space into N ranges and scan them concurrently (needs a uniform _id distribution of a single type)")
+	exportCmd.Flags().BoolVar(&flags.natural, "natural", false, "Return documents in storage order; usually the fastest full scan (cannot be combined with --parallel-scan)")
+	exportCmd.Flags().IntVar(&flags.queueDepth, "queue-depth", 0, "Batches buffered between --parallel-scan scanners and the writer (0 for one per range); memory grows by about depth x --batch-size x average document size")
+	exportCmd.Flags().StringVar(&flags.sortField, "sort-for-compression", "", "Sort each batch by this field before compressing; only the order within a batch changes")
+	exportCmd.Flags().BoolVar(&flags.skipBadDocs, "skip-unmarshalable", false, "Log and skip documents that fail to marshal instead of failing the export")
+	exportCmd.Flags().BoolVar(&flags.explain, "explain", false, "Print the query plan for the export filter instead of exporting")
+	exportCmd.Flags().BoolVar(&flags.estimateSize, "estimate-size", false, "Compress a random sample of documents and print the predicted output size instead of exporting; OUTPUT_FILE is optional and only used to report free space")
+	exportCmd.Flags().IntVar(&flags.estimateSamples, "estimate-samples", 1000, "Number of documents sampled for --estimate-size")
+	exportCmd.Flags().StringVar(&flags.sinceField, "since-field", "", "Export only documents whose value of this field is greater than the one recorded in --watermark-file; it must only grow, e.g. an insert time or ObjectId _id")
+	exportCmd.Flags().StringVar(&flags.watermarkFile, "watermark-file", "", "With --since-field, start after the value recorded in this file and record the largest value exported once the export succeeds; without the file, everything is exported")
+	exportCmd.Flags().StringVar(&flags.sinceOplog, "since-oplog", "", "Export the inserts, updates and deletes recorded in the replica set oplog after this timestamp (seconds[:increment] or RFC 3339) or after the end of this earlier oplog export; needs find on local.oplog.rs")
+	exportCmd.Flags().StringVar(&flags.remapIDs, "remap-ids", "", "Replace each _id with a sequential number (sequential) or an ObjectId derived from its hash (hash), writing the mapping to OUTPUT_FILE"+idMapExtension)
+	exportCmd.Flags().StringSliceVar(&flags.remapRefFields, "remap-ref-fields", nil, "Comma-separated fields holding _id references, rewritten with the --remap-ids mapping; only references to ids seen in this export stay resolvable")
+	exportCmd.Flags().StringVar(&flags.jqExpr, "jq", "", "jq expression applied to each document in canonical extended JSON (empty result skips the document)")
 
 	exportCmd.MarkFlagRequired("database")
 	exportCmd.MarkFlagRequired("collection")
@@ -40,31 +163,297 @@ func newExportCmd() *cobra.Command {
 	return exportCmd
 }
 
-func runExport(database, collection, queryStr, outputFile string) error {
+// resolveQuery loads the query filter from --query-file if given and
+// checks it, so syntax errors are reported before connecting
+func resolveQuery(cmd *cobra.Command, flags *exportFlags) error {
+	if flags.queryFile != "" {
+		if cmd.Flags().Changed("query") {
+			return usageErrorf("--query and --query-file cannot be used together")
+		}
+		data, err := storage.ReadAuxFile(flags.queryFile)
+		if err != nil {
+			return fmt.Errorf("failed to read query file: %w", err)
+		}
+		flags.query = string(data)
+	}
+
+	query, err := db.NormalizeQuery(flags.query, flags.relaxedJSON)
+	if err != nil {
+		return usageError(err)
+	}
+	if flags.coerceDates {
+		if query, err = db.CoerceQueryDates(query); err != nil {
+			return usageError(err)
+		}
+	}
+	flags.query = query
+	return nil
+}
+
+// parseFileMode parses --file-mode as octal permission bits
+func parseFileMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode == 0 || mode > 0777 {
+		return 0, usageErrorf("invalid --file-mode %q (expected octal permissions such as 0640)", s)
+	}
+	return os.FileMode(mode), nil
+}
+
+// resolveOplogStart checks that --since-oplog is not combined with options
+// that only apply to documents and returns the timestamp to export from.
+// The value is either a timestamp or the path of an earlier oplog export of
+// the same collection, which continues the chain where that file ended.
+func resolveOplogStart(flags exportFlags) (primitive.Timestamp, error) {
+	switch {
+	case flags.query != "{}":
+		return primitive.Timestamp{}, usageErrorf("--since-oplog cannot be combined with --query")
+	case flags.jqExpr != "":
+		return primitive.Timestamp{}, usageErrorf("--since-oplog cannot be combined with --jq")
+	case flags.parallelScan > 1 || flags.natural || flags.sortField != "":
+		return primitive.Timestamp{}, usageErrorf("--since-oplog reads the oplog in order and cannot be combined with --parallel-scan, --natural or --sort-for-compression")
+	case flags.appendMode || flags.splitSize != "" || flags.partitionBy != "":
+		return primitive.Timestamp{}, usageErrorf("--since-oplog cannot be combined with --append, --split-size or --partition-by")
+	case flags.structureOnly || flags.trainDict:
+		return primitive.Timestamp{}, usageErrorf("--since-oplog cannot be combined with --structure-only or --train-dict")
+	case flags.remapIDs != "":
+		return primitive.Timestamp{}, usageErrorf("--since-oplog cannot be combined with --remap-ids")
+	}
+
+	if !fileExists(flags.sinceOplog) {
+		start, err := db.ParseOplogTimestamp(flags.sinceOplog)
+		if err != nil {
+			return start, usageError(err)
+		}
+		return start, nil
+	}
+	reader, err := storage.NewFileReader(flags.sinceOplog)
+	if err != nil {
+		return primitive.Timestamp{}, fmt.Errorf("failed to open %s: %w", flags.sinceOplog, err)
+	}
+	defer reader.Close()
+	previous, err := reader.ReadHeader()
+	if err != nil {
+		return primitive.Timestamp{}, headerError(err)
+	}
+	if previous.Format != storage.FormatOplog || previous.OplogEnd.IsZero() {
+		return primitive.Timestamp{}, fmt.Errorf("%s is not an oplog export", flags.sinceOplog)
+	}
+	if previous.Database != flags.database || previous.Collection != flags.collection {
+		return primitive.Timestamp{}, fmt.Errorf("%s holds the oplog of %s.%s, not %s.%s",
+			flags.sinceOplog, previous.Database, previous.Collection, flags.database, flags.collection)
+	}
+	return previous.OplogEnd, nil
+}
+
+func runExport(flags exportFlags, outputFile string, metrics *runMetrics) error {
+	database, collection := flags.database, flags.collection
+
+	// Give extensionless output paths the canonical extension; with
+	// --partition-by the path names a directory
+	if flags.partitionBy == "" && filepath.Ext(outputFile) == "" {
+		outputFile += storage.FileExtension
+	}
+
+	compression, err := storage.ResolveCompression(flags.preset, flags.level)
+	if err != nil {
+		return usageError(err)
+	}
+	if err := storage.ValidateWindowLog(flags.windowLog); err != nil {
+		return usageError(err)
+	}
+	compression.WindowLog = flags.windowLog
+	compression.CompressMetadata = flags.compressMetadata
+	compression.DedupBatches = flags.dedupBatches
+	compression.NoFooterSeek = flags.noFooterSeek
+	if compression.FileMode, err = parseFileMode(flags.fileMode); err != nil {
+		return err
+	}
+
+	if flags.countThreshold < 0 {
+		return usageErrorf("--count-estimate-threshold must not be negative")
+	}
+	if flags.parallelScan < 1 {
+		return usageErrorf("--parallel-scan must be at least 1")
+	}
+	if flags.natural && flags.parallelScan > 1 {
+		return usageErrorf("--natural cannot be combined with --parallel-scan, whose _id ranges need an index")
+	}
+	if flags.queueDepth < 0 {
+		return usageErrorf("--queue-depth must not be negative")
+	}
+	if flags.remapIDs != "" && !db.ValidRemapMode(flags.remapIDs) {
+		return usageErrorf("invalid --remap-ids mode %q (expected sequential or hash)", flags.remapIDs)
+	}
+	if len(flags.remapRefFields) > 0 && flags.remapIDs == "" {
+		return usageErrorf("--remap-ref-fields requires --remap-ids")
+	}
+	if flags.noFooterSeek && flags.appendMode {
+		return usageErrorf("--no-footer-seek cannot be combined with --append, which rewrites the header in place")
+	}
+	if flags.remapIDs != "" && flags.appendMode {
+		return usageErrorf("--remap-ids cannot be combined with --append, whose existing documents were mapped by another run")
+	}
+	if (flags.sinceField == "") != (flags.watermarkFile == "") {
+		return usageErrorf("--since-field and --watermark-file must be used together")
+	}
+	if flags.sinceField != "" && (flags.sinceOplog != "" || flags.structureOnly) {
+		return usageErrorf("--since-field cannot be combined with --since-oplog or --structure-only")
+	}
+	if flags.sinceField != "" && (flags.remapIDs != "" || flags.jqExpr != "") {
+		// The watermark is read from the documents as written, which would
+		// record rewritten values the next run's filter cannot match
+		return usageErrorf("--since-field cannot be combined with --remap-ids or --jq")
+	}
+	var watermark storage.Watermark
+	var hasWatermark bool
+	if flags.watermarkFile != "" {
+		if watermark, hasWatermark, err = readWatermark(flags); err != nil {
+			return err
+		}
+		if hasWatermark {
+			if flags.query, err = watermarkQuery(flags.query, watermark); err != nil {
+				return err
+			}
+			logger.Info("Continuing after watermark", "field", watermark.Field, "value", watermark.Value, "file", flags.watermarkFile)
+		} else {
+			logger.Info("No watermark yet; exporting all documents", "file", flags.watermarkFile)
+		}
+	}
+	if flags.partitionBy != "" {
+		if err := checkPartitionFlags(flags); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(outputFile, 0777); err != nil {
+			return fmt.Errorf("failed to create output directory: %w", writeError(outputFile, err))
+		}
+	}
+
+	var oplogSince primitive.Timestamp
+	if flags.sinceOplog != "" {
+		if oplogSince, err = resolveOplogStart(flags); err != nil {
+			return err
+		}
+	}
+	if uint64(flags.parallelScan) > maxPoolSize {
+		logger.Warn("--parallel-scan exceeds --max-pool-size; scanners will wait for connections",
+			"parallel_scan", flags.parallelScan, "max_pool_size", maxPoolSize)
+	}
+
+	var splitSize int64
+	if flags.splitSize != "" {
+		splitSize, err = utils.ParseByteSize(flags.splitSize)
+		if err != nil {
+			return usageErrorf("invalid --split-size: %w", err)
+		}
+		if splitSize <= 0 {
+			return usageErrorf("--split-size must be positive")
+		}
+		if flags.appendMode {
+			return usageErrorf("--split-size cannot be combined with --append")
+		}
+	}
+
+	writeCheckPath := outputFile
+	if flags.partitionBy != "" {
+		writeCheckPath = filepath.Join(outputFile, storage.PartitionPath("", flags.partitionBy, storage.PartitionMissing))
+	}
+	if err := checkWritable(writeCheckPath, flags.appendMode); err != nil {
+		return err
+	}
+
+	// Compile the transform before doing any work
+	var transformer *transform.Transformer
+	if flags.jqExpr != "" {
+		transformer, err = transform.NewTransformer(flags.jqExpr)
+		if err != nil {
+			return usageError(err)
+		}
+	}
+
 	// Create context with timeout
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
 	defer cancel()
 
 	// Connect to MongoDB
-	client, err := db.Connect(ctx, uri, host, port)
+	connOpts, err := connectOptions()
+	if err != nil {
+		return err
+	}
+	client, err := db.Connect(ctx, connOpts)
 	if err != nil {
-		return fmt.Errorf("failed to connect to MongoDB: %w", err)
+		return connectError(err)
 	}
 	defer client.Disconnect(ctx)
 
-	// Create file writer
-	fileWriter, err := storage.NewFileWriter(outputFile)
-	if err != nil {
-		return fmt.Errorf("failed to create output file: %w", err)
+	if !flags.structureOnly && flags.sinceOplog == "" {
+		if err := checkDiskSpace(ctx, client, flags, outputFile); err != nil {
+			return err
+		}
+	}
+
+	// Create file writer, extending the existing file in append mode
+	var fileWriter exportWriter
+	var existingDocs int64
+	switch {
+	case flags.appendMode && fileExists(outputFile):
+		appendWriter, err := storage.NewAppendWriter(outputFile, compression)
+		if err != nil {
+			return fmt.Errorf("failed to open output file for append: %w", writeError(outputFile, err))
+		}
+		fileWriter = appendWriter
+		existingDocs = fileWriter.Metadata().DocumentCount
+		logger.Info("Appending to existing file", "file", outputFile, "existing_docs", existingDocs)
+		if flags.trainDict {
+			logger.Warn("Ignoring --train-dict when appending; the file keeps its original dictionary setting")
+		}
+	default:
+		if flags.partitionBy != "" {
+			fileWriter, err = storage.NewPartitionWriter(outputFile, flags.partitionBy, compression, flags.maxOpenParts)
+		} else if splitSize > 0 {
+			fileWriter, err = storage.NewVolumeWriter(outputFile, compression, splitSize)
+		} else {
+			fileWriter, err = storage.NewFileWriter(outputFile, compression)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to create output file: %w", writeError(outputFile, err))
+		}
+		if flags.trainDict {
+			if err := trainDictionary(ctx, client, flags, compression, fileWriter); err != nil {
+				return err
+			}
+		}
 	}
 	defer fileWriter.Close()
 
+	logger.Info("Compression settings",
+		"codec", storage.Codec,
+		"level", compression.Level,
+		"encoder", compression.EncoderLevel(),
+		"threads", compression.Concurrency)
+
 	// Prepare metadata
 	metadata := storage.Metadata{
 		Database:   database,
 		Collection: collection,
 		Timestamp:  time.Now().Unix(),
 		Source:     fmt.Sprintf("%s:%d", host, port),
+		Writer:     "mc " + Version,
+	}
+	if flags.sinceOplog != "" {
+		metadata.Format = storage.FormatOplog
+	}
+
+	// Capture the collection structure so import can recreate it
+	metadata.Options, metadata.Indexes, err = db.CollectionStructure(ctx, client, database, collection)
+	if err != nil {
+		if flags.structureOnly {
+			return err
+		}
+		logger.Warn("Could not read collection options and indexes", "error", err)
+	}
+	metadata.CollectionUUID, err = db.CollectionUUID(ctx, client, database, collection)
+	if err != nil {
+		logger.Warn("Could not read the collection UUID", "error", err)
 	}
 
 	// Write header
@@ -73,29 +462,462 @@ func runExport(database, collection, queryStr, outputFile string) error {
 	}
 
 	// Initialize progress bar
-	progress := utils.NewProgressBar("Exporting")
+	progress := newProgressBar("Exporting")
+	if !progressBytes() {
+		progress.SetInitial(existingDocs)
+	}
+	stopStats := startStatsLogger(progress)
+	defer stopStats()
+
+	// Open the id mapping; mappings are streamed to it as ids are first seen
+	var remapper *db.IDRemapper
+	var idMap *bufio.Writer
+	if flags.remapIDs != "" {
+		idMapFile, err := os.OpenFile(outputFile+idMapExtension, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, compression.FileMode)
+		if err != nil {
+			return fmt.Errorf("failed to create id mapping: %w", writeError(outputFile+idMapExtension, err))
+		}
+		defer idMapFile.Close()
+		idMap = bufio.NewWriter(idMapFile)
+		remapper = db.NewIDRemapper(flags.remapIDs, flags.remapRefFields, idMap)
+	}
 
 	// Export collection
-	docCount, err := db.ExportCollection(
-		ctx,
-		client,
-		database,
-		collection,
-		queryStr,
-		batchSize,
-		fileWriter,
-		progress,
-	)
+	var result db.ExportResult
+	if flags.sinceOplog != "" {
+		var oplogResult db.OplogResult
+		oplogResult, err = db.ExportOplog(ctx, client, database, collection,
+			db.OplogOptions{
+				Since:         oplogSince,
+				BatchSize:     batchSize,
+				ProgressBytes: progressBytes(),
+				Logger:        logger,
+			},
+			fileWriter,
+			progress,
+		)
+		result.Exported = oplogResult.Exported
+		metadata.OplogEnd = oplogResult.End
+	} else {
+		result, err = db.ExportCollection(
+			ctx,
+			client,
+			database,
+			collection,
+			db.ExportOptions{
+				Query:             flags.query,
+				BatchSize:         batchSize,
+				Transform:         transformer,
+				CountTimeout:      flags.countTimeout,
+				CountThreshold:    flags.countThreshold,
+				StructureOnly:     flags.structureOnly,
+				SkipUnmarshalable: flags.skipBadDocs,
+				ParallelScan:      flags.parallelScan,
+				QueueDepth:        flags.queueDepth,
+				Natural:           flags.natural,
+				RemapIDs:          remapper,
+				SortField:         flags.sortField,
+				MaxField:          flags.sinceField,
+				ProgressBytes:     progressBytes(),
+				Logger:            logger,
+			},
+			fileWriter,
+			progress,
+		)
+	}
+	stopStats()
+	progress.Finish()
+	metrics.docs = result.Exported
 	if err != nil {
-		return fmt.Errorf("export failed: %w", err)
+		return fmt.Errorf("export failed: %w", writeError(outputFile, err))
+	}
+
+	if idMap != nil {
+		if err := idMap.Flush(); err != nil {
+			return fmt.Errorf("failed to write id mapping: %w", writeError(outputFile+idMapExtension, err))
+		}
 	}
 
 	// Update metadata with doc count and finalize
-	metadata.DocumentCount = docCount
+	metadata.DocumentCount = result.Exported
 	if err := fileWriter.WriteFooter(metadata); err != nil {
-		return fmt.Errorf("failed to write footer: %w", err)
+		return fmt.Errorf("failed to write footer: %w", writeError(outputFile, err))
+	}
+
+	metrics.bytes = fileWriter.BytesWritten()
+	if fileWriter.WroteTrailer() && !flags.noFooterSeek {
+		logger.Warn("Could not seek back to the start of the output; the header was written as a trailer after the data instead")
 	}
 
-	logger.Info("Export completed", "docs", docCount, "file", outputFile)
+	volumes := []storage.Volume{{Path: outputFile, DocumentCount: fileWriter.Metadata().DocumentCount}}
+	switch writer := fileWriter.(type) {
+	case *storage.VolumeWriter:
+		volumes = writer.Volumes()
+	case *storage.PartitionWriter:
+		volumes = writer.Partitions()
+	}
+
+	// The manifest has to hash the finished file
+	if flags.manifest {
+		if err := fileWriter.Close(); err != nil {
+			return fmt.Errorf("failed to close output file: %w", err)
+		}
+		for _, volume := range volumes {
+			manifestPath, err := storage.WriteManifest(volume.Path, volume.DocumentCount)
+			if err != nil {
+				return fmt.Errorf("failed to write manifest: %w", err)
+			}
+			logger.Info("Manifest written", "file", manifestPath)
+		}
+	}
+
+	if transformer != nil {
+		logger.Info("Transform applied", "modified", transformer.Modified(), "dropped", transformer.Dropped())
+	}
+	if remapper != nil {
+		logger.Info("Ids remapped", "mode", flags.remapIDs, "ids", remapper.Mapped(), "mapping", outputFile+idMapExtension)
+	}
+	if result.Skipped > 0 {
+		logger.Warn("Documents skipped because they failed to marshal", "skipped", result.Skipped)
+	}
+	if splitSize > 0 {
+		for _, volume := range volumes {
+			logger.Info("Volume written", "file", volume.Path, "docs", volume.DocumentCount)
+		}
+	}
+	if flags.partitionBy != "" {
+		for _, volume := range volumes {
+			logger.Info("Partition written", "value", volume.Partition, "file", filepath.Base(volume.Path), "docs", volume.DocumentCount)
+		}
+		logger.Info("Partitions written", "field", flags.partitionBy, "files", len(volumes), "dir", outputFile)
+	}
+	if flags.watermarkFile != "" {
+		if err := saveWatermark(flags, result, watermark, hasWatermark); err != nil {
+			return err
+		}
+	}
+	if flags.sinceOplog != "" {
+		logger.Info("Oplog exported", "since", db.FormatOplogTimestamp(oplogSince), "until", db.FormatOplogTimestamp(metadata.OplogEnd))
+	}
+	logger.Info("Export completed",
+		"docs", result.Exported,
+		"indexes", len(metadata.Indexes),
+		"file", outputFile,
+		"size", utils.FormatByteSize(fileWriter.BytesWritten()))
 	return nil
 }
+
+// readWatermark loads the watermark of an incremental export and checks it
+// was recorded for the same collection and field
+func readWatermark(flags exportFlags) (storage.Watermark, bool, error) {
+	watermark, ok, err := storage.ReadWatermark(flags.watermarkFile)
+	if err != nil || !ok {
+		return watermark, ok, err
+	}
+	if watermark.Database != flags.database || watermark.Collection != flags.collection || watermark.Field != flags.sinceField {
+		return watermark, false, fmt.Errorf("%s records %s of %s.%s, not %s of %s.%s",
+			flags.watermarkFile, watermark.Field, watermark.Database, watermark.Collection,
+			flags.sinceField, flags.database, flags.collection)
+	}
+	return watermark, true, nil
+}
+
+// watermarkQuery restricts a query to documents past the watermark
+func watermarkQuery(query string, watermark storage.Watermark) (string, error) {
+	condition, err := bson.MarshalExtJSON(bson.D{{Key: watermark.Field, Value: bson.D{{Key: "$gt", Value: watermark.Value}}}}, true, false)
+	if err != nil {
+		return "", fmt.Errorf("failed to build watermark filter: %w", err)
+	}
+	if query == "{}" {
+		return string(condition), nil
+	}
+	return `{"$and":[` + query + `,` + string(condition) + `]}`, nil
+}
+
+// saveWatermark records the largest value exported for the next run. When
+// nothing new was exported the previous watermark is kept.
+func saveWatermark(flags exportFlags, result db.ExportResult, previous storage.Watermark, hasPrevious bool) error {
+	if result.MaxValue == nil {
+		if result.Exported > 0 {
+			logger.Warn("No exported document had the --since-field; the watermark is unchanged", "field", flags.sinceField)
+		} else if hasPrevious {
+			logger.Info("No new documents; the watermark is unchanged", "value", previous.Value)
+		}
+		return nil
+	}
+
+	watermark := storage.Watermark{
+		Database:   flags.database,
+		Collection: flags.collection,
+		Field:      flags.sinceField,
+		Value:      result.MaxValue,
+		Timestamp:  time.Now().Unix(),
+	}
+	if err := storage.WriteWatermark(flags.watermarkFile, watermark); err != nil {
+		return fmt.Errorf("failed to write watermark: %w", writeError(flags.watermarkFile, err))
+	}
+	logger.Info("Watermark recorded", "field", flags.sinceField, "value", result.MaxValue, "file", flags.watermarkFile)
+	return nil
+}
+
+// checkPartitionFlags rejects options that cannot be combined with
+// --partition-by
+func checkPartitionFlags(flags exportFlags) error {
+	switch {
+	case flags.maxOpenParts < 1:
+		return usageErrorf("--max-open-partitions must be at least 1")
+	case flags.appendMode || flags.splitSize != "":
+		return usageErrorf("--partition-by cannot be combined with --append or --split-size")
+	case flags.structureOnly:
+		return usageErrorf("--partition-by cannot be combined with --structure-only, which writes no documents to route")
+	case flags.noFooterSeek:
+		return usageErrorf("--partition-by cannot be combined with --no-footer-seek, since partitions closed to stay within --max-open-partitions are reopened for append")
+	}
+	return nil
+}
+
+// runExplain prints the winning query plan for the export filter so missing
+// indexes show up before a long export
+func runExplain(flags exportFlags) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	connOpts, err := connectOptions()
+	if err != nil {
+		return err
+	}
+	client, err := db.Connect(ctx, connOpts)
+	if err != nil {
+		return connectError(err)
+	}
+	defer client.Disconnect(ctx)
+
+	plan, err := db.ExplainQuery(ctx, client, flags.database, flags.collection, flags.query)
+	if err != nil {
+		return err
+	}
+
+	indexes := "none"
+	if len(plan.Indexes) > 0 {
+		indexes = strings.Join(plan.Indexes, ", ")
+	}
+	collScan := "no"
+	if plan.CollectionScan {
+		collScan = "yes"
+	}
+
+	fmt.Println("=== Query Plan ===")
+	fmt.Println("Namespace:", plan.Namespace)
+	fmt.Println("Filter:", flags.query)
+	fmt.Println("Index used:", indexes)
+	fmt.Println("Collection scan:", collScan)
+	fmt.Println("")
+	fmt.Println("=== Winning Plan ===")
+	for _, stage := range plan.Stages {
+		line := strings.Repeat("  ", stage.Depth) + stage.Stage
+		if stage.IndexName != "" {
+			line += " (" + stage.IndexName + ")"
+		}
+		fmt.Println(line)
+	}
+
+	if plan.CollectionScan && flags.query != "{}" {
+		logger.Warn("The filter is not served by an index; the export will scan the whole collection")
+	}
+	return nil
+}
+
+// runEstimateSize compresses a random sample of the documents to export
+// and extrapolates the output size to all of them. The range combines the
+// spread of the compression ratio within the sample with the uncertainty of
+// the average document size when the total comes from the sample too.
+func runEstimateSize(flags exportFlags, args []string) error {
+	if flags.estimateSamples < 1 {
+		return usageErrorf("--estimate-samples must be at least 1")
+	}
+	compression, err := storage.ResolveCompression(flags.preset, flags.level)
+	if err != nil {
+		return usageError(err)
+	}
+	if err := storage.ValidateWindowLog(flags.windowLog); err != nil {
+		return usageError(err)
+	}
+	compression.WindowLog = flags.windowLog
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+	defer cancel()
+
+	connOpts, err := connectOptions()
+	if err != nil {
+		return err
+	}
+	client, err := db.Connect(ctx, connOpts)
+	if err != nil {
+		return connectError(err)
+	}
+	defer client.Disconnect(ctx)
+
+	count, estimated, err := db.CountMatching(ctx, client, flags.database, flags.collection, flags.query)
+	if err != nil {
+		return err
+	}
+	countNote := "counted"
+	if estimated {
+		countNote = "estimated"
+	}
+
+	fmt.Println("=== Size Estimate ===")
+	fmt.Println("Namespace:", flags.database+"."+flags.collection)
+	fmt.Println("Filter:", flags.query)
+	fmt.Printf("Documents: %d (%s)\n", count, countNote)
+	if count == 0 {
+		fmt.Println("Predicted output: nothing to export")
+		return nil
+	}
+
+	samples, err := db.SampleRandomDocuments(ctx, client, flags.database, flags.collection, flags.query, flags.estimateSamples)
+	if err != nil {
+		return fmt.Errorf("failed to sample documents: %w", err)
+	}
+	sample, err := storage.EstimateCompression(samples, compression)
+	if err != nil {
+		return err
+	}
+
+	// Without a filter collStats gives the data size; otherwise it is
+	// extrapolated from the average sampled document
+	mean := float64(sample.RawBytes) / float64(sample.Documents)
+	rawLow, rawHigh := mean*float64(count), mean*float64(count)
+	var dataSize int64
+	if flags.query == "{}" {
+		dataSize, err = db.CollectionDataSize(ctx, client, flags.database, flags.collection)
+		if err != nil {
+			logger.Warn("Extrapolating the data size from the sample", "error", err)
+		}
+	}
+	switch {
+	case dataSize > 0:
+		rawLow = float64(dataSize + 4*count)
+		rawHigh = rawLow
+	case int64(sample.Documents) < count:
+		margin := 1.96 * sample.SizeStdDev / math.Sqrt(float64(sample.Documents)) * float64(count)
+		rawLow = math.Max(rawLow-margin, 0)
+		rawHigh += margin
+	}
+	ratioLow, ratioHigh := sample.RatioRange(count)
+	predicted := int64((rawLow + rawHigh) / 2 * sample.Ratio)
+	low := int64(rawLow * ratioLow)
+	high := int64(rawHigh * ratioHigh)
+
+	fmt.Printf("Sampled: %d documents (%s)\n", sample.Documents, utils.FormatByteSize(sample.RawBytes))
+	fmt.Printf("Compression: zstd level %d, sample ratio %.3f (%.3f-%.3f)\n", compression.Level, sample.Ratio, ratioLow, ratioHigh)
+	fmt.Printf("Uncompressed data: %s\n", utils.FormatByteSize(int64((rawLow+rawHigh)/2)))
+	fmt.Printf("Predicted output: %s (likely %s to %s)\n",
+		utils.FormatByteSize(predicted), utils.FormatByteSize(low), utils.FormatByteSize(high))
+	if len(args) > 0 {
+		if available, ok := freeSpace(filepath.Dir(args[0])); ok {
+			fmt.Printf("Available on output filesystem: %s\n", utils.FormatByteSize(available))
+			if high > available {
+				logger.Warn("The export may not fit on the output filesystem",
+					"predicted_high", utils.FormatByteSize(high), "available", utils.FormatByteSize(available))
+			}
+		}
+	}
+	if flags.trainDict {
+		logger.Info("The estimate does not account for --train-dict")
+	}
+	return nil
+}
+
+// trainDictionary samples documents from the collection and configures the
+// writer to compress with a dictionary trained on them
+func trainDictionary(
+	ctx context.Context,
+	client *mongo.Client,
+	flags exportFlags,
+	compression storage.CompressionOptions,
+	fileWriter exportWriter,
+) error {
+	samples, err := db.SampleDocuments(ctx, client, flags.database, flags.collection, flags.query, flags.dictSamples)
+	if err != nil {
+		return fmt.Errorf("failed to sample documents for dictionary: %w", err)
+	}
+
+	dict, err := storage.BuildDictionary(samples, compression)
+	if err != nil {
+		return err
+	}
+	if err := fileWriter.SetDictionary(dict); err != nil {
+		return fmt.Errorf("failed to set dictionary: %w", err)
+	}
+
+	logger.Info("Trained compression dictionary", "samples", len(samples), "size", utils.FormatByteSize(int64(len(dict))))
+	return nil
+}
+
+// checkDiskSpace compares a conservative estimate of the output size with
+// the space available for it. The estimate assumes only 2:1 compression of
+// the collection's data size, since the real ratio is unknown up front. A
+// shortfall is an error unless --ignore-space is set, or a query limits the
+// export to part of the collection. The check is skipped when either number
+// cannot be determined.
+func checkDiskSpace(ctx context.Context, client *mongo.Client, flags exportFlags, outputFile string) error {
+	available, ok := freeSpace(filepath.Dir(outputFile))
+	if !ok {
+		return nil
+	}
+	dataSize, err := db.CollectionDataSize(ctx, client, flags.database, flags.collection)
+	if err != nil {
+		logger.Warn("Skipping the disk space check", "error", err)
+		return nil
+	}
+
+	estimate := dataSize / diskSpaceCompressionRatio
+	if estimate <= available {
+		return nil
+	}
+	if flags.ignoreSpace || flags.query != "{}" {
+		logger.Warn("Output filesystem may be too small for the export",
+			"estimated", utils.FormatByteSize(estimate), "available", utils.FormatByteSize(available))
+		return nil
+	}
+	return fmt.Errorf("export needs an estimated %s but only %s is available on the output filesystem (use --ignore-space to try anyway)",
+		utils.FormatByteSize(estimate), utils.FormatByteSize(available))
+}
+
+// checkWritable makes sure before any work is done that the output file can
+// be created, or opened for writing when appending to it
+func checkWritable(path string, appending bool) error {
+	dir := filepath.Dir(path)
+	info, err := os.Stat(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("output directory %s does not exist", dir)
+	}
+	if err != nil {
+		return writeError(dir, err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("output directory %s is not a directory", dir)
+	}
+
+	if appending && fileExists(path) {
+		f, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			return writeError(path, err)
+		}
+		return f.Close()
+	}
+
+	f, err := os.CreateTemp(dir, ".mc-write-check-*")
+	if err != nil {
+		return writeError(dir, err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// fileExists reports whether a regular file exists at path
+func fileExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && !info.IsDir()
+}
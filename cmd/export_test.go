@@ -0,0 +1,133 @@
+package cmd
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/sfi2k7/mc/internal/db"
+	"github.com/sfi2k7/mc/internal/storage"
+	"github.com/sfi2k7/mc/internal/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func init() {
+	logger = utils.NewLogger()
+}
+
+func TestWatermarkQuery(t *testing.T) {
+	date := primitive.NewDateTimeFromTime(time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC))
+	watermark := storage.Watermark{Field: "updatedAt", Value: date}
+
+	tests := []struct {
+		query string
+		want  bson.D
+	}{
+		{"{}", bson.D{{Key: "updatedAt", Value: bson.D{{Key: "$gt", Value: date}}}}},
+		{`{"status":"active"}`, bson.D{{Key: "$and", Value: bson.A{
+			bson.D{{Key: "status", Value: "active"}},
+			bson.D{{Key: "updatedAt", Value: bson.D{{Key: "$gt", Value: date}}}},
+		}}}},
+	}
+	for _, tt := range tests {
+		query, err := watermarkQuery(tt.query, watermark)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Compare in canonical form, whatever the spacing of the query
+		var got bson.D
+		if err := bson.UnmarshalExtJSON([]byte(query), true, &got); err != nil {
+			t.Fatalf("%s: invalid query %s: %v", tt.query, query, err)
+		}
+		gotJSON, _ := bson.MarshalExtJSON(got, true, false)
+		wantJSON, _ := bson.MarshalExtJSON(tt.want, true, false)
+		if string(gotJSON) != string(wantJSON) {
+			t.Errorf("%s: got %s, want %s", tt.query, gotJSON, wantJSON)
+		}
+	}
+}
+
+func TestReadWatermarkMismatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "watermark.json")
+	flags := exportFlags{database: "db", collection: "coll", sinceField: "updatedAt", watermarkFile: path}
+
+	if _, ok, err := readWatermark(flags); ok || err != nil {
+		t.Fatalf("no watermark yet: got %v, %v", ok, err)
+	}
+
+	if err := storage.WriteWatermark(path, storage.Watermark{Database: "db", Collection: "coll", Field: "updatedAt", Value: int64(5)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := readWatermark(flags); !ok || err != nil {
+		t.Fatalf("matching watermark: got %v, %v", ok, err)
+	}
+
+	for _, other := range []exportFlags{
+		{database: "other", collection: "coll", sinceField: "updatedAt", watermarkFile: path},
+		{database: "db", collection: "other", sinceField: "updatedAt", watermarkFile: path},
+		{database: "db", collection: "coll", sinceField: "_id", watermarkFile: path},
+	} {
+		if _, _, err := readWatermark(other); err == nil {
+			t.Errorf("%s.%s %s: expected a mismatch error", other.database, other.collection, other.sinceField)
+		}
+	}
+}
+
+func TestSaveWatermark(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "watermark.json")
+	flags := exportFlags{database: "db", collection: "coll", sinceField: "seq", watermarkFile: path}
+
+	// Nothing exported on the first run: no watermark is written
+	if err := saveWatermark(flags, db.ExportResult{}, storage.Watermark{}, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := storage.ReadWatermark(path); ok {
+		t.Fatal("watermark written without a value")
+	}
+
+	if err := saveWatermark(flags, db.ExportResult{Exported: 3, MaxValue: int64(42)}, storage.Watermark{}, false); err != nil {
+		t.Fatal(err)
+	}
+	watermark, ok, err := storage.ReadWatermark(path)
+	if err != nil || !ok {
+		t.Fatalf("ReadWatermark = %v, %v", ok, err)
+	}
+	if watermark.Value != int64(42) || watermark.Field != "seq" || watermark.Database != "db" || watermark.Collection != "coll" {
+		t.Fatalf("unexpected watermark %#v", watermark)
+	}
+
+	// A run that found nothing new keeps the previous watermark
+	if err := saveWatermark(flags, db.ExportResult{}, watermark, true); err != nil {
+		t.Fatal(err)
+	}
+	if kept, _, _ := storage.ReadWatermark(path); kept.Value != int64(42) {
+		t.Fatalf("watermark changed to %v", kept.Value)
+	}
+}
+
+func TestResolveQueryGzipFile(t *testing.T) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write([]byte(`{"status": "active"}`))
+	w.Close()
+	path := filepath.Join(t.TempDir(), "query.json.gz")
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	flags := exportFlags{query: "{}", queryFile: path}
+	if err := resolveQuery(newExportCmd(), &flags); err != nil {
+		t.Fatal(err)
+	}
+	var got bson.D
+	if err := bson.UnmarshalExtJSON([]byte(flags.query), false, &got); err != nil {
+		t.Fatalf("invalid query %s: %v", flags.query, err)
+	}
+	if len(got) != 1 || got[0].Key != "status" || got[0].Value != "active" {
+		t.Fatalf("got query %s", flags.query)
+	}
+}
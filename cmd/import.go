@@ -3,45 +3,190 @@ package cmd
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"strings"
+	"os"
+	"regexp"
 	"time"
 
 	"github.com/sfi2k7/mc/internal/db"
 	"github.com/sfi2k7/mc/internal/storage"
+	"github.com/sfi2k7/mc/internal/transform"
 	"github.com/sfi2k7/mc/internal/utils"
 	"github.com/spf13/cobra"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
+// exactCountLimit is the largest target collection whose documents are
+// counted exactly before and after an import; larger ones use the
+// estimate from the collection metadata
+const exactCountLimit = 1000000
+
+// importFlags holds the command line options of the import command
+type importFlags struct {
+	database         string
+	collection       string
+	collectionPrefix string
+	collectionSuffix string
+	drop             bool
+	jqExpr           string
+	ignoreShardCheck bool
+	continueOnError  bool
+	dupReport        string
+	sanitizeKeys     string
+	validateBSON     string
+	metricsFile      string
+	collation        string
+	validator        string
+	timeseries       string
+	structureOnly    bool
+	decodeThreads    int
+	plan             bool
+	resume           bool
+	oplogMode        string
+	skipIndexes      []string
+	skipIndexRegex   string
+	pauseEvery       int
+	pauseDuration    time.Duration
+	idMin            string
+	idMax            string
+	preserveUUID     bool
+	buildIndexes     bool
+	maxDocs          int64
+}
+
 func newImportCmd() *cobra.Command {
-	var (
-		database   string
-		collection string
-		drop       bool
-	)
+	var flags importFlags
 
 	importCmd := &cobra.Command{
-		Use:   "import -d DATABASE -c COLLECTION [flags] INPUT_FILE",
-		Short: "Import a MongoDB collection from a file",
-		Long:  `Import a MongoDB collection from a compressed BSON file.`,
-		Args:  cobra.ExactArgs(1),
+		Use:         "import -d DATABASE -c COLLECTION [flags] INPUT_FILE",
+		Short:       "Import a MongoDB collection from a file",
+		Long:        `Import a MongoDB collection from a compressed BSON file.`,
+		Annotations: map[string]string{needsConnection: "true"},
+		Args:        cobra.ExactArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			inputFile := args[0]
-			return runImport(database, collection, drop, inputFile)
+			if flags.plan {
+				return runImport(flags, inputFile, &runMetrics{})
+			}
+			metrics := newRunMetrics("import", flags.database, flags.collection)
+			return finishMetrics(flags.metricsFile, metrics, runImport(flags, inputFile, metrics))
 		},
 	}
 
-	importCmd.Flags().StringVarP(&database, "database", "d", "", "MongoDB database name")
-	importCmd.Flags().StringVarP(&collection, "collection", "c", "", "MongoDB collection name")
-	importCmd.Flags().BoolVar(&drop, "drop", false, "Drop collection before import if exists")
+	importCmd.Flags().StringVarP(&flags.database, "database", "d", "", "MongoDB database name")
+	importCmd.Flags().StringVarP(&flags.collection, "collection", "c", "", "MongoDB collection name")
+	importCmd.Flags().StringVar(&flags.collectionPrefix, "collection-prefix", "", "Import into the source collection name with this prefix (ignored when --collection is set)")
+	importCmd.Flags().StringVar(&flags.collectionSuffix, "collection-suffix", "", "Import into the source collection name with this suffix, e.g. _restore (ignored when --collection is set)")
+	importCmd.Flags().BoolVar(&flags.drop, "drop", false, "Drop collection before import if exists")
+	importCmd.Flags().BoolVar(&flags.ignoreShardCheck, "ignore-shard-check", false, "Skip checking documents for the shard key of a sharded target")
+	importCmd.Flags().BoolVar(&flags.continueOnError, "continue-on-error", false, "Insert unordered and keep going when documents are rejected")
+	importCmd.Flags().StringVar(&flags.dupReport, "dup-report", "", "Write the _id of each duplicate-key document to this file (requires --continue-on-error)")
+	importCmd.Flags().StringVar(&flags.sanitizeKeys, "sanitize-keys", "", "Rewrite field names with dots or a leading $: escape, replace or error")
+	importCmd.Flags().StringVar(&flags.validateBSON, "validate-bson", db.ValidateRelaxed, "Check field names, deprecated types and document size before insert: strict (reject), relaxed (count only) or off")
+	importCmd.Flags().StringVar(&flags.collation, "collation", "", "Collation in JSON used when the target collection has to be created")
+	importCmd.Flags().StringVar(&flags.validator, "validator", "", "Validator in JSON used when the target collection has to be created")
+	importCmd.Flags().StringVar(&flags.timeseries, "timeseries", "", `Create the target as a time-series collection, e.g. '{"timeField":"ts","metaField":"meta"}'`)
+	importCmd.Flags().BoolVar(&flags.structureOnly, "structure-only", false, "Only create the collection and its indexes from the file metadata, without documents")
+	importCmd.Flags().IntVar(&flags.decodeThreads, "decompress-threads", 0, "Number of zstd decoder goroutines (0 for the decoder default)")
+	importCmd.Flags().BoolVar(&flags.plan, "plan", false, "Print what the import would do from the file header and target state, then exit")
+	importCmd.Flags().BoolVar(&flags.plan, "estimate", false, "Alias for --plan")
+	importCmd.Flags().MarkHidden("estimate")
+	importCmd.Flags().StringVar(&flags.metricsFile, "metrics-file", "", "Write Prometheus textfile metrics about the run to this file, even when it fails")
+	importCmd.Flags().BoolVar(&flags.resume, "resume", false, "Record progress in a "+storage.CheckpointExtension+" file next to the input and continue from it when rerun on the same, unchanged file. Documents are skipped by position, and those of the interrupted batch that already exist are skipped by _id")
+	importCmd.Flags().StringVar(&flags.oplogMode, "oplog-mode", db.OplogSkip, "For oplog exports, what to do with an update or delete of a missing document: skip, fail or upsert")
+	importCmd.Flags().BoolVar(&flags.buildIndexes, "build-indexes", false, "Build the indexes stored in the file once the documents are loaded")
+	importCmd.Flags().StringSliceVar(&flags.skipIndexes, "skip-index", nil, "Names of stored indexes not to recreate with --build-indexes or --structure-only (comma-separated)")
+	importCmd.Flags().StringVar(&flags.skipIndexRegex, "skip-index-regex", "", "Do not recreate stored indexes whose name matches this regular expression (with --build-indexes or --structure-only)")
+	importCmd.Flags().StringVar(&flags.idMin, "id-min", "", "Only import documents whose _id is at least this value (ObjectId hex, extended JSON value or string)")
+	importCmd.Flags().StringVar(&flags.idMax, "id-max", "", "Only import documents whose _id is below this value (ObjectId hex, extended JSON value or string)")
+	importCmd.Flags().IntVar(&flags.pauseEvery, "pause-every", 0, "Pause after every N batches so a busy server can catch up; a courtesy throttle, not a rate limit (0 to disable)")
+	importCmd.Flags().DurationVar(&flags.pauseDuration, "pause-duration", time.Second, "How long each --pause-every pause lasts")
+	importCmd.Flags().BoolVar(&flags.preserveUUID, "preserve-uuid", false, "Create the collection with the UUID stored at export time; needs the restore role and a new collection (see --drop), otherwise a new UUID is used with a warning")
+	importCmd.Flags().Int64Var(&flags.maxDocs, "max-docs", 0, "Refuse a file whose header counts more documents than this, and stop before inserting more in this run (0 for no limit)")
+	importCmd.Flags().StringVar(&flags.jqExpr, "jq", "", "jq expression applied to each document in canonical extended JSON (empty result skips the document)")
 
 	importCmd.MarkFlagRequired("database")
-	importCmd.MarkFlagRequired("collection")
 
 	return importCmd
 }
 
-func runImport(database, collection string, drop bool, inputFile string) error {
+func runImport(flags importFlags, inputFile string, metrics *runMetrics) error {
+	database := flags.database
+
+	if flags.dupReport != "" && !flags.continueOnError {
+		return usageErrorf("--dup-report requires --continue-on-error")
+	}
+	if flags.resume && flags.drop {
+		return usageErrorf("--resume cannot be combined with --drop")
+	}
+	if flags.decodeThreads < 0 {
+		return usageErrorf("--decompress-threads must not be negative")
+	}
+	if flags.maxDocs < 0 {
+		return usageErrorf("--max-docs must not be negative")
+	}
+	if flags.pauseEvery < 0 {
+		return usageErrorf("--pause-every must not be negative")
+	}
+	if flags.pauseEvery > 0 && flags.pauseDuration <= 0 {
+		return usageErrorf("--pause-duration must be positive when --pause-every is set")
+	}
+	if flags.sanitizeKeys != "" && !db.ValidSanitizeStrategy(flags.sanitizeKeys) {
+		return usageErrorf("invalid --sanitize-keys strategy %q (expected escape, replace or error)", flags.sanitizeKeys)
+	}
+
+	if !db.ValidOplogMode(flags.oplogMode) {
+		return usageErrorf("invalid --oplog-mode %q (expected skip, fail or upsert)", flags.oplogMode)
+	}
+
+	if !db.ValidValidationLevel(flags.validateBSON) {
+		return usageErrorf("invalid --validate-bson level %q (expected strict, relaxed or off)", flags.validateBSON)
+	}
+
+	var (
+		idMin, idMax interface{}
+		err          error
+	)
+	if flags.idMin != "" {
+		if idMin, err = db.ParseIDBound(flags.idMin); err != nil {
+			return usageErrorf("invalid --id-min: %w", err)
+		}
+	}
+	if flags.idMax != "" {
+		if idMax, err = db.ParseIDBound(flags.idMax); err != nil {
+			return usageErrorf("invalid --id-max: %w", err)
+		}
+	}
+
+	// Stored indexes are only created by --structure-only and
+	// --build-indexes, so there is nothing to skip otherwise
+	if (len(flags.skipIndexes) > 0 || flags.skipIndexRegex != "") && !flags.structureOnly && !flags.buildIndexes {
+		return usageErrorf("--skip-index and --skip-index-regex need --build-indexes or --structure-only")
+	}
+	var skipIndexPattern *regexp.Regexp
+	if flags.skipIndexRegex != "" {
+		skipIndexPattern, err = regexp.Compile(flags.skipIndexRegex)
+		if err != nil {
+			return usageErrorf("invalid --skip-index-regex: %w", err)
+		}
+	}
+
+	collOpts, err := db.ParseCollectionOptions(flags.collation, flags.validator, flags.timeseries)
+	if err != nil {
+		return usageError(err)
+	}
+
+	// Compile the transform before doing any work
+	var transformer *transform.Transformer
+	if flags.jqExpr != "" {
+		transformer, err = transform.NewTransformer(flags.jqExpr)
+		if err != nil {
+			return usageError(err)
+		}
+	}
+
 	// Create context with timeout
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
 	defer cancel()
@@ -52,18 +197,34 @@ func runImport(database, collection string, drop bool, inputFile string) error {
 		return fmt.Errorf("failed to open input file: %w", err)
 	}
 	defer fileReader.Close()
+	fileReader.SetConcurrency(flags.decodeThreads)
 
 	// Read header
 	metadata, err := fileReader.ReadHeader()
 	if err != nil {
-		if strings.Contains(err.Error(), "invalid file format") ||
-			strings.Contains(err.Error(), "magic number mismatch") {
-			return fmt.Errorf("invalid file format: the file may be corrupted or not an MCBZ file")
-		}
-		if strings.Contains(err.Error(), "unsupported file version") {
-			return fmt.Errorf("unsupported file version: this file was created with a newer version of mc")
+		return headerError(err)
+	}
+	metadata.Indexes = skipIndexes(flags, skipIndexPattern, metadata.Indexes)
+	if flags.maxDocs > 0 && !flags.structureOnly && metadata.DocumentCount > flags.maxDocs {
+		return fmt.Errorf("%s holds %d documents, more than --max-docs %d; nothing was imported",
+			inputFile, metadata.DocumentCount, flags.maxDocs)
+	}
+	replay := metadata.Format == storage.FormatOplog
+	if replay {
+		if err := checkReplayFlags(flags); err != nil {
+			return err
 		}
-		return fmt.Errorf("failed to read header: %w", err)
+	}
+
+	collection, err := targetCollection(flags, metadata.Collection)
+	if err != nil {
+		return err
+	}
+	flags.collection = collection
+	metrics.collection = collection
+
+	if flags.plan {
+		return runImportPlan(ctx, flags, inputFile, metadata)
 	}
 
 	logger.Info("Importing collection",
@@ -73,42 +234,383 @@ func runImport(database, collection string, drop bool, inputFile string) error {
 		"target_coll", collection)
 
 	// Connect to MongoDB
-	client, err := db.Connect(ctx, uri, host, port)
+	connOpts, err := connectOptions()
 	if err != nil {
-		return fmt.Errorf("failed to connect to MongoDB: %w", err)
+		return err
+	}
+	client, err := db.Connect(ctx, connOpts)
+	if err != nil {
+		return connectError(err)
 	}
 	defer client.Disconnect(ctx)
 
+	// Detect a sharded target so documents without the shard key fail early
+	var shardKey []string
+	if !flags.ignoreShardCheck {
+		shardKey, err = db.ShardKey(ctx, client, database, collection)
+		if err != nil {
+			logger.Warn("Could not determine whether the target is sharded", "error", err)
+		} else if len(shardKey) > 0 {
+			logger.Info("Target collection is sharded", "shard_key", shardKey)
+		}
+	}
+
+	// Open the duplicate-key report; ids are streamed to it as they occur
+	var dupReport *os.File
+	if flags.dupReport != "" {
+		dupReport, err = os.Create(flags.dupReport)
+		if err != nil {
+			return fmt.Errorf("failed to create duplicate report: %w", err)
+		}
+		defer dupReport.Close()
+	}
+
 	// Initialize progress bar
-	progress := utils.NewProgressBar("Importing")
-	progress.SetTotal(metadata.DocumentCount)
+	progress := newProgressBar("Importing")
+	stopStats := startStatsLogger(progress)
+	defer stopStats()
+
+	// Record the target's size so the log shows what the import changed
+	before := targetCount(ctx, client, database, collection)
+	logger.Info("Target collection before import", before.attrs("database", database, "collection", collection)...)
 
 	// Drop collection if requested
-	if drop {
+	if flags.drop {
 		if err := db.DropCollection(ctx, client, database, collection); err != nil {
 			return fmt.Errorf("failed to drop collection: %w", err)
 		}
 		logger.Info("Dropped existing collection", "database", database, "collection", collection)
 	}
 
+	// Fall back to the options captured at export time
+	collOpts.Stored = metadata.Options
+	if flags.preserveUUID {
+		if len(metadata.CollectionUUID) == 0 {
+			logger.Warn("The file has no collection UUID; --preserve-uuid is ignored")
+		}
+		collOpts.UUID = metadata.CollectionUUID
+	}
+
+	importOpts := db.ImportOptions{
+		BatchSize:       batchSize,
+		Transform:       transformer,
+		ShardKey:        shardKey,
+		SanitizeKeys:    flags.sanitizeKeys,
+		ValidateBSON:    flags.validateBSON,
+		ContinueOnError: flags.continueOnError,
+		Collection:      collOpts,
+		StructureOnly:   flags.structureOnly,
+		Indexes:         metadata.Indexes,
+		BuildIndexes:    flags.buildIndexes,
+		ProgressBytes:   progressBytes(),
+		IDMin:           idMin,
+		IDMax:           idMax,
+		PauseEvery:      flags.pauseEvery,
+		PauseDuration:   flags.pauseDuration,
+		MaxDocuments:    flags.maxDocs,
+		Logger:          logger,
+	}
+	if replay {
+		importOpts.OplogMode = flags.oplogMode
+	}
+	if dupReport != nil {
+		importOpts.DupReport = dupReport
+	}
+	if flags.resume && !flags.structureOnly {
+		if err := setupCheckpoint(&importOpts, flags, inputFile, metadata); err != nil {
+			return err
+		}
+	}
+	var fileEnd int64
+	if progressUnit == utils.UnitFile && !flags.structureOnly {
+		fileEnd, err = fileReader.DataEnd()
+		if err != nil || fileEnd <= fileReader.Offset() {
+			logger.Warn("Cannot measure progress through the input file; counting documents", "error", err)
+			importOpts.ProgressBytes = false
+			progress.SetBytes(false)
+		} else {
+			importOpts.ProgressFile = true
+		}
+	}
+	// Skipped documents are counted as they are read past in byte modes
+	switch {
+	case flags.structureOnly:
+	case importOpts.ProgressFile:
+		progress.SetTotal(fileEnd - fileReader.Offset())
+	case importOpts.ProgressBytes:
+		progress.SetTotal(metadata.OriginalSize)
+	default:
+		progress.SetInitial(importOpts.SkipDocuments)
+		progress.SetTotal(metadata.DocumentCount - importOpts.SkipDocuments)
+	}
+
 	// Import collection
-	importedCount, err := db.ImportCollection(
+	result, err := db.ImportCollection(
 		ctx,
 		client,
 		database,
 		collection,
-		batchSize,
+		importOpts,
 		fileReader,
 		progress,
 	)
+	stopStats()
+	progress.Finish()
+	dataOffset, dataLength := fileReader.DataRegion()
+	metrics.docs, metrics.bytes = result.Inserted+result.Updated+result.Deleted, dataOffset+dataLength
+	after := targetCount(ctx, client, database, collection)
+	logger.Info("Target collection after import", after.attrs("delta", after.count-before.count)...)
+
+	if errors.Is(err, db.ErrMaxDocuments) {
+		logger.Error("Import stopped at --max-docs; documents inserted so far were kept",
+			"inserted", result.Inserted+result.Updated+result.Deleted,
+			"max_docs", flags.maxDocs,
+			"database", database,
+			"collection", collection)
+	}
 	if err != nil {
 		return fmt.Errorf("import failed: %w", err)
 	}
 
+	if flags.resume {
+		if err := storage.RemoveCheckpoint(inputFile); err != nil {
+			logger.Warn("Could not remove checkpoint", "error", err)
+		}
+	}
+
+	if flags.structureOnly {
+		logger.Info("Structure import completed",
+			"indexes", len(metadata.Indexes),
+			"database", database,
+			"collection", collection)
+		return nil
+	}
+	if transformer != nil {
+		logger.Info("Transform applied", "modified", transformer.Modified(), "dropped", transformer.Dropped())
+	}
+	if result.Skipped > 0 {
+		logger.Info("Resumed after documents imported earlier", "skipped", result.Skipped)
+	}
+	if result.OutOfRange > 0 {
+		logger.Info("Documents outside the _id range skipped", "skipped", result.OutOfRange)
+	}
+	if result.Sanitized > 0 {
+		logger.Info("Field names rewritten", "docs", result.Sanitized, "strategy", flags.sanitizeKeys)
+	}
+	if result.Rejected > 0 {
+		logger.Warn("Documents rejected by BSON validation", "rejected", result.Rejected)
+	}
+	if result.Invalid > 0 {
+		logger.Warn("Documents failed BSON validation but were inserted",
+			"invalid", result.Invalid,
+			"hint", "use --validate-bson strict to reject them")
+	}
+	if result.Failed > 0 {
+		logger.Warn("Some documents were rejected",
+			"failed", result.Failed,
+			"duplicates", result.Duplicates)
+		if dupReport != nil {
+			logger.Info("Duplicate report written", "file", flags.dupReport)
+		}
+	}
+	if replay {
+		logger.Info("Oplog replayed",
+			"inserted", result.Inserted,
+			"updated", result.Updated,
+			"deleted", result.Deleted,
+			"missing", result.Missing,
+			"oplog_mode", flags.oplogMode,
+			"file", inputFile,
+			"database", database,
+			"collection", collection)
+		return nil
+	}
 	logger.Info("Import completed",
-		"docs", importedCount,
+		"docs", result.Inserted,
 		"file", inputFile,
 		"database", database,
 		"collection", collection)
+	if left := result.Failed + result.Rejected; left > 0 {
+		return &codedError{code: ErrorCodePartial, phase: "run",
+			err: fmt.Errorf("import finished with %d documents rejected", left)}
+	}
+	return nil
+}
+
+// countedTarget is the document count of an import target
+type countedTarget struct {
+	exists bool
+	count  int64
+	exact  bool
+}
+
+// targetCount counts the documents of an import target, exactly unless the
+// collection holds more than exactCountLimit documents. A failure is logged
+// and reported as a missing collection, since the count is informational.
+func targetCount(ctx context.Context, client *mongo.Client, database, collection string) countedTarget {
+	exists, count, exact, err := db.CollectionCountExact(ctx, client, database, collection, exactCountLimit)
+	if err != nil {
+		logger.Warn("Could not count the target collection", "error", err)
+	}
+	return countedTarget{exists: exists, count: count, exact: exact}
+}
+
+// attrs returns log attributes describing the count, followed by extra
+func (t countedTarget) attrs(extra ...interface{}) []interface{} {
+	countKind := "estimated"
+	if t.exact {
+		countKind = "exact"
+	}
+	attrs := []interface{}{"exists", t.exists, "docs", t.count, "count", countKind}
+	return append(attrs, extra...)
+}
+
+// checkReplayFlags rejects options that only apply to importing documents
+// when the input is an oplog export
+func checkReplayFlags(flags importFlags) error {
+	switch {
+	case flags.drop:
+		return usageErrorf("--drop cannot be used when replaying an oplog export, which only holds changes")
+	case flags.structureOnly || flags.buildIndexes:
+		return usageErrorf("--structure-only and --build-indexes cannot be used when replaying an oplog export")
+	case flags.jqExpr != "" || flags.sanitizeKeys != "":
+		return usageErrorf("--jq and --sanitize-keys cannot be used when replaying an oplog export")
+	case flags.continueOnError:
+		return usageErrorf("--continue-on-error cannot be used when replaying an oplog export; entries are applied in order")
+	case flags.idMin != "" || flags.idMax != "":
+		return usageErrorf("--id-min and --id-max cannot be used when replaying an oplog export")
+	}
+	return nil
+}
+
+// skipIndexes removes the stored indexes excluded by --skip-index and
+// --skip-index-regex, logging each one, and warns about listed names the
+// file does not have
+func skipIndexes(flags importFlags, pattern *regexp.Regexp, indexes []bson.D) []bson.D {
+	kept, skipped := db.FilterIndexes(indexes, flags.skipIndexes, pattern)
+	for _, name := range skipped {
+		logger.Info("Skipping stored index", "index", name)
+	}
+	for _, name := range flags.skipIndexes {
+		found := false
+		for _, s := range skipped {
+			if s == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			logger.Warn("No stored index with this name", "index", name)
+		}
+	}
+	return kept
+}
+
+// targetCollection returns the collection to import into: --collection when
+// given, otherwise the source collection decorated with the prefix and suffix
+func targetCollection(flags importFlags, source string) (string, error) {
+	name := flags.collection
+	if name == "" {
+		if flags.collectionPrefix == "" && flags.collectionSuffix == "" {
+			return "", usageErrorf("--collection is required unless --collection-prefix or --collection-suffix is given")
+		}
+		if source == "" {
+			return "", usageErrorf("the file does not record its source collection; use --collection")
+		}
+		name = flags.collectionPrefix + source + flags.collectionSuffix
+	}
+	if err := db.ValidateCollectionName(flags.database, name); err != nil {
+		return "", usageError(err)
+	}
+	return name, nil
+}
+
+// setupCheckpoint resumes from an existing checkpoint of the input file and
+// arranges for progress to be recorded after every committed batch
+func setupCheckpoint(importOpts *db.ImportOptions, flags importFlags, inputFile string, metadata storage.Metadata) error {
+	info, err := os.Stat(inputFile)
+	if err != nil {
+		return err
+	}
+	current := storage.Checkpoint{
+		Database:   flags.database,
+		Collection: flags.collection,
+		FileSize:   info.Size(),
+		Timestamp:  metadata.Timestamp,
+		BatchSize:  batchSize,
+	}
+
+	saved, found, err := storage.ReadCheckpoint(inputFile)
+	if err != nil {
+		return err
+	}
+	if found {
+		if !saved.Matches(current) {
+			return fmt.Errorf("checkpoint %s belongs to a different file or target; remove it to start over",
+				inputFile+storage.CheckpointExtension)
+		}
+		importOpts.SkipDocuments = saved.Documents
+		importOpts.ResumeOverlap = int64(saved.BatchSize)
+		if saved.BatchSize == 0 {
+			importOpts.ResumeOverlap = int64(batchSize)
+		}
+		logger.Info("Resuming import from checkpoint", "skip", saved.Documents, "overlap", importOpts.ResumeOverlap)
+	}
+
+	importOpts.Checkpoint = func(processed int64) error {
+		current.Documents = processed
+		return storage.WriteCheckpoint(inputFile, current)
+	}
+	return nil
+}
+
+// runImportPlan prints a pre-flight summary of an import using only the
+// file header and the current state of the target collection
+func runImportPlan(ctx context.Context, flags importFlags, inputFile string, metadata storage.Metadata) error {
+	connOpts, err := connectOptions()
+	if err != nil {
+		return err
+	}
+	client, err := db.Connect(ctx, connOpts)
+	if err != nil {
+		return connectError(err)
+	}
+	defer client.Disconnect(ctx)
+
+	exists, count, err := db.CollectionCount(ctx, client, flags.database, flags.collection)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("=== Import Plan ===")
+	fmt.Println("File:", inputFile)
+	fmt.Println("Source:", metadata.Database+"."+metadata.Collection)
+	switch {
+	case metadata.Format == storage.FormatOplog:
+		fmt.Println("Oplog entries in file:", metadata.DocumentCount)
+	case flags.structureOnly:
+		fmt.Println("Documents in file: none will be imported (--structure-only)")
+	default:
+		fmt.Println("Documents in file:", metadata.DocumentCount)
+	}
+	fmt.Println("Stored indexes:", len(metadata.Indexes))
+	fmt.Println("")
+	fmt.Println("Target:", flags.database+"."+flags.collection)
+	if !exists {
+		fmt.Println("Target exists: no (it will be created)")
+		return nil
+	}
+	fmt.Println("Target exists: yes")
+	fmt.Println("Current documents (estimated):", count)
+	switch {
+	case flags.drop && count > 0:
+		fmt.Printf("--drop: would delete %d existing documents\n", count)
+	case flags.drop:
+		fmt.Println("--drop: would drop the empty collection")
+	case metadata.Format == storage.FormatOplog:
+		fmt.Printf("Oplog entries will be replayed onto the existing documents (--oplog-mode %s)\n", flags.oplogMode)
+	case count > 0:
+		fmt.Println("Documents will be added to the existing ones; duplicate _id values will fail")
+	}
 	return nil
 }
@@ -0,0 +1,103 @@
+package cmd
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sfi2k7/mc/internal/db"
+	"github.com/sfi2k7/mc/internal/storage"
+	"github.com/sfi2k7/mc/internal/utils"
+)
+
+func TestSetupCheckpointResumeOverlap(t *testing.T) {
+	defer func(saved int) { batchSize = saved }(batchSize)
+	batchSize = 100
+
+	inputFile := filepath.Join(t.TempDir(), "in"+storage.FileExtension)
+	if err := os.WriteFile(inputFile, make([]byte, 64), 0644); err != nil {
+		t.Fatal(err)
+	}
+	flags := importFlags{database: "db", collection: "c"}
+	metadata := storage.Metadata{Timestamp: 1700000000}
+	checkpoint := storage.Checkpoint{Database: "db", Collection: "c", FileSize: 64, Timestamp: 1700000000, Documents: 3000}
+
+	tests := []struct {
+		name      string
+		batchSize int
+		want      int64
+	}{
+		// The batch after the checkpoint is as large as the batches of the
+		// run that wrote it, whatever --batch-size is now
+		{"recorded batch size", 500, 500},
+		// Checkpoints written before the batch size was recorded
+		{"current batch size", 0, 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkpoint.BatchSize = tt.batchSize
+			if err := storage.WriteCheckpoint(inputFile, checkpoint); err != nil {
+				t.Fatal(err)
+			}
+
+			var opts db.ImportOptions
+			if err := setupCheckpoint(&opts, flags, inputFile, metadata); err != nil {
+				t.Fatal(err)
+			}
+			if opts.SkipDocuments != 3000 || opts.ResumeOverlap != tt.want {
+				t.Fatalf("skip %d with an overlap of %d, want 3000 and %d", opts.SkipDocuments, opts.ResumeOverlap, tt.want)
+			}
+
+			// New checkpoints record the current batch size
+			if err := opts.Checkpoint(3100); err != nil {
+				t.Fatal(err)
+			}
+			saved, _, err := storage.ReadCheckpoint(inputFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if saved.Documents != 3100 || saved.BatchSize != 100 {
+				t.Fatalf("checkpoint records %d documents in batches of %d, want 3100 in batches of 100", saved.Documents, saved.BatchSize)
+			}
+		})
+	}
+
+	// A checkpoint of another file is refused
+	checkpoint.FileSize = 65
+	if err := storage.WriteCheckpoint(inputFile, checkpoint); err != nil {
+		t.Fatal(err)
+	}
+	if err := setupCheckpoint(&db.ImportOptions{}, flags, inputFile, metadata); err == nil {
+		t.Fatal("expected an error for a checkpoint of a different file")
+	}
+}
+
+func TestSkipIndexNeedsIndexBuild(t *testing.T) {
+	rootCmd.SetOut(io.Discard)
+	rootCmd.SetErr(io.Discard)
+	defer rootCmd.SetOut(nil)
+	defer rootCmd.SetErr(nil)
+
+	missing := filepath.Join(t.TempDir(), "missing"+storage.FileExtension)
+	tests := []struct {
+		args []string
+		want int
+	}{
+		// A plain import builds no stored indexes, so skipping one is a
+		// mistake rather than a no-op
+		{[]string{"--skip-index", "a_1"}, ExitUsage},
+		{[]string{"--skip-index-regex", "^tmp_"}, ExitUsage},
+		// With an index build the flags are accepted, and the import gets
+		// as far as opening the file
+		{[]string{"--build-indexes", "--skip-index", "a_1"}, ExitFile},
+		{[]string{"--structure-only", "--skip-index-regex", "^tmp_"}, ExitFile},
+	}
+	for _, tt := range tests {
+		rootCmd.SetArgs(append(append([]string{"import", "-d", "db"}, tt.args...), missing))
+		err := Execute(utils.NewLogger())
+		if code := ExitCode(err); code != tt.want {
+			t.Errorf("%v: exit code %d, want %d (%v)", tt.args, code, tt.want, err)
+		}
+	}
+}
@@ -4,14 +4,27 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"sort"
+	"text/tabwriter"
 	"time"
 
+	"github.com/sfi2k7/mc/internal/db"
 	"github.com/sfi2k7/mc/internal/storage"
 	"github.com/sfi2k7/mc/internal/utils"
 	"github.com/spf13/cobra"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
 )
 
 func newInspectCmd() *cobra.Command {
+	var (
+		typeReport bool
+		sampleSize int
+		timezone   string
+		timeFormat string
+		validate   bool
+	)
+
 	inspectCmd := &cobra.Command{
 		Use:   "inspect FILE",
 		Short: "Display metadata information about an MCBZ file",
@@ -19,14 +32,35 @@ func newInspectCmd() *cobra.Command {
 		Args:  cobra.ExactArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			filePath := args[0]
-			return runInspect(filePath)
+			return runInspect(filePath, typeReport, sampleSize, timezone, timeFormat, validate)
 		},
 	}
 
+	inspectCmd.Flags().BoolVar(&typeReport, "type-report", false, "Sample documents and list the BSON types they contain")
+	inspectCmd.Flags().IntVar(&sampleSize, "sample", 1000, "Number of documents sampled for --type-report")
+	inspectCmd.Flags().StringVar(&timezone, "timezone", "UTC", "Time zone for displayed times, e.g. UTC, Local or Europe/Berlin")
+	inspectCmd.Flags().StringVar(&timeFormat, "time-format", "rfc1123", "Format for displayed times: rfc1123 or rfc3339")
+	inspectCmd.Flags().BoolVar(&validate, "validate", false, "Check that the file is neither truncated nor padded, without reading documents")
+
 	return inspectCmd
 }
 
-func runInspect(filePath string) error {
+// timeFormats maps --time-format values to layouts that include the offset
+var timeFormats = map[string]string{
+	"rfc1123": time.RFC1123Z,
+	"rfc3339": time.RFC3339,
+}
+
+func runInspect(filePath string, typeReport bool, sampleSize int, timezone, timeFormat string, validate bool) error {
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		return usageErrorf("invalid --timezone: %w", err)
+	}
+	layout, ok := timeFormats[timeFormat]
+	if !ok {
+		return usageErrorf("invalid --time-format %q (expected rfc1123 or rfc3339)", timeFormat)
+	}
+
 	// Get file stat info
 	fileInfo, err := os.Stat(filePath)
 	if err != nil {
@@ -43,7 +77,7 @@ func runInspect(filePath string) error {
 	// Read header
 	metadata, err := fileReader.ReadHeader()
 	if err != nil {
-		return fmt.Errorf("failed to read header: %w", err)
+		return headerError(err)
 	}
 
 	// Calculate human-readable sizes
@@ -51,12 +85,9 @@ func runInspect(filePath string) error {
 	originalSizeHuman := utils.FormatByteSize(metadata.OriginalSize)
 	compressedSizeHuman := utils.FormatByteSize(metadata.CompressedSize)
 
-	// Calculate compression ratio
-	compressionRatio := float64(metadata.OriginalSize) / float64(metadata.CompressedSize)
-
 	// Format creation times
-	fileCreationTime := fileInfo.ModTime().Format(time.RFC1123)
-	exportTime := time.Unix(metadata.Timestamp, 0).Format(time.RFC1123)
+	fileCreationTime := fileInfo.ModTime().In(location).Format(layout)
+	exportTime := time.Unix(metadata.Timestamp, 0).In(location).Format(layout)
 
 	// Print file information
 	fmt.Println("=== MCBZ File Information ===")
@@ -69,18 +100,221 @@ func runInspect(filePath string) error {
 	fmt.Println("=== Collection Information ===")
 	fmt.Println("Database:", metadata.Database)
 	fmt.Println("Collection:", metadata.Collection)
-	fmt.Println("Document count:", metadata.DocumentCount)
+	if metadata.DocumentCount == 0 {
+		fmt.Println("Document count: 0 (empty)")
+	} else {
+		fmt.Println("Document count:", metadata.DocumentCount)
+	}
+	if metadata.Part > 0 {
+		fmt.Println("Volume:", metadata.Part)
+	}
+	if metadata.Format == storage.FormatOplog {
+		oplogEnd := time.Unix(int64(metadata.OplogEnd.T), 0).In(location).Format(layout)
+		fmt.Println("Format: oplog entries")
+		fmt.Printf("Oplog end: %s (%s)\n", db.FormatOplogTimestamp(metadata.OplogEnd), oplogEnd)
+	}
 	fmt.Println("Source:", metadata.Source)
+	if len(metadata.CollectionUUID) > 0 {
+		fmt.Println("Collection UUID:", formatUUID(metadata.CollectionUUID))
+	}
 	fmt.Println("Export time:", exportTime)
+	if metadata.Writer == "" {
+		fmt.Println("Written by: unknown")
+	} else {
+		fmt.Println("Written by:", metadata.Writer)
+	}
 	fmt.Println("")
 
+	// Print the stored collection structure
+	if len(metadata.Options) > 0 || len(metadata.Indexes) > 0 {
+		fmt.Println("=== Collection Structure ===")
+		for _, option := range metadata.Options {
+			fmt.Println("Option:", option.Key)
+			if ts, ok := option.Value.(bson.D); ok && option.Key == "timeseries" {
+				spec, err := bson.MarshalExtJSON(ts, false, false)
+				if err != nil {
+					return fmt.Errorf("failed to format time-series options: %w", err)
+				}
+				fmt.Println("Time series:", string(spec))
+			}
+		}
+		for _, index := range metadata.Indexes {
+			spec, err := bson.MarshalExtJSON(index, false, false)
+			if err != nil {
+				return fmt.Errorf("failed to format index: %w", err)
+			}
+			fmt.Println("Index:", string(spec))
+		}
+		fmt.Println("")
+	}
+
 	// Print compression information
 	fmt.Println("=== Compression Information ===")
+	if metadata.Codec == "" {
+		fmt.Println("Codec: unknown/none")
+	} else {
+		fmt.Printf("Codec: %s, level: %d\n", metadata.Codec, metadata.Level)
+	}
 	fmt.Println("Original size:", originalSizeHuman, fmt.Sprintf("(%d bytes)", metadata.OriginalSize))
 	fmt.Println("Compressed size:", compressedSizeHuman, fmt.Sprintf("(%d bytes)", metadata.CompressedSize))
-	fmt.Printf("Compression ratio: %.2f:1 (%.1f%% reduction)\n",
-		compressionRatio,
-		(1-float64(metadata.CompressedSize)/float64(metadata.OriginalSize))*100)
+	if metadata.OriginalSize == 0 || metadata.CompressedSize == 0 {
+		// Avoid dividing by zero for files without any documents
+		fmt.Println("Compression ratio: n/a (empty)")
+	} else {
+		compressionRatio := float64(metadata.OriginalSize) / float64(metadata.CompressedSize)
+		fmt.Printf("Compression ratio: %.2f:1 (%.1f%% reduction)\n",
+			compressionRatio,
+			(1-float64(metadata.CompressedSize)/float64(metadata.OriginalSize))*100)
+	}
+	dataOffset, dataLength := fileReader.DataRegion()
+	fmt.Printf("Data region: %d bytes at offset %d\n", dataLength, dataOffset)
+	if fileReader.HasTrailer() {
+		fmt.Println("Header: stored as a trailer after the data region")
+	}
+	if validate {
+		if err := fileReader.CheckDataRegion(); err != nil {
+			return err
+		}
+		fmt.Println("Data region check: OK")
+	}
+
+	if typeReport {
+		fmt.Println("")
+		return printTypeReport(fileReader, sampleSize)
+	}
 
 	return nil
 }
+
+// fragileTypes are BSON types that plain JSON round-trips commonly mangle
+var fragileTypes = map[bsontype.Type]string{
+	bsontype.Decimal128:    "becomes a lossy double or string",
+	bsontype.Int64:         "loses precision above 2^53",
+	bsontype.Timestamp:     "becomes an object or number",
+	bsontype.Binary:        "becomes a base64 string, losing the subtype",
+	bsontype.DateTime:      "becomes a string or number",
+	bsontype.ObjectID:      "becomes a plain string",
+	bsontype.Regex:         "becomes an object or string",
+	bsontype.JavaScript:    "becomes a plain string",
+	bsontype.CodeWithScope: "has no JSON equivalent",
+	bsontype.Symbol:        "becomes a plain string",
+	bsontype.DBPointer:     "has no JSON equivalent",
+	bsontype.Undefined:     "becomes null or is dropped",
+	bsontype.MinKey:        "has no JSON equivalent",
+	bsontype.MaxKey:        "has no JSON equivalent",
+}
+
+// typeCounts tallies BSON element types found in documents
+type typeCounts struct {
+	types    map[bsontype.Type]int64
+	subtypes map[byte]int64
+}
+
+// printTypeReport samples documents from the reader and prints the BSON types
+// they contain
+func printTypeReport(fileReader *storage.FileReader, sampleSize int) error {
+	counts := typeCounts{
+		types:    make(map[bsontype.Type]int64),
+		subtypes: make(map[byte]int64),
+	}
+
+	sampled := 0
+	for sampled < sampleSize {
+		batch, err := fileReader.ReadBatch(batchSize)
+		if err != nil {
+			return fmt.Errorf("failed to read batch: %w", err)
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		for _, doc := range batch {
+			if sampled >= sampleSize {
+				break
+			}
+			raw, err := bson.Marshal(doc)
+			if err != nil {
+				return err
+			}
+			if err := counts.addDocument(raw); err != nil {
+				return err
+			}
+			sampled++
+		}
+	}
+
+	fmt.Println("=== BSON Type Report ===")
+	fmt.Println("Documents sampled:", sampled)
+	if len(counts.types) == 0 {
+		return nil
+	}
+
+	types := make([]bsontype.Type, 0, len(counts.types))
+	for t := range counts.types {
+		types = append(types, t)
+	}
+	sort.Slice(types, func(i, j int) bool {
+		if counts.types[types[i]] != counts.types[types[j]] {
+			return counts.types[types[i]] > counts.types[types[j]]
+		}
+		return types[i] < types[j]
+	})
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "TYPE\tCOUNT\tJSON ROUND-TRIP")
+	for _, t := range types {
+		note := fragileTypes[t]
+		if note != "" {
+			note = "at risk: " + note
+		}
+		fmt.Fprintf(table, "%s\t%d\t%s\n", t, counts.types[t], note)
+		if t == bsontype.Binary {
+			subtypes := make([]byte, 0, len(counts.subtypes))
+			for st := range counts.subtypes {
+				subtypes = append(subtypes, st)
+			}
+			sort.Slice(subtypes, func(i, j int) bool { return subtypes[i] < subtypes[j] })
+			for _, st := range subtypes {
+				fmt.Fprintf(table, "  subtype 0x%02x\t%d\t\n", st, counts.subtypes[st])
+			}
+		}
+	}
+	return table.Flush()
+}
+
+// addDocument counts the types of every element in a document, recursing
+// into embedded documents and arrays
+func (c typeCounts) addDocument(raw bson.Raw) error {
+	elements, err := raw.Elements()
+	if err != nil {
+		return err
+	}
+
+	for _, elem := range elements {
+		value := elem.Value()
+		c.types[value.Type]++
+
+		switch value.Type {
+		case bsontype.EmbeddedDocument:
+			if err := c.addDocument(value.Document()); err != nil {
+				return err
+			}
+		case bsontype.Array:
+			if err := c.addDocument(bson.Raw(value.Array())); err != nil {
+				return err
+			}
+		case bsontype.Binary:
+			subtype, _ := value.Binary()
+			c.subtypes[subtype]++
+		}
+	}
+	return nil
+}
+
+// formatUUID formats 16 bytes in the usual 8-4-4-4-12 hex form
+func formatUUID(b []byte) string {
+	if len(b) != 16 {
+		return fmt.Sprintf("%x", b)
+	}
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/sfi2k7/mc/internal/storage"
+	"github.com/sfi2k7/mc/internal/utils"
+)
+
+// notANumber matches the NaN and Inf that divisions by zero print
+var notANumber = regexp.MustCompile(`\bNaN\b|\bInf\b`)
+
+// captureStdout returns what fn prints to standard output, which is
+// where inspect and the progress bar write their reports
+func captureStdout(t *testing.T, fn func() error) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	if err := fn(); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+func TestInspectEmptyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "empty.mcbz")
+	writer, err := storage.NewFileWriter(path, storage.DefaultCompressionOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata := storage.Metadata{Database: "db", Collection: "empty"}
+	if err := writer.WriteHeader(metadata); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.WriteFooter(metadata); err != nil {
+		t.Fatal(err)
+	}
+	writer.Close()
+
+	out := captureStdout(t, func() error {
+		return runInspect(path, true, 100, "UTC", "rfc3339", true)
+	})
+	for _, want := range []string{"Document count: 0 (empty)", "Compression ratio: n/a (empty)", "Data region check: OK"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output lacks %q:\n%s", want, out)
+		}
+	}
+	if notANumber.MatchString(out) {
+		t.Errorf("output contains NaN or Inf:\n%s", out)
+	}
+}
+
+func TestProgressBarFinishEmpty(t *testing.T) {
+	for _, total := range []int64{0, -1} {
+		out := captureStdout(t, func() error {
+			progress := utils.NewProgressBar("Exporting")
+			progress.SetTotal(total)
+			progress.Finish()
+			return nil
+		})
+		if !strings.Contains(out, "0 items (empty)") {
+			t.Errorf("total %d: output %q does not report an empty run", total, out)
+		}
+		if notANumber.MatchString(out) {
+			t.Errorf("total %d: output %q contains NaN or Inf", total, out)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// labelEscaper escapes label values for the Prometheus text format
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// runMetrics collects the figures of one export or import for --metrics-file
+type runMetrics struct {
+	operation  string
+	database   string
+	collection string
+	start      time.Time
+	docs       int64
+	bytes      int64
+}
+
+// newRunMetrics starts timing an operation
+func newRunMetrics(operation, database, collection string) *runMetrics {
+	return &runMetrics{
+		operation:  operation,
+		database:   database,
+		collection: collection,
+		start:      time.Now(),
+	}
+}
+
+// finishMetrics writes the metrics of a run to path, if set, and returns
+// runErr. Metrics are written for failed runs too so that alerts can fire
+// on them; a failure to write them only surfaces when the run succeeded.
+func finishMetrics(path string, metrics *runMetrics, runErr error) error {
+	if path == "" {
+		return runErr
+	}
+	if err := writeMetrics(path, metrics, runErr == nil); err != nil {
+		if runErr != nil {
+			logger.Warn("Could not write metrics", "file", path, "error", err)
+			return runErr
+		}
+		return fmt.Errorf("failed to write metrics: %w", err)
+	}
+	return runErr
+}
+
+// writeMetrics writes the metrics in the Prometheus text format. The file is
+// replaced atomically, as the node_exporter textfile collector expects.
+func writeMetrics(path string, metrics *runMetrics, success bool) error {
+	labels := fmt.Sprintf(`operation="%s",database="%s",collection="%s"`,
+		labelEscaper.Replace(metrics.operation),
+		labelEscaper.Replace(metrics.database),
+		labelEscaper.Replace(metrics.collection))
+	successValue := 0
+	if success {
+		successValue = 1
+	}
+
+	var b strings.Builder
+	gauge := func(name, help string, value interface{}) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n%s{%s} %v\n", name, help, name, name, labels, value)
+	}
+	gauge("mc_documents", "Documents processed by the last run.", metrics.docs)
+	gauge("mc_bytes", "Size in bytes of the file written or read by the last run.", metrics.bytes)
+	gauge("mc_duration_seconds", "Duration of the last run in seconds.", fmt.Sprintf("%.3f", time.Since(metrics.start).Seconds()))
+	gauge("mc_success", "Whether the last run succeeded (1) or failed (0).", successValue)
+	gauge("mc_last_run_timestamp_seconds", "Unix time at which the last run finished.", time.Now().Unix())
+
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, []byte(b.String()), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
@@ -0,0 +1,161 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sfi2k7/mc/internal/db"
+	"github.com/sfi2k7/mc/internal/storage"
+	"github.com/sfi2k7/mc/internal/utils"
+	"github.com/spf13/cobra"
+)
+
+// restoreFlags holds the command line options of the restore command
+type restoreFlags struct {
+	database        string
+	collection      string
+	src             string
+	drop            bool
+	yes             bool
+	skipIndexes     bool
+	continueOnError bool
+	preserveUUID    bool
+	metricsFile     string
+}
+
+func newRestoreCmd() *cobra.Command {
+	var flags restoreFlags
+
+	restoreCmd := &cobra.Command{
+		Use:   "restore -d DATABASE --src FILE",
+		Short: "Restore a collection from a backup in one step",
+		Long: `Restore imports a backup into a collection and then builds the stored indexes,
+which is faster than maintaining them during the load. The file is checked
+before the target is touched: its header must be valid and its data region
+complete.
+
+A backup compressed as a whole with gzip or zstd (e.g. backup.mcbz.gz) is
+detected by its content and decompressed to a temporary file next to it
+first, since reading an MCBZ file needs seeking. Only local paths are
+supported.
+
+--drop asks for confirmation on a terminal; pass --yes to skip the question,
+which is required when not running interactively.`,
+		Annotations: map[string]string{needsConnection: "true"},
+		Args:        cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			metrics := newRunMetrics("restore", flags.database, flags.collection)
+			return finishMetrics(flags.metricsFile, metrics, runRestore(flags, metrics))
+		},
+	}
+
+	restoreCmd.Flags().StringVarP(&flags.database, "database", "d", "", "MongoDB database name")
+	restoreCmd.Flags().StringVarP(&flags.collection, "collection", "c", "", "MongoDB collection name (default: the collection the backup was taken from)")
+	restoreCmd.Flags().StringVar(&flags.src, "src", "", "Backup file to restore, optionally gzip or zstd compressed as a whole")
+	restoreCmd.Flags().BoolVar(&flags.drop, "drop", false, "Drop the collection before restoring")
+	restoreCmd.Flags().BoolVarP(&flags.yes, "yes", "y", false, "Do not ask for confirmation before --drop")
+	restoreCmd.Flags().BoolVar(&flags.skipIndexes, "skip-indexes", false, "Do not build the indexes stored in the backup")
+	restoreCmd.Flags().BoolVar(&flags.continueOnError, "continue-on-error", false, "Insert unordered and keep going when documents are rejected")
+	restoreCmd.Flags().BoolVar(&flags.preserveUUID, "preserve-uuid", false, "Create the collection with the UUID stored in the backup (see import --preserve-uuid)")
+	restoreCmd.Flags().StringVar(&flags.metricsFile, "metrics-file", "", "Write Prometheus textfile metrics about the run to this file, even when it fails")
+
+	restoreCmd.MarkFlagRequired("database")
+	restoreCmd.MarkFlagRequired("src")
+
+	return restoreCmd
+}
+
+func runRestore(flags restoreFlags, metrics *runMetrics) error {
+	if strings.Contains(flags.src, "://") {
+		return usageErrorf("unsupported source %q: only local paths are supported", flags.src)
+	}
+
+	inputFile := flags.src
+	wrapper, err := storage.DetectWrapper(inputFile)
+	if err != nil {
+		return fmt.Errorf("failed to open backup: %w", err)
+	}
+	if wrapper != "" {
+		logger.Info("Decompressing backup", "file", inputFile, "codec", wrapper)
+		inputFile, err = storage.UnwrapFile(inputFile, wrapper)
+		if err != nil {
+			return &codedError{code: ErrorCodeFileFormat, phase: "read-header", err: err}
+		}
+		defer os.Remove(inputFile)
+	}
+
+	metadata, err := checkBackup(inputFile)
+	if err != nil {
+		return err
+	}
+
+	importOpts := importFlags{
+		database:        flags.database,
+		collection:      flags.collection,
+		drop:            flags.drop,
+		continueOnError: flags.continueOnError,
+		preserveUUID:    flags.preserveUUID,
+		buildIndexes:    !flags.skipIndexes,
+		validateBSON:    db.ValidateRelaxed,
+		oplogMode:       db.OplogSkip,
+		pauseDuration:   time.Second,
+	}
+	if importOpts.collection == "" {
+		importOpts.collection = metadata.Collection
+	}
+	target, err := targetCollection(importOpts, metadata.Collection)
+	if err != nil {
+		return err
+	}
+	if flags.drop && !flags.yes {
+		if err := confirmDrop(flags.database, target, metadata); err != nil {
+			return err
+		}
+	}
+
+	if err := runImport(importOpts, inputFile, metrics); err != nil {
+		return err
+	}
+	logger.Info("Restore completed", "file", flags.src, "database", flags.database, "collection", target)
+	return nil
+}
+
+// checkBackup reads the header of a backup and makes sure its data region
+// is complete, so a damaged file is rejected before the target is touched
+func checkBackup(path string) (storage.Metadata, error) {
+	fileReader, err := storage.NewFileReader(path)
+	if err != nil {
+		return storage.Metadata{}, fmt.Errorf("failed to open backup: %w", err)
+	}
+	defer fileReader.Close()
+
+	metadata, err := fileReader.ReadHeader()
+	if err != nil {
+		return metadata, headerError(err)
+	}
+	if err := fileReader.CheckDataRegion(); err != nil {
+		return metadata, &codedError{code: ErrorCodeFileFormat, phase: "read-header", err: err}
+	}
+	return metadata, nil
+}
+
+// confirmDrop asks on the terminal whether the target collection may be
+// dropped. Without a terminal there is nobody to ask, so --yes is required.
+func confirmDrop(database, collection string, metadata storage.Metadata) error {
+	if !utils.IsTerminal(os.Stdin) {
+		return &codedError{code: ErrorCodeUsage, phase: "setup",
+			err: fmt.Errorf("--drop needs confirmation; pass --yes when not running interactively")}
+	}
+
+	fmt.Printf("Drop %s.%s and restore %d documents from %s.%s? [y/N] ",
+		database, collection, metadata.DocumentCount, metadata.Database, metadata.Collection)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return nil
+	}
+	return fmt.Errorf("restore cancelled")
+}
@@ -2,41 +2,379 @@
 package cmd
 
 import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sfi2k7/mc/internal/db"
 	"github.com/sfi2k7/mc/internal/utils"
 	"github.com/spf13/cobra"
 )
 
+// Version is the mc release, reported to the server in the default
+// application name. Release builds set it with
+// -ldflags "-X github.com/sfi2k7/mc/cmd.Version=..."
+var Version = "dev"
+
+// passwordEnvVar is the environment variable consulted for the password
+const passwordEnvVar = "MC_MONGO_PASSWORD"
+
+// needsConnection marks commands that connect to MongoDB; only those have
+// their connection flags validated
+const needsConnection = "needsConnection"
+
+// largeBatchSize is the --batch-size above which a warning is logged, since
+// each batch is held in memory
+const largeBatchSize = 100000
+
 var (
-	host      string
-	port      int
-	uri       string
-	batchSize int
-	logger    *utils.Logger
-	rootCmd   *cobra.Command
+	host             string
+	port             int
+	uri              string
+	username         string
+	password         string
+	passwordFile     string
+	appName          string
+	batchSize        int
+	progressInterval time.Duration
+	colorMode        string
+	statsEvery       time.Duration
+	maxPoolSize      uint64
+	minPoolSize      uint64
+	selectionTimeout time.Duration
+	netCompressors   []string
+	progressColor    bool
+	progressFD       int
+	progressEvents   *os.File
+	progressUnit     string
+	logFormat        string
+	cpuProfile       string
+	memProfile       string
+	cpuProfileFile   *os.File
+	logger           *utils.Logger
+	rootCmd          *cobra.Command
 )
 
 func init() {
 	rootCmd = &cobra.Command{
-		Use:   "mc",
-		Short: "MongoDB Collection Transfer Utility",
+		Use:     "mc",
+		Short:   "MongoDB Collection Transfer Utility",
+		Version: Version,
 		Long: `A utility for transferring MongoDB collections between servers.
-Supports exporting and importing collections while preserving BSON types.`,
+Supports exporting and importing collections while preserving BSON types.
+
+Exit codes:
+  0  success
+  1  other failure
+  2  invalid flags or arguments
+  3  cannot connect to MongoDB, or the connection was lost
+  4  input file missing or not a valid MCBZ file
+  5  timeout
+  6  failed to write output
+  7  partial success: an import finished but rejected some documents`,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if err := applyGlobalFlags(); err != nil {
+				return usageError(err)
+			}
+			// cobra checks these only after this hook, and without an
+			// error code
+			if err := cmd.ValidateRequiredFlags(); err != nil {
+				return usageError(err)
+			}
+			if err := cmd.ValidateFlagGroups(); err != nil {
+				return usageError(err)
+			}
+			if cmd.Annotations[needsConnection] != "" {
+				if err := validateConnectionFlags(cmd); err != nil {
+					return usageError(err)
+				}
+			}
+			return nil
+		},
 	}
+	rootCmd.SetFlagErrorFunc(func(cmd *cobra.Command, err error) error {
+		return usageError(err)
+	})
 
 	// Global flags
 	rootCmd.PersistentFlags().StringVar(&host, "host", "localhost", "MongoDB host")
 	rootCmd.PersistentFlags().IntVar(&port, "port", 27017, "MongoDB port")
 	rootCmd.PersistentFlags().StringVar(&uri, "uri", "", "MongoDB URI (overrides host/port if specified)")
+	rootCmd.PersistentFlags().StringVar(&username, "username", "", "MongoDB username")
+	rootCmd.PersistentFlags().StringVar(&password, "password", "", "MongoDB password (or set "+passwordEnvVar+")")
+	rootCmd.PersistentFlags().StringVar(&passwordFile, "password-file", "", "Read the MongoDB password from the first line of a file")
+	rootCmd.PersistentFlags().StringVar(&appName, "app-name", "mc/"+Version, "Application name reported to the server in logs and currentOp (an appName in --uri takes precedence)")
+	rootCmd.PersistentFlags().Uint64Var(&maxPoolSize, "max-pool-size", 10, "Maximum number of connections in the pool (should be at least the number of parallel workers)")
+	rootCmd.PersistentFlags().Uint64Var(&minPoolSize, "min-pool-size", 1, "Minimum number of connections kept in the pool")
+	rootCmd.PersistentFlags().DurationVar(&selectionTimeout, "server-selection-timeout", 10*time.Second, "How long to wait for a reachable MongoDB server")
+	rootCmd.PersistentFlags().StringSliceVar(&netCompressors, "network-compression", nil, "Compress MongoDB wire traffic with snappy, zstd or zlib, independently of the file codec; a comma-separated list is offered in order of preference (default none)")
 	rootCmd.PersistentFlags().IntVar(&batchSize, "batch-size", 1000, "Number of documents per batch")
+	rootCmd.PersistentFlags().StringVar(&colorMode, "color", "auto", "Colorize output: auto, always or never")
+	rootCmd.PersistentFlags().DurationVar(&progressInterval, "progress-interval", utils.DefaultProgressInterval, "Minimum time between progress updates")
+	rootCmd.PersistentFlags().IntVar(&progressFD, "progress-fd", 0, "Also write progress as JSON lines to this open file descriptor, e.g. for a GUI (0 to disable)")
+	rootCmd.PersistentFlags().StringVar(&progressUnit, "progress-unit", utils.UnitAuto, "Unit of the progress bar: docs, bytes, file (bytes of the input file, for import) or auto")
+	rootCmd.PersistentFlags().StringVar(&logFormat, "log-format", utils.LogFormatText, "Log output format: text or json (json adds an error code and phase to failures)")
+	rootCmd.PersistentFlags().DurationVar(&statsEvery, "stats-every", 0, "Log progress statistics at this interval (0 to disable)")
+
+	// Profiling flags for performance debugging
+	rootCmd.PersistentFlags().StringVar(&cpuProfile, "cpuprofile", "", "Write a CPU profile to this file")
+	rootCmd.PersistentFlags().StringVar(&memProfile, "memprofile", "", "Write a heap profile to this file")
+	rootCmd.PersistentFlags().MarkHidden("cpuprofile")
+	rootCmd.PersistentFlags().MarkHidden("memprofile")
 
 	// Add subcommands
 	rootCmd.AddCommand(newExportCmd())
 	rootCmd.AddCommand(newImportCmd())
 	rootCmd.AddCommand(newInspectCmd())
+	rootCmd.AddCommand(newBenchmarkCmd())
+	rootCmd.AddCommand(newVerifyCmd())
+	rootCmd.AddCommand(newVerifyRestoreCmd())
+	rootCmd.AddCommand(newUpgradeCmd())
+	rootCmd.AddCommand(newBrowseCmd())
+	rootCmd.AddCommand(newBackupCmd())
+	rootCmd.AddCommand(newRestoreCmd())
+
+	for _, cmd := range rootCmd.Commands() {
+		tagArgErrors(cmd)
+	}
+}
+
+// tagArgErrors marks the errors of a command's argument checks, such as a
+// missing OUTPUT_FILE, as usage errors
+func tagArgErrors(cmd *cobra.Command) {
+	if args := cmd.Args; args != nil {
+		cmd.Args = func(cmd *cobra.Command, a []string) error {
+			if err := args(cmd, a); err != nil {
+				return usageError(err)
+			}
+			return nil
+		}
+	}
+	for _, sub := range cmd.Commands() {
+		tagArgErrors(sub)
+	}
+}
+
+// applyGlobalFlags validates the global flags and configures shared state
+func applyGlobalFlags() error {
+	if !utils.ValidLogFormat(logFormat) {
+		return fmt.Errorf("invalid --log-format %q (expected text or json)", logFormat)
+	}
+	logger.SetFormat(logFormat)
+	if logger.JSON() {
+		// Failures are reported once, as JSON, by ReportError
+		rootCmd.SilenceErrors = true
+		rootCmd.SilenceUsage = true
+	}
+
+	stdoutColor, err := utils.UseColor(colorMode, os.Stdout)
+	if err != nil {
+		return err
+	}
+	stderrColor, err := utils.UseColor(colorMode, os.Stderr)
+	if err != nil {
+		return err
+	}
+	if batchSize <= 0 {
+		return fmt.Errorf("--batch-size must be positive, got %d", batchSize)
+	}
+	if batchSize > math.MaxInt32 {
+		return fmt.Errorf("--batch-size cannot exceed %d", math.MaxInt32)
+	}
+	if maxPoolSize == 0 {
+		return fmt.Errorf("--max-pool-size must be at least 1")
+	}
+	if selectionTimeout <= 0 {
+		return fmt.Errorf("--server-selection-timeout must be positive, got %s", selectionTimeout)
+	}
+	if minPoolSize > maxPoolSize {
+		return fmt.Errorf("--min-pool-size (%d) cannot exceed --max-pool-size (%d)", minPoolSize, maxPoolSize)
+	}
+
+	if !utils.ValidProgressUnit(progressUnit) {
+		return fmt.Errorf("invalid --progress-unit %q (expected docs, bytes, file or auto)", progressUnit)
+	}
+
+	if progressFD < 0 {
+		return fmt.Errorf("--progress-fd must not be negative, got %d", progressFD)
+	}
+	if progressFD > 0 {
+		f := os.NewFile(uintptr(progressFD), "progress-fd")
+		if _, err := f.Stat(); err != nil {
+			return fmt.Errorf("--progress-fd %d is not an open file descriptor", progressFD)
+		}
+		progressEvents = f
+	}
+
+	logger.SetColor(stdoutColor, stderrColor)
+	progressColor = stdoutColor
+
+	if batchSize > largeBatchSize {
+		logger.Warn("Very large --batch-size; every batch is held in memory", "batch_size", batchSize)
+	}
+
+	if cpuProfile != "" {
+		f, err := os.Create(cpuProfile)
+		if err != nil {
+			return fmt.Errorf("failed to create CPU profile: %w", err)
+		}
+		if err := pprof.StartCPUProfile(f); err != nil {
+			f.Close()
+			return fmt.Errorf("failed to start CPU profile: %w", err)
+		}
+		cpuProfileFile = f
+	}
+
+	return nil
+}
+
+// validateConnectionFlags rejects conflicting or incomplete connection
+// flags before a command starts working
+func validateConnectionFlags(cmd *cobra.Command) error {
+	flags := cmd.Flags()
+	if uri != "" && (flags.Changed("host") || flags.Changed("port")) {
+		return fmt.Errorf("--uri cannot be combined with --host or --port")
+	}
+	if password != "" && passwordFile != "" {
+		logger.Warn("--password is set, so --password-file is ignored", "password_file", passwordFile)
+	}
+
+	opts, err := connectOptions()
+	if err != nil {
+		return err
+	}
+	return opts.Validate()
+}
+
+// stopProfiling flushes any profiles requested on the command line
+func stopProfiling() {
+	if cpuProfileFile != nil {
+		pprof.StopCPUProfile()
+		cpuProfileFile.Close()
+		cpuProfileFile = nil
+	}
+
+	if memProfile != "" {
+		f, err := os.Create(memProfile)
+		if err != nil {
+			logger.Error("Failed to create heap profile", "error", err)
+			return
+		}
+		defer f.Close()
+
+		// Get up-to-date statistics
+		runtime.GC()
+		if err := pprof.WriteHeapProfile(f); err != nil {
+			logger.Error("Failed to write heap profile", "error", err)
+		}
+	}
+}
+
+// connectOptions builds the connection settings from the global flags. The
+// password is taken from --password, then --password-file, then the
+// environment.
+func connectOptions() (db.ConnectOptions, error) {
+	opts := db.ConnectOptions{
+		URI:         uri,
+		Host:        host,
+		Port:        port,
+		Username:    username,
+		Password:    password,
+		AppName:     appName,
+		MaxPoolSize: maxPoolSize,
+		MinPoolSize: minPoolSize,
+
+		ServerSelectionTimeout: selectionTimeout,
+		Compressors:            netCompressors,
+	}
+
+	if opts.Password == "" && passwordFile != "" {
+		data, err := os.ReadFile(passwordFile)
+		if err != nil {
+			return db.ConnectOptions{}, fmt.Errorf("failed to read password file: %w", err)
+		}
+		opts.Password = strings.TrimRight(strings.SplitN(string(data), "\n", 2)[0], "\r")
+	}
+	if opts.Password == "" {
+		opts.Password = os.Getenv(passwordEnvVar)
+	}
+
+	return opts, nil
+}
+
+// progressBytes reports whether progress is counted in bytes. Every command
+// moves documents to or from a database, so auto counts documents. Commands
+// that do not read an MCBZ file count document bytes for the file unit.
+func progressBytes() bool {
+	return progressUnit == utils.UnitBytes || progressUnit == utils.UnitFile
+}
+
+// newProgressBar creates a progress bar configured from the global flags
+func newProgressBar(operation string) *utils.ProgressBar {
+	progress := utils.NewProgressBar(operation)
+	progress.SetInterval(progressInterval)
+	progress.SetColor(progressColor)
+	progress.SetBytes(progressBytes())
+	if progressEvents != nil {
+		progress.SetEventWriter(progressEvents)
+	}
+	return progress
+}
+
+// startStatsLogger logs the progress of a running operation every
+// --stats-every interval. The returned function stops it and is safe to
+// call more than once.
+func startStatsLogger(progress *utils.ProgressBar) func() {
+	if statsEvery <= 0 {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	ticker := time.NewTicker(statsEvery)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				stats := progress.Stats()
+				percent := "unknown"
+				if stats.Percent >= 0 {
+					percent = fmt.Sprintf("%.1f%%", stats.Percent)
+				}
+				logger.Info("Progress",
+					"count", stats.Current,
+					"total", stats.Total,
+					"percent", percent,
+					"rate", fmt.Sprintf("%.0f/s", stats.Rate),
+					"elapsed", stats.Elapsed.Round(time.Second))
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
 }
 
 // Execute runs the root command
 func Execute(log *utils.Logger) error {
 	logger = log
-	return rootCmd.Execute()
+
+	// Profiles are flushed even when the command fails
+	defer stopProfiling()
+	cmd, err := rootCmd.ExecuteC()
+	var coded *codedError
+	if err != nil && cmd == rootCmd && !errors.As(err, &coded) {
+		// The root command runs nothing itself, so its errors come from
+		// resolving the command line, e.g. an unknown command
+		return usageError(err)
+	}
+	return err
 }
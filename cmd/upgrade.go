@@ -0,0 +1,134 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/sfi2k7/mc/internal/storage"
+	"github.com/sfi2k7/mc/internal/utils"
+	"github.com/spf13/cobra"
+)
+
+// upgradeExtension is appended to the file path while it is rewritten
+const upgradeExtension = ".upgrade"
+
+func newUpgradeCmd() *cobra.Command {
+	var (
+		force  bool
+		preset string
+	)
+
+	upgradeCmd := &cobra.Command{
+		Use:   "upgrade FILE",
+		Short: "Rewrite an MCBZ file in the current format version",
+		Long: `Upgrade reads an MCBZ file written in an older format version and rewrites it
+in the current one. The document count and sizes are recomputed from the data.
+The new file replaces the old one only once it is complete. Files already in
+the current format are left alone unless --force is given.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runUpgrade(args[0], force, preset)
+		},
+	}
+
+	upgradeCmd.Flags().BoolVar(&force, "force", false, "Rewrite the file even if it is already in the current format")
+	upgradeCmd.Flags().StringVar(&preset, "compression", "balanced", "Compression preset for the rewritten file: fast, balanced or max")
+
+	return upgradeCmd
+}
+
+func runUpgrade(filePath string, force bool, preset string) error {
+	compression, err := storage.ResolveCompression(preset, 0)
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to get file info: %w", err)
+	}
+	compression.FileMode = info.Mode().Perm()
+
+	fileReader, err := storage.NewFileReader(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %w", err)
+	}
+	defer fileReader.Close()
+
+	metadata, err := fileReader.ReadHeader()
+	if err != nil {
+		return headerError(err)
+	}
+	if !fileReader.Outdated() && !force {
+		return fmt.Errorf("%s is already in the current format (use --force to rewrite it anyway)", filePath)
+	}
+
+	tmpPath := filePath + upgradeExtension
+	fileWriter, err := storage.NewFileWriter(tmpPath, compression)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", tmpPath, writeError(tmpPath, err))
+	}
+	defer os.Remove(tmpPath)
+	defer fileWriter.Close()
+
+	// Keep what describes the export; sizes and codec are recomputed
+	upgraded := storage.Metadata{
+		Database:       metadata.Database,
+		Collection:     metadata.Collection,
+		Timestamp:      metadata.Timestamp,
+		Source:         metadata.Source,
+		Options:        metadata.Options,
+		Indexes:        metadata.Indexes,
+		CollectionUUID: metadata.CollectionUUID,
+		Part:           metadata.Part,
+		Writer:         metadata.Writer,
+		Format:         metadata.Format,
+		OplogEnd:       metadata.OplogEnd,
+	}
+	if err := fileWriter.WriteHeader(upgraded); err != nil {
+		return fmt.Errorf("failed to write header: %w", err)
+	}
+
+	progress := newProgressBar("Upgrading")
+	progress.SetTotal(metadata.DocumentCount)
+	var count int64
+	for {
+		batch, err := fileReader.ReadBatch(batchSize)
+		if err != nil {
+			progress.Finish()
+			return fmt.Errorf("failed to read batch: %w", err)
+		}
+		if len(batch) == 0 {
+			break
+		}
+		if err := fileWriter.WriteBatch(batch); err != nil {
+			progress.Finish()
+			return fmt.Errorf("failed to write batch: %w", writeError(tmpPath, err))
+		}
+		count += int64(len(batch))
+		progress.Add(int64(len(batch)))
+	}
+	progress.Finish()
+
+	if count != metadata.DocumentCount {
+		logger.Warn("Document count differs from the old header; using the count read",
+			"header", metadata.DocumentCount, "read", count)
+	}
+	upgraded.DocumentCount = count
+	if err := fileWriter.WriteFooter(upgraded); err != nil {
+		return fmt.Errorf("failed to write footer: %w", writeError(tmpPath, err))
+	}
+	if err := fileWriter.Close(); err != nil {
+		return fmt.Errorf("failed to close %s: %w", tmpPath, err)
+	}
+	fileReader.Close()
+
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		return fmt.Errorf("failed to replace %s: %w", filePath, err)
+	}
+	logger.Info("File upgraded",
+		"file", filePath,
+		"docs", count,
+		"size", utils.FormatByteSize(fileWriter.BytesWritten()))
+	return nil
+}
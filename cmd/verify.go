@@ -0,0 +1,102 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/sfi2k7/mc/internal/storage"
+	"github.com/spf13/cobra"
+)
+
+func newVerifyCmd() *cobra.Command {
+	var (
+		useManifest  bool
+		manifestPath string
+		strict       bool
+	)
+
+	verifyCmd := &cobra.Command{
+		Use:   "verify FILE",
+		Short: "Verify the integrity of an MCBZ file",
+		Long: `Verify reads every document in an MCBZ file and checks the count against
+the header. With --manifest the file is also checked against its SHA-256 sidecar.
+With --strict the file must also end exactly where the header says the data
+region ends, so truncation at a batch boundary and trailing bytes are caught.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			filePath := args[0]
+			if manifestPath != "" {
+				useManifest = true
+			} else if useManifest {
+				manifestPath = filePath + storage.ManifestExtension
+			}
+			return runVerify(filePath, useManifest, manifestPath, strict)
+		},
+	}
+
+	verifyCmd.Flags().BoolVar(&useManifest, "manifest", false, "Check the file against its "+storage.ManifestExtension+" manifest")
+	verifyCmd.Flags().StringVar(&manifestPath, "manifest-file", "", "Path to the manifest (implies --manifest)")
+	verifyCmd.Flags().BoolVar(&strict, "strict", false, "Fail unless the file ends exactly at the end of the data region recorded in the header")
+
+	return verifyCmd
+}
+
+func runVerify(filePath string, useManifest bool, manifestPath string, strict bool) error {
+	var manifest storage.Manifest
+	if useManifest {
+		var err error
+		manifest, err = storage.ReadManifest(manifestPath)
+		if err != nil {
+			return fmt.Errorf("failed to read manifest: %w", err)
+		}
+
+		sum, err := storage.FileSHA256(filePath)
+		if err != nil {
+			return fmt.Errorf("failed to hash file: %w", err)
+		}
+		if sum != manifest.SHA256 {
+			return fmt.Errorf("checksum mismatch: manifest has %s, file has %s", manifest.SHA256, sum)
+		}
+		logger.Info("Checksum OK", "sha256", sum)
+	}
+
+	// Create file reader
+	fileReader, err := storage.NewFileReader(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %w", err)
+	}
+	defer fileReader.Close()
+
+	metadata, err := fileReader.ReadHeader()
+	if err != nil {
+		return headerError(err)
+	}
+
+	if strict {
+		if err := fileReader.CheckDataRegion(); err != nil {
+			return err
+		}
+	}
+
+	// Read every document to make sure the data region decodes
+	var count int64
+	for {
+		batch, err := fileReader.ReadBatch(batchSize)
+		if err != nil {
+			return fmt.Errorf("failed to read batch after %d documents: %w", count, err)
+		}
+		if len(batch) == 0 {
+			break
+		}
+		count += int64(len(batch))
+	}
+
+	if count != metadata.DocumentCount {
+		return fmt.Errorf("document count mismatch: header has %d, file contains %d", metadata.DocumentCount, count)
+	}
+	if useManifest && manifest.DocumentCount >= 0 && manifest.DocumentCount != count {
+		return fmt.Errorf("document count mismatch: manifest has %d, file contains %d", manifest.DocumentCount, count)
+	}
+
+	logger.Info("Verification passed", "file", filePath, "docs", count)
+	return nil
+}
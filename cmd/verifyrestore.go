@@ -0,0 +1,117 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sfi2k7/mc/internal/db"
+	"github.com/sfi2k7/mc/internal/storage"
+	"github.com/spf13/cobra"
+)
+
+func newVerifyRestoreCmd() *cobra.Command {
+	var (
+		database   string
+		collection string
+		full       bool
+		sampleSize int
+	)
+
+	verifyRestoreCmd := &cobra.Command{
+		Use:   "verify-restore -d DATABASE [-c COLLECTION] FILE",
+		Short: "Check that a collection matches the documents of an MCBZ file",
+		Long: `Verify-restore looks up documents of an MCBZ file by _id in a collection and
+compares them, ignoring field order. A random sample is checked unless --full
+is given. Documents added to the collection after the restore are not
+reported. The collection defaults to the source collection of the file.`,
+		Annotations: map[string]string{needsConnection: "true"},
+		Args:        cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runVerifyRestore(args[0], database, collection, full, sampleSize)
+		},
+	}
+
+	verifyRestoreCmd.Flags().StringVarP(&database, "database", "d", "", "MongoDB database name")
+	verifyRestoreCmd.Flags().StringVarP(&collection, "collection", "c", "", "MongoDB collection name (default: the source collection of the file)")
+	verifyRestoreCmd.Flags().BoolVar(&full, "full", false, "Check every document instead of a sample")
+	verifyRestoreCmd.Flags().IntVar(&sampleSize, "sample", 1000, "Number of documents checked without --full")
+
+	verifyRestoreCmd.MarkFlagRequired("database")
+
+	return verifyRestoreCmd
+}
+
+func runVerifyRestore(filePath, database, collection string, full bool, sampleSize int) error {
+	if !full && sampleSize < 1 {
+		return usageErrorf("--sample must be at least 1")
+	}
+
+	fileReader, err := storage.NewFileReader(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %w", err)
+	}
+	defer fileReader.Close()
+
+	metadata, err := fileReader.ReadHeader()
+	if err != nil {
+		return headerError(err)
+	}
+	if metadata.Format == storage.FormatOplog {
+		return fmt.Errorf("%s is an oplog export, which holds changes rather than documents", filePath)
+	}
+	if collection == "" {
+		collection = metadata.Collection
+	}
+	if err := db.ValidateCollectionName(database, collection); err != nil {
+		return usageError(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+	defer cancel()
+
+	connOpts, err := connectOptions()
+	if err != nil {
+		return err
+	}
+	client, err := db.Connect(ctx, connOpts)
+	if err != nil {
+		return connectError(err)
+	}
+	defer client.Disconnect(ctx)
+
+	progress := newProgressBar("Verifying")
+	if progressBytes() {
+		progress.SetTotal(metadata.OriginalSize)
+	} else {
+		progress.SetTotal(metadata.DocumentCount)
+	}
+	result, err := db.VerifyRestore(ctx, client, database, collection,
+		db.VerifyOptions{
+			Full:          full,
+			Sample:        sampleSize,
+			BatchSize:     batchSize,
+			ProgressBytes: progressBytes(),
+			Logger:        logger,
+		},
+		fileReader,
+		progress,
+	)
+	progress.Finish()
+	if err != nil {
+		return err
+	}
+
+	logger.Info("Verification finished",
+		"checked", result.Checked,
+		"matched", result.Matched,
+		"mismatched", result.Mismatched,
+		"missing", result.Missing,
+		"database", database,
+		"collection", collection)
+	if result.Mismatched > 0 || result.Missing > 0 {
+		return fmt.Errorf("collection does not match the file: %d mismatched, %d missing of %d checked",
+			result.Mismatched, result.Missing, result.Checked)
+	}
+	return nil
+}
@@ -3,7 +3,8 @@ module github.com/sfi2k7/mc
 go 1.18
 
 require (
-	github.com/klauspost/compress v1.16.7
+	github.com/itchyny/gojq v0.12.13
+	github.com/klauspost/compress v1.17.2
 	github.com/spf13/cobra v1.7.0
 	go.mongodb.org/mongo-driver v1.12.1
 )
@@ -11,6 +12,7 @@ require (
 require (
 	github.com/golang/snappy v0.0.4 // indirect
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
+	github.com/itchyny/timefmt-go v0.1.5 // indirect
 	github.com/montanaflynn/stats v0.7.1 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
 	github.com/xdg-go/pbkdf2 v1.0.0 // indirect
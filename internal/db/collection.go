@@ -0,0 +1,373 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// CollectionOptions are the collection-level settings applied when an
+// import has to create its target collection
+type CollectionOptions struct {
+	Collation bson.D
+	Validator bson.D
+	// Timeseries creates a time-series collection; it needs at least a
+	// timeField
+	Timeseries bson.D
+	// Stored are the options captured at export time. Collation, Validator
+	// and Timeseries take precedence over the matching stored entries.
+	Stored bson.D
+	// UUID, when set, is the UUID to create the collection with. It needs
+	// applyOps with the useUUID and forceUUID privileges (the restore role
+	// on a replica set); without them the collection gets a new UUID and a
+	// warning is logged.
+	UUID []byte
+}
+
+// IsZero reports whether no options are set
+func (o CollectionOptions) IsZero() bool {
+	return len(o.Collation) == 0 && len(o.Validator) == 0 && len(o.Timeseries) == 0 && len(o.Stored) == 0 && len(o.UUID) == 0
+}
+
+// createOptions merges the stored options with the explicit ones
+func (o CollectionOptions) createOptions() bson.D {
+	merged := make(bson.D, 0, len(o.Stored)+3)
+	for _, elem := range o.Stored {
+		if (elem.Key == "collation" && len(o.Collation) > 0) ||
+			(elem.Key == "validator" && len(o.Validator) > 0) ||
+			(elem.Key == "timeseries" && len(o.Timeseries) > 0) {
+			continue
+		}
+		merged = append(merged, elem)
+	}
+	if len(o.Collation) > 0 {
+		merged = append(merged, bson.E{Key: "collation", Value: o.Collation})
+	}
+	if len(o.Validator) > 0 {
+		merged = append(merged, bson.E{Key: "validator", Value: o.Validator})
+	}
+	if len(o.Timeseries) > 0 {
+		merged = append(merged, bson.E{Key: "timeseries", Value: o.Timeseries})
+	}
+	return merged
+}
+
+// maxNamespaceLength is the server's limit on database.collection names
+const maxNamespaceLength = 255
+
+// ValidateCollectionName rejects collection names the server would refuse
+func ValidateCollectionName(database, collection string) error {
+	switch {
+	case collection == "":
+		return fmt.Errorf("collection name must not be empty")
+	case strings.ContainsAny(collection, "$\x00"):
+		return fmt.Errorf("invalid collection name %q: must not contain $ or a null character", collection)
+	case strings.HasPrefix(collection, "system."):
+		return fmt.Errorf("invalid collection name %q: the system. prefix is reserved", collection)
+	case len(database)+1+len(collection) > maxNamespaceLength:
+		return fmt.Errorf("invalid collection name %q: namespace %s.%s exceeds %d bytes", collection, database, collection, maxNamespaceLength)
+	}
+	return nil
+}
+
+// ParseCollectionOptions parses collation, validator and time-series
+// documents given in extended JSON. Empty strings leave the option unset.
+func ParseCollectionOptions(collation, validator, timeseries string) (CollectionOptions, error) {
+	var opts CollectionOptions
+	if collation != "" {
+		if err := bson.UnmarshalExtJSON([]byte(collation), true, &opts.Collation); err != nil {
+			return opts, fmt.Errorf("invalid collation: %w", err)
+		}
+	}
+	if validator != "" {
+		if err := bson.UnmarshalExtJSON([]byte(validator), true, &opts.Validator); err != nil {
+			return opts, fmt.Errorf("invalid validator: %w", err)
+		}
+	}
+	if timeseries != "" {
+		if err := bson.UnmarshalExtJSON([]byte(timeseries), true, &opts.Timeseries); err != nil {
+			return opts, fmt.Errorf("invalid timeseries options: %w", err)
+		}
+		if field, _ := lookupField(opts.Timeseries, "timeField"); field == nil || field == "" {
+			return opts, fmt.Errorf("invalid timeseries options: timeField is required")
+		}
+	}
+	return opts, nil
+}
+
+// CollectionStructure returns the options and secondary index
+// specifications of a collection. Server-managed index fields are removed
+// so the specifications can be passed to createIndexes.
+func CollectionStructure(ctx context.Context, client *mongo.Client, database, collection string) (bson.D, []bson.D, error) {
+	db := client.Database(database)
+
+	specs, err := db.ListCollectionSpecifications(ctx, bson.D{{Key: "name", Value: collection}})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list collection options: %w", err)
+	}
+	var collOptions bson.D
+	if len(specs) > 0 && len(specs[0].Options) > 0 {
+		if err := bson.Unmarshal(specs[0].Options, &collOptions); err != nil {
+			return nil, nil, fmt.Errorf("failed to decode collection options: %w", err)
+		}
+		collOptions = creatableTimeseries(collOptions)
+	}
+
+	cursor, err := db.Collection(collection).Indexes().List(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list indexes: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	var indexes []bson.D
+	for cursor.Next(ctx) {
+		var spec bson.D
+		if err := cursor.Decode(&spec); err != nil {
+			return nil, nil, fmt.Errorf("failed to decode index: %w", err)
+		}
+		if name, _ := lookupField(spec, "name"); name == "_id_" {
+			continue
+		}
+		indexes = append(indexes, withoutFields(spec, "v", "ns"))
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, nil, fmt.Errorf("failed to list indexes: %w", err)
+	}
+
+	return collOptions, indexes, nil
+}
+
+// CollectionUUID returns the UUID listCollections reports for a collection,
+// or nil when the collection does not exist or the server reports none
+func CollectionUUID(ctx context.Context, client *mongo.Client, database, collection string) ([]byte, error) {
+	specs, err := client.Database(database).ListCollectionSpecifications(ctx, bson.D{{Key: "name", Value: collection}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list collection: %w", err)
+	}
+	if len(specs) == 0 || specs[0].UUID == nil {
+		return nil, nil
+	}
+	return specs[0].UUID.Data, nil
+}
+
+// CollectionCount reports whether a collection exists and its estimated
+// document count
+func CollectionCount(ctx context.Context, client *mongo.Client, database, collection string) (bool, int64, error) {
+	db := client.Database(database)
+	names, err := db.ListCollectionNames(ctx, bson.D{{Key: "name", Value: collection}})
+	if err != nil {
+		return false, 0, fmt.Errorf("failed to look up collection: %w", err)
+	}
+	if len(names) == 0 {
+		return false, 0, nil
+	}
+
+	count, err := db.Collection(collection).EstimatedDocumentCount(ctx)
+	if err != nil {
+		return true, 0, fmt.Errorf("failed to count documents: %w", err)
+	}
+	return true, count, nil
+}
+
+// CollectionCountExact is CollectionCount with an exact count when the
+// estimate is at most exactLimit, where counting is cheap. It reports
+// whether the count is exact.
+func CollectionCountExact(ctx context.Context, client *mongo.Client, database, collection string, exactLimit int64) (exists bool, count int64, exact bool, err error) {
+	exists, count, err = CollectionCount(ctx, client, database, collection)
+	if err != nil || !exists || count > exactLimit {
+		return exists, count, false, err
+	}
+
+	count, err = client.Database(database).Collection(collection).CountDocuments(ctx, bson.D{})
+	if err != nil {
+		return true, 0, false, fmt.Errorf("failed to count documents: %w", err)
+	}
+	return true, count, true, nil
+}
+
+// CollectionDataSize returns the uncompressed size of a collection's
+// documents as reported by collStats
+func CollectionDataSize(ctx context.Context, client *mongo.Client, database, collection string) (int64, error) {
+	var stats struct {
+		Size int64 `bson:"size"`
+	}
+	cmd := bson.D{{Key: "collStats", Value: collection}}
+	if err := client.Database(database).RunCommand(ctx, cmd).Decode(&stats); err != nil {
+		return 0, fmt.Errorf("failed to read collection stats: %w", err)
+	}
+	return stats.Size, nil
+}
+
+// FilterIndexes removes the index specifications whose name is listed in
+// names or matches pattern (when not nil). It returns the remaining
+// specifications and the names of the removed ones.
+func FilterIndexes(indexes []bson.D, names []string, pattern *regexp.Regexp) ([]bson.D, []string) {
+	var kept []bson.D
+	var skipped []string
+	for _, spec := range indexes {
+		name, _ := lookupField(spec, "name")
+		nameStr, _ := name.(string)
+		skip := pattern != nil && pattern.MatchString(nameStr)
+		for _, n := range names {
+			if n == nameStr {
+				skip = true
+				break
+			}
+		}
+		if skip {
+			skipped = append(skipped, nameStr)
+		} else {
+			kept = append(kept, spec)
+		}
+	}
+	return kept, skipped
+}
+
+// createIndexes builds the given index specifications on a collection
+func createIndexes(ctx context.Context, client *mongo.Client, database, collection string, indexes []bson.D) error {
+	if len(indexes) == 0 {
+		return nil
+	}
+	cmd := bson.D{
+		{Key: "createIndexes", Value: collection},
+		{Key: "indexes", Value: indexes},
+	}
+	if err := client.Database(database).RunCommand(ctx, cmd).Err(); err != nil {
+		return fmt.Errorf("failed to create indexes: %w", err)
+	}
+	return nil
+}
+
+// ensureCollection creates the collection with the given options when it
+// does not exist yet. An existing collection is left alone, with a warning
+// when its options differ from the requested ones. Without options, the
+// collection is only created when force is set.
+func ensureCollection(ctx context.Context, client *mongo.Client, database, collection string, opts ImportOptions, force bool) error {
+	if opts.Collection.IsZero() && !force {
+		return nil
+	}
+	requested := opts.Collection.createOptions()
+
+	db := client.Database(database)
+	specs, err := db.ListCollectionSpecifications(ctx, bson.D{{Key: "name", Value: collection}})
+	if err != nil {
+		return fmt.Errorf("failed to look up collection: %w", err)
+	}
+
+	if len(specs) > 0 {
+		for _, elem := range requested {
+			if optionDiffers(specs[0].Options, elem) {
+				opts.Logger.Warn("Existing collection has a different option; keeping it", "collection", collection, "option", elem.Key)
+			}
+		}
+		uuid := opts.Collection.UUID
+		if len(uuid) > 0 && (specs[0].UUID == nil || !bytes.Equal(specs[0].UUID.Data, uuid)) {
+			opts.Logger.Warn("Existing collection has a different UUID; keeping it (use --drop to recreate it)", "collection", collection)
+		}
+		return nil
+	}
+
+	cmd := append(bson.D{{Key: "create", Value: collection}}, requested...)
+	if len(opts.Collection.UUID) > 0 {
+		err := createWithUUID(ctx, client, database, cmd, opts.Collection.UUID)
+		if err == nil {
+			opts.Logger.Info("Created collection with the stored UUID", "database", database, "collection", collection)
+			return nil
+		}
+		opts.Logger.Warn("Cannot create the collection with the stored UUID; it gets a new one", "collection", collection, "error", err)
+	}
+	if err := db.RunCommand(ctx, cmd).Err(); err != nil {
+		return fmt.Errorf("failed to create collection: %w", err)
+	}
+
+	opts.Logger.Info("Created collection", "database", database, "collection", collection)
+	return nil
+}
+
+// createWithUUID runs a create command through applyOps with the given
+// collection UUID, the way mongorestore --preserveUUID does. The server
+// only accepts this from users with the applyOps, useUUID and forceUUID
+// privileges, and not on mongos or a standalone without an oplog.
+func createWithUUID(ctx context.Context, client *mongo.Client, database string, create bson.D, uuid []byte) error {
+	cmd := bson.D{{Key: "applyOps", Value: bson.A{bson.D{
+		{Key: "op", Value: "c"},
+		{Key: "ns", Value: database + ".$cmd"},
+		{Key: "ui", Value: primitive.Binary{Subtype: bson.TypeBinaryUUID, Data: uuid}},
+		{Key: "o", Value: create},
+	}}}}
+	return client.Database("admin").RunCommand(ctx, cmd).Err()
+}
+
+// optionDiffers reports whether a requested option disagrees with an
+// existing collection's options. For document options only the requested
+// fields are compared, since the server fills in defaults for the rest of
+// a collation.
+func optionDiffers(existing bson.Raw, requested bson.E) bool {
+	raw, err := bson.Marshal(bson.D{requested})
+	if err != nil {
+		return true
+	}
+	want := bson.Raw(raw).Lookup(requested.Key)
+	have := existing.Lookup(requested.Key)
+
+	wantDoc, ok := want.DocumentOK()
+	if !ok {
+		return !have.Equal(want)
+	}
+	haveDoc, ok := have.DocumentOK()
+	if !ok {
+		return true
+	}
+	elems, err := wantDoc.Elements()
+	if err != nil {
+		return true
+	}
+	for _, elem := range elems {
+		if !haveDoc.Lookup(elem.Key()).Equal(elem.Value()) {
+			return true
+		}
+	}
+	return false
+}
+
+// creatableTimeseries removes the bucketMaxSpanSeconds the server reports
+// next to granularity, since create rejects the two together
+func creatableTimeseries(collOptions bson.D) bson.D {
+	for i, elem := range collOptions {
+		if elem.Key != "timeseries" {
+			continue
+		}
+		ts, ok := elem.Value.(bson.D)
+		if !ok {
+			break
+		}
+		if _, ok := lookupField(ts, "granularity"); ok {
+			collOptions[i].Value = withoutFields(ts, "bucketMaxSpanSeconds", "bucketRoundingSeconds")
+		}
+	}
+	return collOptions
+}
+
+// withoutFields returns a copy of doc without the given top-level keys
+func withoutFields(doc bson.D, keys ...string) bson.D {
+	out := make(bson.D, 0, len(doc))
+	for _, elem := range doc {
+		drop := false
+		for _, key := range keys {
+			if elem.Key == key {
+				drop = true
+				break
+			}
+		}
+		if !drop {
+			out = append(out, elem)
+		}
+	}
+	return out
+}
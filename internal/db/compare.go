@@ -0,0 +1,268 @@
+package db
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"math/rand"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/sfi2k7/mc/internal/storage"
+	"github.com/sfi2k7/mc/internal/utils"
+)
+
+// maxReportedDifferences caps the mismatches and missing documents logged
+// individually by VerifyRestore; all of them are counted
+const maxReportedDifferences = 20
+
+// CanonicalHash returns a SHA-256 of a document that ignores the order of
+// fields within documents, so a document whose fields were reordered by an
+// update still matches. Array order and value types are significant: 1 and
+// 1.0 or int32 and int64 differ.
+func CanonicalHash(doc bson.D) ([32]byte, error) {
+	data, err := bson.Marshal(canonicalize(doc))
+	if err != nil {
+		return [32]byte{}, err
+	}
+	return sha256.Sum256(data), nil
+}
+
+// canonicalize returns a copy of a value with the fields of every embedded
+// document sorted by name
+func canonicalize(value interface{}) interface{} {
+	switch v := value.(type) {
+	case bson.D:
+		sorted := make(bson.D, len(v))
+		for i, elem := range v {
+			sorted[i] = bson.E{Key: elem.Key, Value: canonicalize(elem.Value)}
+		}
+		sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Key < sorted[j].Key })
+		return sorted
+	case bson.A:
+		items := make(bson.A, len(v))
+		for i, item := range v {
+			items[i] = canonicalize(item)
+		}
+		return items
+	}
+	return value
+}
+
+// valueKey identifies a BSON value by its type and bytes, for use as a map
+// key; 1 and "1" differ
+func valueKey(value interface{}) (string, error) {
+	t, data, err := bson.MarshalValue(value)
+	if err != nil {
+		return "", err
+	}
+	return string(append([]byte{byte(t)}, data...)), nil
+}
+
+// VerifyOptions configures VerifyRestore
+type VerifyOptions struct {
+	// Full checks every document; otherwise Sample documents are picked at
+	// random from the file
+	Full      bool
+	Sample    int
+	BatchSize int
+	// ProgressBytes counts progress in bytes of documents read from the
+	// file instead of documents
+	ProgressBytes bool
+	Logger        *utils.Logger
+}
+
+// VerifyResult summarizes VerifyRestore
+type VerifyResult struct {
+	Checked    int64
+	Matched    int64
+	Mismatched int64
+	// Missing counts documents of the file not found in the collection
+	Missing int64
+}
+
+// verifyEntry is a document of the file awaiting comparison
+type verifyEntry struct {
+	id   interface{}
+	key  string
+	hash [32]byte
+}
+
+// VerifyRestore compares documents of an export file with the documents of
+// the same _id in a collection. Only the _id and hash of each document are
+// kept, and the collection is queried with $in over one batch of ids at a
+// time, so memory stays bounded by the batch size (or the sample size).
+func VerifyRestore(
+	ctx context.Context,
+	client *mongo.Client,
+	database, collection string,
+	opts VerifyOptions,
+	reader *storage.FileReader,
+	progress *utils.ProgressBar,
+) (VerifyResult, error) {
+	coll := client.Database(database).Collection(collection)
+	var result VerifyResult
+
+	sample := newReservoir(opts.Sample, rand.New(rand.NewSource(time.Now().UnixNano())))
+
+	for {
+		bytesBefore := reader.BytesRead()
+		batch, err := reader.ReadBatch(opts.BatchSize)
+		if err != nil {
+			return result, fmt.Errorf("failed to read batch: %w", err)
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		entries := make([]verifyEntry, 0, len(batch))
+		for _, doc := range batch {
+			entry, ok, err := newVerifyEntry(doc)
+			if err != nil {
+				return result, err
+			}
+			if !ok {
+				continue
+			}
+			if opts.Full {
+				entries = append(entries, entry)
+				continue
+			}
+			sample.add(entry)
+		}
+		if opts.Full {
+			if err := compareEntries(ctx, coll, entries, opts.Logger, &result); err != nil {
+				return result, err
+			}
+		}
+		if opts.ProgressBytes {
+			progress.Add(reader.BytesRead() - bytesBefore)
+		} else {
+			progress.Add(int64(len(batch)))
+		}
+	}
+
+	err := inBatches(sample.entries, opts.BatchSize, func(entries []verifyEntry) error {
+		return compareEntries(ctx, coll, entries, opts.Logger, &result)
+	})
+	return result, err
+}
+
+// reservoir keeps a uniform random sample of up to size entries out of
+// all entries added
+type reservoir struct {
+	size    int
+	rng     *rand.Rand
+	seen    int64
+	entries []verifyEntry
+}
+
+func newReservoir(size int, rng *rand.Rand) *reservoir {
+	return &reservoir{size: size, rng: rng}
+}
+
+// add offers an entry to the sample
+func (r *reservoir) add(entry verifyEntry) {
+	r.seen++
+	if len(r.entries) < r.size {
+		r.entries = append(r.entries, entry)
+	} else if j := r.rng.Int63n(r.seen); j < int64(r.size) {
+		r.entries[j] = entry
+	}
+}
+
+// inBatches calls fn with consecutive groups of at most size entries
+func inBatches(entries []verifyEntry, size int, fn func([]verifyEntry) error) error {
+	for start := 0; start < len(entries); start += size {
+		end := start + size
+		if end > len(entries) {
+			end = len(entries)
+		}
+		if err := fn(entries[start:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newVerifyEntry hashes a document of the file. Documents without _id
+// cannot be looked up and are left out.
+func newVerifyEntry(doc bson.D) (verifyEntry, bool, error) {
+	id, ok := lookupField(doc, "_id")
+	if !ok {
+		return verifyEntry{}, false, nil
+	}
+	key, err := valueKey(id)
+	if err != nil {
+		return verifyEntry{}, false, fmt.Errorf("failed to encode _id: %w", err)
+	}
+	hash, err := CanonicalHash(doc)
+	if err != nil {
+		return verifyEntry{}, false, fmt.Errorf("failed to hash document %v: %w", id, err)
+	}
+	return verifyEntry{id: id, key: key, hash: hash}, true, nil
+}
+
+// compareEntries fetches the documents of a group of entries and compares
+// their hashes
+func compareEntries(ctx context.Context, coll *mongo.Collection, entries []verifyEntry, logger *utils.Logger, result *VerifyResult) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	ids := make(bson.A, len(entries))
+	for i, entry := range entries {
+		ids[i] = entry.id
+	}
+
+	cursor, err := coll.Find(ctx, bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: ids}}}})
+	if err != nil {
+		return fmt.Errorf("failed to look up documents: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	found := make(map[string][32]byte, len(entries))
+	for cursor.Next(ctx) {
+		var doc bson.D
+		if err := cursor.Decode(&doc); err != nil {
+			return fmt.Errorf("failed to decode document: %w", err)
+		}
+		entry, ok, err := newVerifyEntry(doc)
+		if err != nil {
+			return err
+		}
+		if ok {
+			found[entry.key] = entry.hash
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return fmt.Errorf("failed to look up documents: %w", err)
+	}
+	classifyEntries(entries, found, logger, result)
+	return nil
+}
+
+// classifyEntries counts each entry as matched, mismatched or missing
+// according to the hashes found in the collection, keyed by _id
+func classifyEntries(entries []verifyEntry, found map[string][32]byte, logger *utils.Logger, result *VerifyResult) {
+	for _, entry := range entries {
+		result.Checked++
+		hash, ok := found[entry.key]
+		switch {
+		case !ok:
+			result.Missing++
+			if result.Missing+result.Mismatched <= maxReportedDifferences {
+				logger.Warn("Document missing from the collection", "_id", entry.id)
+			}
+		case hash != entry.hash:
+			result.Mismatched++
+			if result.Missing+result.Mismatched <= maxReportedDifferences {
+				logger.Warn("Document differs from the file", "_id", entry.id)
+			}
+		default:
+			result.Matched++
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package db
+
+import (
+	"errors"
+	"math/rand"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/sfi2k7/mc/internal/utils"
+)
+
+func hash(t *testing.T, doc bson.D) [32]byte {
+	t.Helper()
+	h, err := CanonicalHash(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestCanonicalHash(t *testing.T) {
+	base := bson.D{
+		{Key: "_id", Value: int32(1)},
+		{Key: "name", Value: "a"},
+		{Key: "address", Value: bson.D{{Key: "city", Value: "Oslo"}, {Key: "zip", Value: "0150"}}},
+		{Key: "tags", Value: bson.A{bson.D{{Key: "k", Value: "x"}, {Key: "v", Value: int32(1)}}, "y"}},
+	}
+	tests := []struct {
+		name  string
+		doc   bson.D
+		equal bool
+	}{
+		{
+			name: "fields reordered at every level",
+			doc: bson.D{
+				{Key: "tags", Value: bson.A{bson.D{{Key: "v", Value: int32(1)}, {Key: "k", Value: "x"}}, "y"}},
+				{Key: "address", Value: bson.D{{Key: "zip", Value: "0150"}, {Key: "city", Value: "Oslo"}}},
+				{Key: "name", Value: "a"},
+				{Key: "_id", Value: int32(1)},
+			},
+			equal: true,
+		},
+		{
+			name: "number widened to int64",
+			doc: bson.D{
+				{Key: "_id", Value: int64(1)},
+				{Key: "name", Value: "a"},
+				{Key: "address", Value: bson.D{{Key: "city", Value: "Oslo"}, {Key: "zip", Value: "0150"}}},
+				{Key: "tags", Value: bson.A{bson.D{{Key: "k", Value: "x"}, {Key: "v", Value: int32(1)}}, "y"}},
+			},
+		},
+		{
+			name: "number widened to double in an array",
+			doc: bson.D{
+				{Key: "_id", Value: int32(1)},
+				{Key: "name", Value: "a"},
+				{Key: "address", Value: bson.D{{Key: "city", Value: "Oslo"}, {Key: "zip", Value: "0150"}}},
+				{Key: "tags", Value: bson.A{bson.D{{Key: "k", Value: "x"}, {Key: "v", Value: 1.0}}, "y"}},
+			},
+		},
+		{
+			name: "nested value changed",
+			doc: bson.D{
+				{Key: "_id", Value: int32(1)},
+				{Key: "name", Value: "a"},
+				{Key: "address", Value: bson.D{{Key: "city", Value: "Bergen"}, {Key: "zip", Value: "0150"}}},
+				{Key: "tags", Value: bson.A{bson.D{{Key: "k", Value: "x"}, {Key: "v", Value: int32(1)}}, "y"}},
+			},
+		},
+		{
+			name: "array reordered",
+			doc: bson.D{
+				{Key: "_id", Value: int32(1)},
+				{Key: "name", Value: "a"},
+				{Key: "address", Value: bson.D{{Key: "city", Value: "Oslo"}, {Key: "zip", Value: "0150"}}},
+				{Key: "tags", Value: bson.A{"y", bson.D{{Key: "k", Value: "x"}, {Key: "v", Value: int32(1)}}}},
+			},
+		},
+	}
+	want := hash(t, base)
+	for _, tt := range tests {
+		if got := hash(t, tt.doc) == want; got != tt.equal {
+			t.Errorf("%s: hashes equal = %v, want %v", tt.name, got, tt.equal)
+		}
+	}
+	if base[0].Key != "_id" || base[2].Value.(bson.D)[0].Key != "city" {
+		t.Error("CanonicalHash reordered the fields of its argument")
+	}
+}
+
+func TestClassifyEntries(t *testing.T) {
+	entry := func(id int32, name string) verifyEntry {
+		e, ok, err := newVerifyEntry(bson.D{{Key: "_id", Value: id}, {Key: "name", Value: name}})
+		if err != nil || !ok {
+			t.Fatalf("newVerifyEntry: %v %v", ok, err)
+		}
+		return e
+	}
+	entries := []verifyEntry{entry(1, "a"), entry(2, "b"), entry(3, "c"), entry(4, "d")}
+	// In the collection, 2 was changed and 4 is gone
+	found := map[string][32]byte{}
+	for _, e := range []verifyEntry{entry(1, "a"), entry(2, "changed"), entry(3, "c")} {
+		found[e.key] = e.hash
+	}
+	// The key includes the type, so an int64 _id does not stand in for 3
+	wide, _, _ := newVerifyEntry(bson.D{{Key: "_id", Value: int64(5)}, {Key: "name", Value: "e"}})
+	found[wide.key] = wide.hash
+	entries = append(entries, entry(5, "e"))
+
+	var result VerifyResult
+	classifyEntries(entries, found, utils.NewLogger(), &result)
+	want := VerifyResult{Checked: 5, Matched: 2, Mismatched: 1, Missing: 2}
+	if result != want {
+		t.Errorf("classifyEntries = %+v, want %+v", result, want)
+	}
+}
+
+func TestReservoirSampleIsUniform(t *testing.T) {
+	const size, population, trials = 5, 20, 20000
+	r := rand.New(rand.NewSource(1))
+	counts := make([]int, population)
+	for i := 0; i < trials; i++ {
+		sample := newReservoir(size, r)
+		for id := 0; id < population; id++ {
+			sample.add(verifyEntry{id: id})
+		}
+		if len(sample.entries) != size {
+			t.Fatalf("sample has %d entries, want %d", len(sample.entries), size)
+		}
+		seen := map[int]bool{}
+		for _, e := range sample.entries {
+			id := e.id.(int)
+			if seen[id] {
+				t.Fatalf("entry %d sampled twice", id)
+			}
+			seen[id] = true
+			counts[id]++
+		}
+	}
+	// Every entry should be kept in size/population of the trials
+	expected := float64(trials) * size / population
+	for id, n := range counts {
+		if float64(n) < expected*0.9 || float64(n) > expected*1.1 {
+			t.Errorf("entry %d sampled %d times, want about %.0f", id, n, expected)
+		}
+	}
+
+	small := newReservoir(size, r)
+	for id := 0; id < 3; id++ {
+		small.add(verifyEntry{id: id})
+	}
+	if len(small.entries) != 3 {
+		t.Errorf("sample of 3 entries has %d, want all of them", len(small.entries))
+	}
+}
+
+func TestInBatches(t *testing.T) {
+	entries := make([]verifyEntry, 7)
+	for i := range entries {
+		entries[i].id = i
+	}
+	var sizes []int
+	next := 0
+	err := inBatches(entries, 3, func(batch []verifyEntry) error {
+		sizes = append(sizes, len(batch))
+		for _, e := range batch {
+			if e.id != next {
+				t.Errorf("got entry %v, want %d", e.id, next)
+			}
+			next++
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sizes) != 3 || sizes[0] != 3 || sizes[1] != 3 || sizes[2] != 1 {
+		t.Errorf("batch sizes %v, want [3 3 1]", sizes)
+	}
+
+	calls := 0
+	stop := errors.New("stop")
+	if err := inBatches(entries, 3, func([]verifyEntry) error { calls++; return stop }); err != stop || calls != 1 {
+		t.Errorf("inBatches returned %v after %d calls, want stop after 1", err, calls)
+	}
+	if err := inBatches(nil, 3, func([]verifyEntry) error { calls++; return nil }); err != nil || calls != 1 {
+		t.Error("inBatches called fn for no entries")
+	}
+}
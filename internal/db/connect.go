@@ -3,26 +3,92 @@ package db
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strings"
+	"time"
 
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
 )
 
+// Wire protocol compressors supported by the driver
+const (
+	NetworkSnappy = "snappy"
+	NetworkZstd   = "zstd"
+	NetworkZlib   = "zlib"
+)
+
+// ValidNetworkCompressor reports whether s is a wire protocol compressor
+// the driver supports
+func ValidNetworkCompressor(s string) bool {
+	return s == NetworkSnappy || s == NetworkZstd || s == NetworkZlib
+}
+
+// ConnectOptions holds the settings used to connect to MongoDB
+type ConnectOptions struct {
+	URI      string
+	Host     string
+	Port     int
+	Username string
+	Password string
+	// AppName identifies the client in server logs and currentOp. An
+	// appName set in the URI takes precedence.
+	AppName string
+	// Connection pool bounds; the pool should be at least as large as
+	// the number of concurrent workers
+	MaxPoolSize uint64
+	MinPoolSize uint64
+	// ServerSelectionTimeout bounds how long to wait for a usable server
+	ServerSelectionTimeout time.Duration
+	// Compressors are the wire protocol compressors to offer, in order of
+	// preference; the server uses the first one it also supports, or none.
+	// Empty keeps the compressors of the URI.
+	Compressors []string
+}
+
 // Connect establishes a connection to MongoDB
-func Connect(ctx context.Context, uri, host string, port int) (*mongo.Client, error) {
+func Connect(ctx context.Context, opts ConnectOptions) (*mongo.Client, error) {
 	var clientOptions *options.ClientOptions
 
-	if uri != "" {
-		clientOptions = options.Client().ApplyURI(uri)
+	if opts.URI != "" {
+		clientOptions = options.Client().ApplyURI(opts.URI)
 	} else {
-		mongoURI := fmt.Sprintf("mongodb://%s:%d", host, port)
+		mongoURI := fmt.Sprintf("mongodb://%s:%d", opts.Host, opts.Port)
 		clientOptions = options.Client().ApplyURI(mongoURI)
 	}
 
-	// Set some reasonable defaults
-	clientOptions.SetMaxPoolSize(10)
-	clientOptions.SetMinPoolSize(1)
+	// Explicit credentials take precedence over any in the URI
+	if opts.Username != "" || opts.Password != "" {
+		var credential options.Credential
+		if clientOptions.Auth != nil {
+			credential = *clientOptions.Auth
+		}
+		if opts.Username != "" {
+			credential.Username = opts.Username
+		}
+		if opts.Password != "" {
+			credential.Password = opts.Password
+			credential.PasswordSet = true
+		}
+		clientOptions.SetAuth(credential)
+	}
+
+	if opts.AppName != "" && clientOptions.AppName == nil {
+		clientOptions.SetAppName(opts.AppName)
+	}
+
+	clientOptions.SetMaxPoolSize(opts.MaxPoolSize)
+	clientOptions.SetMinPoolSize(opts.MinPoolSize)
+	if opts.ServerSelectionTimeout > 0 {
+		clientOptions.SetServerSelectionTimeout(opts.ServerSelectionTimeout)
+	}
+
+	if len(opts.Compressors) > 0 {
+		clientOptions.SetCompressors(opts.Compressors)
+	}
 
 	client, err := mongo.Connect(ctx, clientOptions)
 	if err != nil {
@@ -31,13 +97,101 @@ func Connect(ctx context.Context, uri, host string, port int) (*mongo.Client, er
 
 	// Ping the server to verify connection
 	if err := client.Ping(ctx, nil); err != nil {
+		client.Disconnect(ctx)
+
+		var selectionErr topology.ServerSelectionError
+		if errors.As(err, &selectionErr) {
+			return nil, fmt.Errorf("could not reach server %s within %s (check --host/--port/--uri or raise --server-selection-timeout): %w",
+				serverAddress(opts), selectionTimeout(clientOptions), err)
+		}
 		return nil, err
 	}
 
 	return client, nil
 }
 
+// defaultSelectionTimeout is the driver's server selection timeout, used
+// when neither the options nor the URI set one
+const defaultSelectionTimeout = 30 * time.Second
+
+// selectionTimeout returns the server selection timeout a client uses
+func selectionTimeout(clientOptions *options.ClientOptions) time.Duration {
+	if clientOptions.ServerSelectionTimeout != nil {
+		return *clientOptions.ServerSelectionTimeout
+	}
+	return defaultSelectionTimeout
+}
+
+// Validate checks the options for mistakes that would otherwise only show up
+// as a confusing driver error
+func (o ConnectOptions) Validate() error {
+	if o.URI != "" {
+		if !strings.HasPrefix(o.URI, "mongodb://") && !strings.HasPrefix(o.URI, "mongodb+srv://") {
+			return fmt.Errorf("--uri must start with mongodb:// or mongodb+srv://")
+		}
+	} else if o.Port < 1 || o.Port > 65535 {
+		return fmt.Errorf("--port must be between 1 and 65535, got %d", o.Port)
+	}
+
+	for _, compressor := range o.Compressors {
+		if !ValidNetworkCompressor(compressor) {
+			return fmt.Errorf("invalid --network-compression %q (expected snappy, zstd or zlib)", compressor)
+		}
+	}
+
+	if o.Password != "" && o.Username == "" && !uriHasUser(o.URI) {
+		return fmt.Errorf("a password was given without a username (set --username or include it in --uri)")
+	}
+	return nil
+}
+
+// uriHasUser reports whether a connection string carries user information
+func uriHasUser(uri string) bool {
+	_, rest, found := strings.Cut(uri, "://")
+	if !found {
+		return false
+	}
+	hosts, _, _ := strings.Cut(rest, "/")
+	return strings.Contains(hosts, "@")
+}
+
+// serverAddress describes the server being connected to for error messages
+func serverAddress(opts ConnectOptions) string {
+	if opts.URI != "" {
+		return "given by --uri"
+	}
+	return fmt.Sprintf("%s:%d", opts.Host, opts.Port)
+}
+
 // DropCollection drops a collection if it exists
 func DropCollection(ctx context.Context, client *mongo.Client, database, collection string) error {
 	return client.Database(database).Collection(collection).Drop(ctx)
 }
+
+// ShardKey returns the shard key fields of a collection, or nil if the
+// collection is not sharded. Deployments without a config database (e.g. a
+// standalone or replica set) are treated as unsharded.
+func ShardKey(ctx context.Context, client *mongo.Client, database, collection string) ([]string, error) {
+	var entry struct {
+		Key     bson.D `bson:"key"`
+		Dropped bool   `bson:"dropped"`
+	}
+
+	filter := bson.D{{Key: "_id", Value: database + "." + collection}}
+	err := client.Database("config").Collection("collections").FindOne(ctx, filter).Decode(&entry)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if entry.Dropped {
+		return nil, nil
+	}
+
+	fields := make([]string, len(entry.Key))
+	for i, elem := range entry.Key {
+		fields[i] = elem.Key
+	}
+	return fields, nil
+}
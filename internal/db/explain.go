@@ -0,0 +1,115 @@
+package db
+
+import (
+	"context"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// collectionScanStage is the plan stage of a full collection scan
+const collectionScanStage = "COLLSCAN"
+
+// PlanStage is one stage of a winning query plan
+type PlanStage struct {
+	Stage     string
+	IndexName string
+	// Depth is the nesting level of the stage, 0 being the root
+	Depth int
+}
+
+// QueryPlan summarizes the winning plan the server chose for a query
+type QueryPlan struct {
+	Namespace string
+	Stages    []PlanStage
+	// Indexes lists the indexes used by the plan, in stage order
+	Indexes []string
+	// CollectionScan reports whether any stage scans the whole collection
+	CollectionScan bool
+}
+
+// ExplainQuery asks the server how it would run the export query, without
+// executing it
+func ExplainQuery(ctx context.Context, client *mongo.Client, database, collection, queryStr string) (QueryPlan, error) {
+	filter, err := parseQuery(queryStr)
+	if err != nil {
+		return QueryPlan{}, err
+	}
+
+	cmd := bson.D{
+		{Key: "explain", Value: bson.D{
+			{Key: "find", Value: collection},
+			{Key: "filter", Value: filter},
+		}},
+		{Key: "verbosity", Value: "queryPlanner"},
+	}
+	result, err := client.Database(database).RunCommand(ctx, cmd).DecodeBytes()
+	if err != nil {
+		return QueryPlan{}, fmt.Errorf("explain failed: %w", err)
+	}
+
+	planner, ok := result.Lookup("queryPlanner").DocumentOK()
+	if !ok {
+		return QueryPlan{}, fmt.Errorf("explain output has no queryPlanner section")
+	}
+
+	var plan QueryPlan
+	plan.Namespace, _ = planner.Lookup("namespace").StringValueOK()
+	if winning, ok := planner.Lookup("winningPlan").DocumentOK(); ok {
+		plan.addStages(winning, 0)
+	}
+	return plan, nil
+}
+
+// addStages walks a plan stage and its inputs depth first
+func (p *QueryPlan) addStages(stage bson.Raw, depth int) {
+	// Servers using the slot-based engine nest the classic plan under queryPlan
+	if inner, ok := stage.Lookup("queryPlan").DocumentOK(); ok {
+		stage = inner
+	}
+
+	name, _ := stage.Lookup("stage").StringValueOK()
+	indexName, _ := stage.Lookup("indexName").StringValueOK()
+	if name != "" {
+		p.Stages = append(p.Stages, PlanStage{Stage: name, IndexName: indexName, Depth: depth})
+		depth++
+	}
+	if name == collectionScanStage {
+		p.CollectionScan = true
+	}
+	if indexName != "" {
+		p.Indexes = append(p.Indexes, indexName)
+	}
+
+	if input, ok := stage.Lookup("inputStage").DocumentOK(); ok {
+		p.addStages(input, depth)
+	}
+	if inputs, ok := stage.Lookup("inputStages").ArrayOK(); ok {
+		p.addStageArray(inputs, "", depth)
+	}
+	// Sharded clusters report one winning plan per shard
+	if shards, ok := stage.Lookup("shards").ArrayOK(); ok {
+		p.addStageArray(shards, "winningPlan", depth)
+	}
+}
+
+// addStageArray walks each stage in an array, optionally nested under key
+func (p *QueryPlan) addStageArray(array bson.Raw, key string, depth int) {
+	values, err := array.Values()
+	if err != nil {
+		return
+	}
+	for _, value := range values {
+		doc, ok := value.DocumentOK()
+		if !ok {
+			continue
+		}
+		if key != "" {
+			if doc, ok = doc.Lookup(key).DocumentOK(); !ok {
+				continue
+			}
+		}
+		p.addStages(doc, depth)
+	}
+}
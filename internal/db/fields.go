@@ -0,0 +1,59 @@
+package db
+
+import (
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// lookupRawField is lookupField for a document that has not been decoded
+func lookupRawField(doc bson.Raw, path string) (bson.RawValue, bool) {
+	parts := strings.Split(path, ".")
+	current := doc
+	for i, part := range parts {
+		value, err := current.LookupErr(part)
+		if err != nil {
+			return bson.RawValue{}, false
+		}
+		if i == len(parts)-1 {
+			return value, true
+		}
+		nested, ok := value.DocumentOK()
+		if !ok {
+			return bson.RawValue{}, false
+		}
+		current = nested
+	}
+	return bson.RawValue{}, false
+}
+
+// lookupField returns the value at a dotted path in a document
+func lookupField(doc bson.D, path string) (interface{}, bool) {
+	parts := strings.Split(path, ".")
+	current := doc
+	for i, part := range parts {
+		var (
+			value interface{}
+			found bool
+		)
+		for _, elem := range current {
+			if elem.Key == part {
+				value, found = elem.Value, true
+				break
+			}
+		}
+		if !found {
+			return nil, false
+		}
+		if i == len(parts)-1 {
+			return value, true
+		}
+
+		nested, ok := value.(bson.D)
+		if !ok {
+			return nil, false
+		}
+		current = nested
+	}
+	return nil, false
+}
@@ -0,0 +1,66 @@
+package db
+
+import (
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ParseIDBound parses an _id range bound given on the command line. A
+// 24-digit hex string is taken as an ObjectId, and anything else that is a
+// valid extended JSON value as that value, e.g. 42 or {"$oid": "..."}.
+// Other input is taken as a plain string.
+func ParseIDBound(s string) (interface{}, error) {
+	if s == "" {
+		return nil, fmt.Errorf("empty _id bound")
+	}
+	if oid, err := primitive.ObjectIDFromHex(s); err == nil {
+		return oid, nil
+	}
+	var wrapper bson.D
+	if err := bson.UnmarshalExtJSON([]byte(`{"v":`+s+`}`), true, &wrapper); err == nil && len(wrapper) == 1 {
+		return wrapper[0].Value, nil
+	}
+	return s, nil
+}
+
+// inIDRange reports whether the _id of a document lies within [min, max).
+// A nil bound leaves that side open. Ids of different types are ordered by
+// type first, as compareValues does, and documents without _id are outside
+// any bounded range.
+func inIDRange(doc bson.D, min, max interface{}) bool {
+	if min == nil && max == nil {
+		return true
+	}
+	id, ok := lookupField(doc, "_id")
+	if !ok {
+		return false
+	}
+	if min != nil && compareValues(id, min) < 0 {
+		return false
+	}
+	if max != nil && compareValues(id, max) >= 0 {
+		return false
+	}
+	return true
+}
+
+// MatchID reports whether the _id of a document equals id. Numbers match
+// across numeric types, as in a query; other values must have the same type.
+func MatchID(doc bson.D, id interface{}) bool {
+	value, ok := lookupField(doc, "_id")
+	if !ok {
+		return false
+	}
+	if x, ok := numericValue(value); ok {
+		y, ok := numericValue(id)
+		return ok && x == y
+	}
+	a, err := valueKey(value)
+	if err != nil {
+		return false
+	}
+	b, err := valueKey(id)
+	return err == nil && a == b
+}
@@ -3,94 +3,535 @@ package db
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"runtime"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 
 	"github.com/sfi2k7/mc/internal/storage"
+	"github.com/sfi2k7/mc/internal/transform"
 	"github.com/sfi2k7/mc/internal/utils"
 )
 
+// duplicateKeyCode is the server error code for a unique index violation
+const duplicateKeyCode = 11000
+
+// ErrMaxDocuments indicates an import stopped because the next batch would
+// take it past ImportOptions.MaxDocuments
+var ErrMaxDocuments = errors.New("document limit reached")
+
+// ExportOptions controls how documents are read from a collection
+type ExportOptions struct {
+	Query     string
+	BatchSize int
+	Transform *transform.Transformer
+	// CountTimeout bounds the document count used for progress. When it
+	// expires the export continues without a known total.
+	CountTimeout time.Duration
+	// CountThreshold skips the exact count of a filtered export when the
+	// collection is estimated to hold more documents than this, leaving
+	// the progress total unknown; 0 always counts
+	CountThreshold int64
+	// StructureOnly skips the documents; only the header is written
+	StructureOnly bool
+	// SkipUnmarshalable logs and skips documents that fail to marshal
+	// instead of failing the export
+	SkipUnmarshalable bool
+	// ParallelScan splits the _id space into this many ranges scanned
+	// concurrently; 0 or 1 scans sequentially
+	ParallelScan int
+	// QueueDepth is the number of batches buffered between the parallel
+	// scanners and the writer; 0 buffers one batch per range. A full queue
+	// blocks the scanners, so a slow writer bounds memory instead of
+	// letting batches pile up.
+	QueueDepth int
+	// Natural returns documents in storage order ({$natural: 1}), which
+	// forces a collection scan and avoids index traversal
+	Natural bool
+	// ProgressBytes counts progress in bytes of source documents instead of
+	// documents. The total is only known for unfiltered exports.
+	ProgressBytes bool
+	// RemapIDs replaces _id and reference fields before writing
+	RemapIDs *IDRemapper
+	// SortField sorts each batch by this field before it is written, which
+	// clusters similar documents for the compressor. Only the order within
+	// a batch changes.
+	SortField string
+	// MaxField, when set, records the largest value of this field (a
+	// dotted path) among the exported documents in ExportResult.MaxValue
+	MaxField string
+	Logger   *utils.Logger
+}
+
+// passThrough reports whether documents can be written exactly as the
+// server returned them, skipping the decode into bson.D and the marshal
+// back, because nothing rewrites them
+func (o ExportOptions) passThrough() bool {
+	return o.Transform == nil && o.RemapIDs == nil && o.SortField == ""
+}
+
+// exportBatch is a batch of documents on its way from a cursor to the
+// writer. Pass-through exports fill raw with copies of the server's bytes
+// and leave docs nil.
+type exportBatch struct {
+	docs []bson.D
+	raw  [][]byte
+}
+
+// len returns the number of documents in the batch
+func (b exportBatch) len() int {
+	if b.raw != nil {
+		return len(b.raw)
+	}
+	return len(b.docs)
+}
+
+// BatchWriter receives the batches of an export
+type BatchWriter interface {
+	WriteBatch(batch []bson.D) error
+	WriteRawBatch(batch [][]byte) error
+}
+
+// ExportResult summarizes an export
+type ExportResult struct {
+	Exported int64
+	// Skipped counts documents left out because they failed to marshal
+	Skipped int64
+	// MaxValue is the largest value of ExportOptions.MaxField among the
+	// exported documents, nil when none had the field
+	MaxValue interface{}
+}
+
+// ImportOptions controls how documents are written to a collection
+type ImportOptions struct {
+	BatchSize int
+	Transform *transform.Transformer
+	// ShardKey lists the fields every document must contain when the
+	// target collection is sharded
+	ShardKey []string
+	// SanitizeKeys rewrites field names with dots or a leading $ using the
+	// given strategy; empty leaves keys untouched
+	SanitizeKeys string
+	// ValidateBSON is the validation level applied to each document before
+	// insert; empty skips validation like ValidateOff
+	ValidateBSON string
+	// ContinueOnError inserts unordered and keeps going past write errors
+	ContinueOnError bool
+	// DupReport receives the _id of every document rejected as a duplicate
+	// key, one extended JSON document per line
+	DupReport io.Writer
+	// Collection holds the options used to create the target collection
+	// when it does not exist
+	Collection CollectionOptions
+	// StructureOnly creates the collection and Indexes without reading any
+	// documents
+	StructureOnly bool
+	Indexes       []bson.D
+	// BuildIndexes creates Indexes once all documents are inserted, which
+	// is faster than maintaining them during the load
+	BuildIndexes bool
+	// SkipDocuments passes over this many documents at the start of the
+	// file, which an earlier run already imported
+	SkipDocuments int64
+	// ResumeOverlap is the number of documents after SkipDocuments that
+	// the earlier run may have inserted without recording them. They are
+	// inserted unordered, and duplicate key errors among them count as
+	// skipped.
+	ResumeOverlap int64
+	// Checkpoint is called after each committed batch with the number of
+	// documents from the start of the file that have been processed
+	Checkpoint func(processed int64) error
+	// ProgressBytes counts progress in bytes of documents read from the
+	// file instead of documents
+	ProgressBytes bool
+	// ProgressFile counts progress in bytes of the compressed file
+	// consumed; it takes precedence over ProgressBytes
+	ProgressFile bool
+	// OplogMode replays the file as oplog entries instead of inserting
+	// documents, handling entries for missing documents by this policy
+	OplogMode string
+	// IDMin and IDMax restrict the import to documents whose _id lies in
+	// [IDMin, IDMax); nil leaves that side open
+	IDMin interface{}
+	IDMax interface{}
+	// PauseEvery sleeps for PauseDuration after every PauseEvery committed
+	// batches, giving the server time to flush and replicate; 0 disables it
+	PauseEvery    int
+	PauseDuration time.Duration
+	// MaxDocuments stops the import before a batch that would take the
+	// documents inserted (or oplog entries applied) past it; 0 for no limit
+	MaxDocuments int64
+	Logger       *utils.Logger
+}
+
+// passThrough reports whether documents can be inserted as read from the
+// file, without decoding them, because nothing rewrites or filters them
+func (o ImportOptions) passThrough() bool {
+	return o.Transform == nil && o.SanitizeKeys == "" && o.IDMin == nil && o.IDMax == nil && o.OplogMode == ""
+}
+
+// ImportResult summarizes an import
+type ImportResult struct {
+	Inserted   int64
+	Failed     int64
+	Duplicates int64
+	// Sanitized counts documents whose field names were rewritten
+	Sanitized int64
+	// Skipped counts documents passed over because of SkipDocuments, and
+	// documents of the resume overlap that already existed
+	Skipped int64
+	// Rejected counts documents left out by strict BSON validation
+	Rejected int64
+	// Invalid counts documents that failed relaxed BSON validation but
+	// were inserted anyway
+	Invalid int64
+	// Updated and Deleted count replayed oplog updates and deletes
+	Updated int64
+	Deleted int64
+	// Missing counts replayed oplog entries whose document did not exist;
+	// they were skipped, or created with OplogUpsert
+	Missing int64
+	// OutOfRange counts documents left out by IDMin and IDMax
+	OutOfRange int64
+}
+
 // ExportCollection exports documents from a collection to a file
 func ExportCollection(
 	ctx context.Context,
 	client *mongo.Client,
-	database, collection, queryStr string,
-	batchSize int,
-	writer *storage.FileWriter,
+	database, collection string,
+	opts ExportOptions,
+	writer BatchWriter,
 	progress *utils.ProgressBar,
-) (int64, error) {
+) (ExportResult, error) {
+	if opts.StructureOnly {
+		return ExportResult{}, nil
+	}
+
 	// Parse query
-	var filter bson.M
-	if err := bson.UnmarshalExtJSON([]byte(queryStr), true, &filter); err != nil {
-		return 0, fmt.Errorf("invalid query: %w", err)
+	filter, err := parseQuery(opts.Query)
+	if err != nil {
+		return ExportResult{}, err
 	}
 
 	coll := client.Database(database).Collection(collection)
 
-	// Get total count for progress bar
-	count, err := coll.CountDocuments(ctx, filter)
-	if err != nil {
-		return 0, fmt.Errorf("failed to count documents: %w", err)
+	if opts.ProgressBytes {
+		if len(filter) == 0 {
+			if size, err := CollectionDataSize(ctx, client, database, collection); err == nil {
+				progress.SetTotal(size)
+			}
+		}
+	} else if err := countForProgress(ctx, coll, filter, opts, progress); err != nil {
+		return ExportResult{}, err
+	}
+
+	var result ExportResult
+	if opts.ParallelScan > 1 {
+		err = exportParallel(ctx, coll, filter, opts, writer, progress, &result)
+	} else {
+		err = scanRange(ctx, coll, filter, opts, progress, func(batch exportBatch) error {
+			if err := processBatch(batch, writer, opts, progress, &result); err != nil {
+				return err
+			}
+
+			// Hint garbage collector after processing large batch
+			runtime.GC()
+			return nil
+		})
+	}
+	if err != nil && mongo.IsTimeout(err) {
+		return result, fmt.Errorf("%w (%d documents exported)", err, result.Exported)
+	}
+	return result, err
+}
+
+// countForProgress sets the progress total to the number of documents
+// matching the filter. Without a filter the collection metadata estimate
+// is used, which is instant; with one the documents are counted, unless the
+// estimate exceeds CountThreshold and counting would take too long.
+func countForProgress(ctx context.Context, coll *mongo.Collection, filter bson.M, opts ExportOptions, progress *utils.ProgressBar) error {
+	estimate, estimateErr := coll.EstimatedDocumentCount(ctx)
+	if estimateErr == nil {
+		if len(filter) == 0 {
+			opts.Logger.Info("Using the estimated document count for progress", "count", estimate)
+			progress.SetTotal(estimate)
+			return nil
+		}
+		if opts.CountThreshold > 0 && estimate > opts.CountThreshold {
+			opts.Logger.Info("Collection is too large to count matching documents, progress total is unknown",
+				"estimate", estimate, "count_threshold", opts.CountThreshold)
+			return nil
+		}
 	}
-	progress.SetTotal(count)
+
+	countOptions := options.Count()
+	if opts.CountTimeout > 0 {
+		countOptions.SetMaxTime(opts.CountTimeout)
+	}
+	count, err := coll.CountDocuments(ctx, filter, countOptions)
+	switch {
+	case err == nil:
+		opts.Logger.Info("Counted matching documents for progress", "count", count)
+		progress.SetTotal(count)
+	case opts.CountTimeout > 0 && mongo.IsTimeout(err):
+		opts.Logger.Warn("Document count timed out, progress total is unknown", "count_timeout", opts.CountTimeout)
+	case mongo.IsTimeout(err):
+		return fmt.Errorf("timed out counting documents (use --count-timeout to bound the count): %w", err)
+	default:
+		return fmt.Errorf("failed to count documents: %w", err)
+	}
+	return nil
+}
+
+// scanRange runs a find with the given filter and passes full batches of
+// (transformed) documents to emit
+func scanRange(
+	ctx context.Context,
+	coll *mongo.Collection,
+	filter interface{},
+	opts ExportOptions,
+	progress *utils.ProgressBar,
+	emit func(batch exportBatch) error,
+) error {
+	batchSize := opts.BatchSize
+	passThrough := opts.passThrough()
 
 	// Find documents
 	findOptions := options.Find().SetBatchSize(int32(batchSize))
+	if opts.Natural {
+		findOptions.SetSort(bson.D{{Key: "$natural", Value: 1}})
+	}
 	cursor, err := coll.Find(ctx, filter, findOptions)
 	if err != nil {
-		return 0, fmt.Errorf("failed to execute find: %w", err)
+		if mongo.IsTimeout(err) {
+			return fmt.Errorf("timed out starting find: %w", err)
+		}
+		return fmt.Errorf("failed to execute find: %w", err)
 	}
 	defer cursor.Close(ctx)
 
-	var totalExported int64 = 0
-	batch := make([]bson.D, 0, batchSize)
+	var batch exportBatch
+	newBatch := func() {
+		if passThrough {
+			batch = exportBatch{raw: make([][]byte, 0, batchSize)}
+		} else {
+			batch = exportBatch{docs: make([]bson.D, 0, batchSize)}
+		}
+	}
+	newBatch()
 
 	// Process batches
 	for cursor.Next(ctx) {
-		var doc bson.D
-		if err := cursor.Decode(&doc); err != nil {
-			return totalExported, fmt.Errorf("failed to decode document: %w", err)
+		if opts.ProgressBytes {
+			progress.Add(int64(len(cursor.Current)))
 		}
 
-		batch = append(batch, doc)
+		if passThrough {
+			// cursor.Current is reused, so copy the bytes
+			batch.raw = append(batch.raw, append([]byte(nil), cursor.Current...))
+		} else {
+			var doc bson.D
+			if err := cursor.Decode(&doc); err != nil {
+				return fmt.Errorf("failed to decode document: %w", err)
+			}
 
-		if len(batch) >= batchSize {
-			if err := processBatch(batch, writer, progress); err != nil {
-				return totalExported, err
+			if opts.Transform != nil {
+				transformed, keep, err := opts.Transform.Apply(doc)
+				if err != nil {
+					return err
+				}
+				if !keep {
+					if !opts.ProgressBytes {
+						progress.Add(1)
+					}
+					continue
+				}
+				doc = transformed
 			}
-			totalExported += int64(len(batch))
-			batch = make([]bson.D, 0, batchSize)
 
-			// Hint garbage collector after processing large batch
-			runtime.GC()
+			batch.docs = append(batch.docs, doc)
+		}
+
+		if batch.len() >= batchSize {
+			if err := emit(batch); err != nil {
+				return err
+			}
+			newBatch()
 		}
 	}
 
 	// Process remaining documents
-	if len(batch) > 0 {
-		if err := processBatch(batch, writer, progress); err != nil {
-			return totalExported, err
+	if batch.len() > 0 {
+		if err := emit(batch); err != nil {
+			return err
 		}
-		totalExported += int64(len(batch))
 	}
 
 	if err := cursor.Err(); err != nil {
-		return totalExported, fmt.Errorf("cursor error: %w", err)
+		if mongo.IsTimeout(err) {
+			return fmt.Errorf("timed out reading documents: %w", err)
+		}
+		return fmt.Errorf("cursor error: %w", err)
+	}
+	return nil
+}
+
+// parseQuery parses a query filter in extended JSON
+func parseQuery(queryStr string) (bson.M, error) {
+	var filter bson.M
+	if err := bson.UnmarshalExtJSON([]byte(queryStr), true, &filter); err != nil {
+		return nil, fmt.Errorf("invalid query: %w", err)
+	}
+	return filter, nil
+}
+
+// SampleDocuments returns the raw BSON of up to limit documents matching the query
+func SampleDocuments(ctx context.Context, client *mongo.Client, database, collection, queryStr string, limit int) ([][]byte, error) {
+	filter, err := parseQuery(queryStr)
+	if err != nil {
+		return nil, err
 	}
 
-	return totalExported, nil
+	coll := client.Database(database).Collection(collection)
+	cursor, err := coll.Find(ctx, filter, options.Find().SetLimit(int64(limit)))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	samples := make([][]byte, 0, limit)
+	for cursor.Next(ctx) {
+		// cursor.Current is reused, so copy the bytes
+		samples = append(samples, append([]byte(nil), cursor.Current...))
+	}
+	return samples, cursor.Err()
+}
+
+// SampleRandomDocuments returns the raw BSON of up to size documents
+// matching the query, picked at random with $sample. Without a query the
+// server can sample without scanning; with one every matching document is
+// read.
+func SampleRandomDocuments(ctx context.Context, client *mongo.Client, database, collection, queryStr string, size int) ([][]byte, error) {
+	filter, err := parseQuery(queryStr)
+	if err != nil {
+		return nil, err
+	}
+
+	var pipeline mongo.Pipeline
+	if len(filter) > 0 {
+		pipeline = append(pipeline, bson.D{{Key: "$match", Value: filter}})
+	}
+	pipeline = append(pipeline, bson.D{{Key: "$sample", Value: bson.D{{Key: "size", Value: size}}}})
+
+	cursor, err := client.Database(database).Collection(collection).Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	samples := make([][]byte, 0, size)
+	for cursor.Next(ctx) {
+		// cursor.Current is reused, so copy the bytes
+		samples = append(samples, append([]byte(nil), cursor.Current...))
+	}
+	return samples, cursor.Err()
+}
+
+// CountMatching returns the number of documents matching the query. Without
+// a query the collection metadata estimate is returned and estimated is
+// true.
+func CountMatching(ctx context.Context, client *mongo.Client, database, collection, queryStr string) (count int64, estimated bool, err error) {
+	filter, err := parseQuery(queryStr)
+	if err != nil {
+		return 0, false, err
+	}
+	coll := client.Database(database).Collection(collection)
+	if len(filter) == 0 {
+		count, err = coll.EstimatedDocumentCount(ctx)
+		if err != nil {
+			return 0, true, fmt.Errorf("failed to estimate document count: %w", err)
+		}
+		return count, true, nil
+	}
+	count, err = coll.CountDocuments(ctx, filter)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to count documents: %w", err)
+	}
+	return count, false, nil
 }
 
 // processBatch processes a batch of documents for export
-func processBatch(batch []bson.D, writer *storage.FileWriter, progress *utils.ProgressBar) error {
-	if err := writer.WriteBatch(batch); err != nil {
-		return fmt.Errorf("failed to write batch: %w", err)
+func processBatch(b exportBatch, writer BatchWriter, opts ExportOptions, progress *utils.ProgressBar, result *ExportResult) error {
+	if b.raw != nil {
+		if err := writer.WriteRawBatch(b.raw); err != nil {
+			return fmt.Errorf("failed to write batch: %w", err)
+		}
+		trackRawMax(b.raw, opts.MaxField, result)
+		result.Exported += int64(len(b.raw))
+		if !opts.ProgressBytes {
+			progress.Add(int64(len(b.raw)))
+		}
+		return nil
+	}
+
+	batch := b.docs
+	if opts.RemapIDs != nil {
+		for _, doc := range batch {
+			if err := opts.RemapIDs.remap(doc); err != nil {
+				return err
+			}
+		}
+	}
+	if opts.SortField != "" {
+		sortBatch(batch, opts.SortField)
+	}
+
+	if !opts.SkipUnmarshalable {
+		if err := writer.WriteBatch(batch); err != nil {
+			return fmt.Errorf("failed to write batch: %w", err)
+		}
+		if opts.MaxField != "" {
+			for _, doc := range batch {
+				if value, ok := lookupField(doc, opts.MaxField); ok {
+					trackMax(value, result)
+				}
+			}
+		}
+		result.Exported += int64(len(batch))
+		if !opts.ProgressBytes {
+			progress.Add(int64(len(batch)))
+		}
+		return nil
+	}
+
+	raw := make([][]byte, 0, len(batch))
+	for _, doc := range batch {
+		data, err := bson.Marshal(doc)
+		if err != nil {
+			id, _ := lookupField(doc, "_id")
+			opts.Logger.Warn("Skipping document that failed to marshal", "_id", id, "error", err)
+			result.Skipped++
+			continue
+		}
+		raw = append(raw, data)
+	}
+	// Readers treat an empty batch as the end of the data
+	if len(raw) > 0 {
+		if err := writer.WriteRawBatch(raw); err != nil {
+			return fmt.Errorf("failed to write batch: %w", err)
+		}
+		trackRawMax(raw, opts.MaxField, result)
+	}
+	result.Exported += int64(len(raw))
+	if !opts.ProgressBytes {
+		progress.Add(int64(len(batch)))
 	}
-	progress.Add(int64(len(batch)))
 	return nil
 }
 
@@ -99,46 +540,367 @@ func ImportCollection(
 	ctx context.Context,
 	client *mongo.Client,
 	database, collection string,
-	batchSize int,
+	opts ImportOptions,
 	reader *storage.FileReader,
 	progress *utils.ProgressBar,
-) (int64, error) {
+) (ImportResult, error) {
+	if err := ensureCollection(ctx, client, database, collection, opts, opts.StructureOnly); err != nil {
+		return ImportResult{}, err
+	}
+	if opts.StructureOnly {
+		return ImportResult{}, createIndexes(ctx, client, database, collection, opts.Indexes)
+	}
+
 	coll := client.Database(database).Collection(collection)
+	batchSize := opts.BatchSize
+	insertOptions := options.InsertMany().SetOrdered(!opts.ContinueOnError)
+
+	var result ImportResult
+	var processed int64
+	var batches int
+
+	// commitBatch records a batch of n documents as done
+	commitBatch := func(n int) error {
+		if !opts.ProgressBytes && !opts.ProgressFile {
+			progress.Add(int64(n))
+		}
+		processed += int64(n)
+		if opts.Checkpoint != nil {
+			if err := opts.Checkpoint(processed); err != nil {
+				return fmt.Errorf("failed to write checkpoint: %w", err)
+			}
+		}
+		batches++
+		if opts.PauseEvery > 0 && batches%opts.PauseEvery == 0 {
+			select {
+			case <-time.After(opts.PauseDuration):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		return nil
+	}
+
+	// checkLimit stops before applying n more documents would pass
+	// MaxDocuments
+	checkLimit := func(n int) error {
+		applied := result.Inserted + result.Updated + result.Deleted
+		if opts.MaxDocuments > 0 && applied+int64(n) > opts.MaxDocuments {
+			return fmt.Errorf("%w: %d documents applied, the next %d would pass the limit of %d",
+				ErrMaxDocuments, applied, n, opts.MaxDocuments)
+		}
+		return nil
+	}
+
+	// position measures progress through the file in bytes
+	position := reader.BytesRead
+	if opts.ProgressFile {
+		position = reader.Offset
+	}
 
-	var totalImported int64 = 0
+	passThrough := opts.passThrough()
 
 	for {
 		// Read a batch of documents
-		batch, err := reader.ReadBatch(batchSize)
+		bytesBefore := position()
+		var (
+			batch []bson.D
+			raw   []bson.Raw
+			n     int
+			err   error
+		)
+		if passThrough {
+			raw, err = reader.ReadRawBatch(batchSize)
+			n = len(raw)
+		} else {
+			batch, err = reader.ReadBatch(batchSize)
+			n = len(batch)
+		}
 		if err != nil {
-			return totalImported, fmt.Errorf("failed to read batch: %w", err)
+			return result, fmt.Errorf("failed to read batch: %w", err)
+		}
+		if opts.ProgressBytes || opts.ProgressFile {
+			progress.Add(position() - bytesBefore)
 		}
 
 		// Stop when no more documents
-		if len(batch) == 0 {
+		if n == 0 {
 			break
 		}
 
+		// Pass over documents imported by an earlier run
+		if processed < opts.SkipDocuments {
+			skip := opts.SkipDocuments - processed
+			if skip > int64(n) {
+				skip = int64(n)
+			}
+			processed += skip
+			result.Skipped += skip
+			if passThrough {
+				raw = raw[skip:]
+			} else {
+				batch = batch[skip:]
+			}
+			n -= int(skip)
+			if n == 0 {
+				continue
+			}
+		}
+
+		if opts.OplogMode != "" {
+			if err := checkLimit(n); err != nil {
+				return result, err
+			}
+			if err := replayOplog(ctx, coll, batch, opts.OplogMode, &result); err != nil {
+				return result, err
+			}
+			if err := commitBatch(n); err != nil {
+				return result, err
+			}
+			continue
+		}
+
 		// Convert to interface slice for MongoDB
-		docs := make([]interface{}, len(batch))
-		for i, doc := range batch {
-			docs[i] = doc
+		var docs []interface{}
+		if passThrough {
+			docs = prepareRawDocuments(raw, opts, &result)
+		} else if docs, err = prepareDocuments(batch, opts, &result); err != nil {
+			return result, err
+		}
+
+		// Make sure the batch can be routed before inserting any of it
+		if err := checkShardKey(docs, opts.ShardKey, result.Inserted+result.Failed); err != nil {
+			return result, err
+		}
+
+		if err := checkLimit(len(docs)); err != nil {
+			return result, err
 		}
 
 		// Insert documents
-		_, err = coll.InsertMany(ctx, docs)
-		if err != nil {
-			return totalImported, fmt.Errorf("failed to insert batch: %w", err)
+		if len(docs) > 0 && processed < opts.SkipDocuments+opts.ResumeOverlap {
+			if err := insertOverlap(ctx, coll, docs, opts, &result); err != nil {
+				return result, fmt.Errorf("failed to insert batch: %w", err)
+			}
+		} else if len(docs) > 0 {
+			_, err = coll.InsertMany(ctx, docs, insertOptions)
+			if err != nil {
+				var bulkErr mongo.BulkWriteException
+				if !opts.ContinueOnError || !errors.As(err, &bulkErr) || bulkErr.WriteConcernError != nil {
+					return result, fmt.Errorf("failed to insert batch: %w", err)
+				}
+				if err := recordWriteErrors(&result, bulkErr, docs, opts.DupReport); err != nil {
+					return result, err
+				}
+			}
 		}
 
-		totalImported += int64(len(batch))
-		progress.Add(int64(len(batch)))
+		result.Inserted += int64(len(docs))
+		if err := commitBatch(n); err != nil {
+			return result, err
+		}
 
 		// Memory optimization
 		batch = nil
+		raw = nil
 		docs = nil
 		runtime.GC()
 	}
 
-	return totalImported, nil
+	if opts.BuildIndexes && len(opts.Indexes) > 0 {
+		opts.Logger.Info("Building indexes", "indexes", len(opts.Indexes))
+		if err := createIndexes(ctx, client, database, collection, opts.Indexes); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// trackRawMax records the largest value of field among marshaled documents
+// in result.MaxValue
+func trackRawMax(batch [][]byte, field string, result *ExportResult) {
+	if field == "" {
+		return
+	}
+	for _, data := range batch {
+		raw, ok := lookupRawField(data, field)
+		if !ok {
+			continue
+		}
+		var value interface{}
+		if err := raw.Unmarshal(&value); err == nil {
+			trackMax(value, result)
+		}
+	}
+}
+
+// trackMax keeps value in result.MaxValue if it is the largest seen
+func trackMax(value interface{}, result *ExportResult) {
+	if result.MaxValue == nil || compareValues(value, result.MaxValue) > 0 {
+		result.MaxValue = value
+	}
+}
+
+// prepareDocuments applies the id range, transform, key sanitizing and
+// validation to a batch, returning the documents to insert
+func prepareDocuments(batch []bson.D, opts ImportOptions, result *ImportResult) ([]interface{}, error) {
+	docs := make([]interface{}, 0, len(batch))
+	for _, doc := range batch {
+		if !inIDRange(doc, opts.IDMin, opts.IDMax) {
+			result.OutOfRange++
+			continue
+		}
+		if opts.Transform != nil {
+			transformed, keep, err := opts.Transform.Apply(doc)
+			if err != nil {
+				return nil, err
+			}
+			if !keep {
+				continue
+			}
+			doc = transformed
+		}
+		if opts.SanitizeKeys != "" {
+			sanitized, changed, err := sanitizeKeys(doc, opts.SanitizeKeys)
+			if err != nil {
+				return nil, fmt.Errorf("document %d: %w (use --sanitize-keys escape or replace to rewrite it)",
+					result.Inserted+result.Failed+int64(len(docs))+1, err)
+			}
+			if changed {
+				result.Sanitized++
+				doc = sanitized
+			}
+		}
+		if opts.ValidateBSON == ValidateStrict || opts.ValidateBSON == ValidateRelaxed {
+			if err := validateDocument(doc, opts.ValidateBSON == ValidateStrict); err != nil {
+				if opts.ValidateBSON == ValidateRelaxed {
+					result.Invalid++
+				} else {
+					id, _ := lookupField(doc, "_id")
+					opts.Logger.Warn("Rejecting document that failed BSON validation", "_id", id, "error", err)
+					result.Rejected++
+					continue
+				}
+			}
+		}
+		docs = append(docs, doc)
+	}
+	return docs, nil
+}
+
+// prepareRawDocuments validates a batch read without decoding and returns
+// the documents to insert; the driver sends bson.Raw as is
+func prepareRawDocuments(raw []bson.Raw, opts ImportOptions, result *ImportResult) []interface{} {
+	docs := make([]interface{}, 0, len(raw))
+	for _, doc := range raw {
+		if opts.ValidateBSON == ValidateStrict || opts.ValidateBSON == ValidateRelaxed {
+			if err := validateRawDocument(doc, opts.ValidateBSON == ValidateStrict); err != nil {
+				if opts.ValidateBSON == ValidateRelaxed {
+					result.Invalid++
+				} else {
+					id, _ := lookupRawField(doc, "_id")
+					opts.Logger.Warn("Rejecting document that failed BSON validation", "_id", id, "error", err)
+					result.Rejected++
+					continue
+				}
+			}
+		}
+		docs = append(docs, doc)
+	}
+	return docs
+}
+
+// insertOverlap inserts documents that an interrupted earlier run may
+// already have inserted. The insert is unordered so the rest of the batch
+// goes in past the documents that exist, which count as skipped. Other
+// write errors fail the import unless ContinueOnError is set.
+func insertOverlap(ctx context.Context, coll *mongo.Collection, docs []interface{}, opts ImportOptions, result *ImportResult) error {
+	_, err := coll.InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+	var bulkErr mongo.BulkWriteException
+	if err == nil || !errors.As(err, &bulkErr) || bulkErr.WriteConcernError != nil {
+		return err
+	}
+
+	var others []mongo.BulkWriteError
+	for _, writeErr := range bulkErr.WriteErrors {
+		if writeErr.Code == duplicateKeyCode {
+			result.Skipped++
+			result.Inserted--
+		} else {
+			others = append(others, writeErr)
+		}
+	}
+	if len(others) == 0 {
+		return nil
+	}
+	if !opts.ContinueOnError {
+		return err
+	}
+	bulkErr.WriteErrors = others
+	return recordWriteErrors(result, bulkErr, docs, opts.DupReport)
+}
+
+// recordWriteErrors accounts for the documents rejected by an unordered
+// insert and reports duplicate keys
+func recordWriteErrors(result *ImportResult, bulkErr mongo.BulkWriteException, docs []interface{}, dupReport io.Writer) error {
+	for _, writeErr := range bulkErr.WriteErrors {
+		result.Failed++
+		result.Inserted--
+
+		if writeErr.Code != duplicateKeyCode {
+			continue
+		}
+		result.Duplicates++
+
+		if dupReport == nil || writeErr.Index < 0 || writeErr.Index >= len(docs) {
+			continue
+		}
+		id, _ := documentID(docs[writeErr.Index])
+		line, err := bson.MarshalExtJSON(bson.D{{Key: "_id", Value: id}}, true, false)
+		if err != nil {
+			return fmt.Errorf("failed to encode duplicate _id: %w", err)
+		}
+		if _, err := fmt.Fprintf(dupReport, "%s\n", line); err != nil {
+			return fmt.Errorf("failed to write duplicate report: %w", err)
+		}
+	}
+	return nil
+}
+
+// documentID returns the _id of a document to insert, decoded or raw
+func documentID(doc interface{}) (interface{}, bool) {
+	if raw, ok := doc.(bson.Raw); ok {
+		id, found := lookupRawField(raw, "_id")
+		return id, found
+	}
+	return lookupField(doc.(bson.D), "_id")
+}
+
+// hasField reports whether a document to insert, decoded or raw, has a
+// value at path
+func hasField(doc interface{}, path string) bool {
+	if raw, ok := doc.(bson.Raw); ok {
+		_, found := lookupRawField(raw, path)
+		return found
+	}
+	_, found := lookupField(doc.(bson.D), path)
+	return found
+}
+
+// checkShardKey verifies that every document contains the shard key fields
+func checkShardKey(docs []interface{}, shardKey []string, offset int64) error {
+	if len(shardKey) == 0 {
+		return nil
+	}
+
+	for i, doc := range docs {
+		for _, field := range shardKey {
+			if !hasField(doc, field) {
+				return fmt.Errorf("document %d is missing shard key field %q; "+
+					"the target collection is sharded on %v, so every document must contain these fields "+
+					"(use --ignore-shard-check to insert anyway)", offset+int64(i)+1, field, shardKey)
+			}
+		}
+	}
+	return nil
 }
@@ -0,0 +1,162 @@
+package db
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/sfi2k7/mc/internal/storage"
+	"github.com/sfi2k7/mc/internal/utils"
+)
+
+// benchBatch returns a batch of n marshaled documents shaped like a
+// typical collection, as a cursor would return them
+func benchBatch(b *testing.B, n int) ([][]byte, int64) {
+	b.Helper()
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	batch := make([][]byte, n)
+	var size int64
+	for i := range batch {
+		data, err := bson.Marshal(bson.D{
+			{Key: "_id", Value: primitive.NewObjectIDFromTimestamp(base.Add(time.Duration(i) * time.Second))},
+			{Key: "user", Value: fmt.Sprintf("user_%05d", i%50000)},
+			{Key: "tags", Value: bson.A{"a", "b", int32(i)}},
+			{Key: "address", Value: bson.D{{Key: "city", Value: "Oslo"}, {Key: "zip", Value: fmt.Sprintf("%04d", i%10000)}}},
+			{Key: "createdAt", Value: primitive.NewDateTimeFromTime(base.Add(time.Duration(i) * time.Minute))},
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+		batch[i] = data
+		size += int64(len(data))
+	}
+	return batch, size
+}
+
+// BenchmarkExportBatch compares writing a batch as the cursor returned it
+// with decoding it into bson.D, as exports that rewrite documents must, and
+// having the writer marshal it again
+func BenchmarkExportBatch(b *testing.B) {
+	batch, size := benchBatch(b, 1000)
+	for _, raw := range []bool{true, false} {
+		name := "raw"
+		if !raw {
+			name = "decoded"
+		}
+		b.Run(name, func(b *testing.B) {
+			writer, err := storage.NewFileWriter(filepath.Join(b.TempDir(), "bench"+storage.FileExtension), storage.CompressionOptions{Level: 1})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer writer.Close()
+			if err := writer.WriteHeader(storage.Metadata{Database: "db", Collection: "bench"}); err != nil {
+				b.Fatal(err)
+			}
+			opts := ExportOptions{ProgressBytes: true}
+			progress := utils.NewProgressBar("bench")
+			var result ExportResult
+
+			b.SetBytes(size)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				var next exportBatch
+				if raw {
+					next.raw = make([][]byte, len(batch))
+					for j, data := range batch {
+						next.raw[j] = append([]byte(nil), data...)
+					}
+				} else {
+					next.docs = make([]bson.D, len(batch))
+					for j, data := range batch {
+						if err := bson.Unmarshal(data, &next.docs[j]); err != nil {
+							b.Fatal(err)
+						}
+					}
+				}
+				if err := processBatch(next, writer, opts, progress, &result); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkImportBatches compares reading documents as stored and handing
+// them to the driver as bson.Raw with decoding them into bson.D first. The
+// driver's marshaling of each document is included.
+func BenchmarkImportBatches(b *testing.B) {
+	batch, size := benchBatch(b, 1000)
+	const batches = 20
+	path := filepath.Join(b.TempDir(), "bench"+storage.FileExtension)
+	writer, err := storage.NewFileWriter(path, storage.CompressionOptions{Level: 1})
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := writer.WriteHeader(storage.Metadata{Database: "db", Collection: "bench"}); err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < batches; i++ {
+		if err := writer.WriteRawBatch(batch); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := writer.WriteFooter(storage.Metadata{DocumentCount: batches * int64(len(batch))}); err != nil {
+		b.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, raw := range []bool{true, false} {
+		name := "raw"
+		if !raw {
+			name = "decoded"
+		}
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(size * batches)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				reader, err := storage.NewFileReader(path)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := reader.ReadHeader(); err != nil {
+					b.Fatal(err)
+				}
+				var result ImportResult
+				for {
+					var docs []interface{}
+					if raw {
+						stored, err := reader.ReadRawBatch(len(batch))
+						if err != nil {
+							b.Fatal(err)
+						}
+						docs = prepareRawDocuments(stored, ImportOptions{}, &result)
+					} else {
+						decoded, err := reader.ReadBatch(len(batch))
+						if err != nil {
+							b.Fatal(err)
+						}
+						if docs, err = prepareDocuments(decoded, ImportOptions{}, &result); err != nil {
+							b.Fatal(err)
+						}
+					}
+					if len(docs) == 0 {
+						break
+					}
+					for _, doc := range docs {
+						if _, err := bson.Marshal(doc); err != nil {
+							b.Fatal(err)
+						}
+					}
+				}
+				reader.Close()
+			}
+		})
+	}
+}
@@ -0,0 +1,459 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/sfi2k7/mc/internal/utils"
+)
+
+// oplogDatabase and oplogCollection locate the replica set oplog
+const (
+	oplogDatabase   = "local"
+	oplogCollection = "oplog.rs"
+)
+
+// oplogOps are the operation types exported: insert, update and delete
+var oplogOps = bson.A{"i", "u", "d"}
+
+// OplogOptions configures an oplog export
+type OplogOptions struct {
+	// Since is the timestamp after which entries are exported
+	Since         primitive.Timestamp
+	BatchSize     int
+	ProgressBytes bool
+	Logger        *utils.Logger
+}
+
+// OplogResult summarizes an oplog export
+type OplogResult struct {
+	Exported int64
+	// End is the newest oplog timestamp when the export started. Entries up
+	// to it are covered, so the next export continues from it even if none
+	// of them touched the namespace.
+	End primitive.Timestamp
+}
+
+// ParseOplogTimestamp parses an oplog position given as "seconds",
+// "seconds:increment" or an RFC 3339 time
+func ParseOplogTimestamp(s string) (primitive.Timestamp, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return primitive.Timestamp{T: uint32(t.Unix())}, nil
+	}
+	seconds, increment, hasIncrement := strings.Cut(s, ":")
+	t, err := strconv.ParseUint(seconds, 10, 32)
+	if err != nil {
+		return primitive.Timestamp{}, fmt.Errorf("invalid oplog timestamp %q (expected seconds[:increment] or an RFC 3339 time)", s)
+	}
+	var i uint64
+	if hasIncrement {
+		if i, err = strconv.ParseUint(increment, 10, 32); err != nil {
+			return primitive.Timestamp{}, fmt.Errorf("invalid oplog timestamp increment %q", increment)
+		}
+	}
+	return primitive.Timestamp{T: uint32(t), I: uint32(i)}, nil
+}
+
+// FormatOplogTimestamp formats a timestamp as "seconds:increment", the form
+// accepted by ParseOplogTimestamp
+func FormatOplogTimestamp(ts primitive.Timestamp) string {
+	return fmt.Sprintf("%d:%d", ts.T, ts.I)
+}
+
+// ExportOplog writes the insert, update and delete entries of a namespace
+// that were added to the oplog after opts.Since. The entries are written
+// unchanged. Operations inside transactions are stored in applyOps entries
+// of another namespace and are not exported.
+func ExportOplog(
+	ctx context.Context,
+	client *mongo.Client,
+	database, collection string,
+	opts OplogOptions,
+	writer BatchWriter,
+	progress *utils.ProgressBar,
+) (OplogResult, error) {
+	if err := requireReplicaSet(ctx, client); err != nil {
+		return OplogResult{}, err
+	}
+
+	oplog := client.Database(oplogDatabase).Collection(oplogCollection)
+	first, err := oplogEdge(ctx, oplog, 1)
+	if err != nil {
+		return OplogResult{}, err
+	}
+	last, err := oplogEdge(ctx, oplog, -1)
+	if err != nil {
+		return OplogResult{}, err
+	}
+	// The oplog is capped; once the entry after Since is gone, the chain
+	// of exports has a gap
+	if !opts.Since.IsZero() && opts.Since.Before(first) {
+		return OplogResult{}, fmt.Errorf("the oplog starts at %s, after %s; entries in between were discarded, so take a full export instead",
+			FormatOplogTimestamp(first), FormatOplogTimestamp(opts.Since))
+	}
+
+	result := OplogResult{End: last}
+	if !opts.Since.Before(last) {
+		return result, nil
+	}
+
+	filter := bson.D{
+		{Key: "ts", Value: bson.D{{Key: "$gt", Value: opts.Since}, {Key: "$lte", Value: last}}},
+		{Key: "ns", Value: database + "." + collection},
+		{Key: "op", Value: bson.D{{Key: "$in", Value: oplogOps}}},
+	}
+	findOptions := options.Find().
+		SetBatchSize(int32(opts.BatchSize)).
+		SetSort(bson.D{{Key: "$natural", Value: 1}})
+	cursor, err := oplog.Find(ctx, filter, findOptions)
+	if err != nil {
+		return result, fmt.Errorf("failed to read the oplog: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	batch := make([][]byte, 0, opts.BatchSize)
+	flush := func() error {
+		if err := writer.WriteRawBatch(batch); err != nil {
+			return fmt.Errorf("failed to write batch: %w", err)
+		}
+		result.Exported += int64(len(batch))
+		if !opts.ProgressBytes {
+			progress.Add(int64(len(batch)))
+		}
+		batch = make([][]byte, 0, opts.BatchSize)
+		return nil
+	}
+
+	for cursor.Next(ctx) {
+		// cursor.Current is reused, so copy the bytes
+		batch = append(batch, append([]byte(nil), cursor.Current...))
+		if opts.ProgressBytes {
+			progress.Add(int64(len(cursor.Current)))
+		}
+		if len(batch) >= opts.BatchSize {
+			if err := flush(); err != nil {
+				return result, err
+			}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return result, fmt.Errorf("failed to read the oplog: %w", err)
+	}
+	if len(batch) > 0 {
+		if err := flush(); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// requireReplicaSet fails unless the client is connected to a replica set
+// member, the only deployment with an oplog to read
+func requireReplicaSet(ctx context.Context, client *mongo.Client) error {
+	var hello struct {
+		SetName string `bson:"setName"`
+		Msg     string `bson:"msg"`
+	}
+	admin := client.Database("admin")
+	err := admin.RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&hello)
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) {
+		// Servers before 4.4.2 only know the legacy name
+		err = admin.RunCommand(ctx, bson.D{{Key: "isMaster", Value: 1}}).Decode(&hello)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to query the deployment type: %w", err)
+	}
+	switch {
+	case hello.Msg == "isdbgrid":
+		return fmt.Errorf("oplog export needs a replica set member; connect to a shard directly instead of mongos")
+	case hello.SetName == "":
+		return fmt.Errorf("oplog export needs a replica set; a standalone server has no oplog")
+	}
+	return nil
+}
+
+// oplogEdge returns the timestamp of the oldest (direction 1) or newest
+// (direction -1) oplog entry
+func oplogEdge(ctx context.Context, oplog *mongo.Collection, direction int) (primitive.Timestamp, error) {
+	var entry struct {
+		TS primitive.Timestamp `bson:"ts"`
+	}
+	findOptions := options.FindOne().
+		SetSort(bson.D{{Key: "$natural", Value: direction}}).
+		SetProjection(bson.D{{Key: "ts", Value: 1}})
+	if err := oplog.FindOne(ctx, bson.D{}, findOptions).Decode(&entry); err != nil {
+		return primitive.Timestamp{}, fmt.Errorf("failed to read the oplog (reading local.oplog.rs needs the find privilege on the local database): %w", err)
+	}
+	return entry.TS, nil
+}
+
+// Policies for oplog entries whose target document does not exist
+const (
+	// OplogSkip counts the entry as missing and carries on
+	OplogSkip = "skip"
+	// OplogFail stops the replay at the entry
+	OplogFail = "fail"
+	// OplogUpsert creates the document from the update. An update that
+	// only sets some fields creates a document with just those fields.
+	OplogUpsert = "upsert"
+)
+
+// ValidOplogMode reports whether s is a known --oplog-mode policy
+func ValidOplogMode(s string) bool {
+	return s == OplogSkip || s == OplogFail || s == OplogUpsert
+}
+
+// oplogEntry holds the fields of an oplog entry needed to replay it
+type oplogEntry struct {
+	Op string              `bson:"op"`
+	TS primitive.Timestamp `bson:"ts"`
+	// O is the document of an insert, the update of an update and the _id
+	// of a delete
+	O bson.D `bson:"o"`
+	// O2 selects the document an update applies to
+	O2 bson.D `bson:"o2"`
+}
+
+// replayOplog applies a batch of oplog entries to coll in order. Inserts
+// are applied as upserting replacements so that replaying an entry twice
+// is harmless; updates and deletes are idempotent as recorded.
+func replayOplog(ctx context.Context, coll *mongo.Collection, batch []bson.D, mode string, result *ImportResult) error {
+	return replayEntries(batch, mode, result, func(entry oplogEntry) (bool, error) {
+		return applyOplogEntry(ctx, coll, entry, mode)
+	})
+}
+
+// replayEntries decodes a batch of oplog entries and applies them in order
+// with apply, which reports whether the target document existed. Entries
+// for missing documents are handled by mode.
+func replayEntries(batch []bson.D, mode string, result *ImportResult, apply func(oplogEntry) (bool, error)) error {
+	for _, doc := range batch {
+		raw, err := bson.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		var entry oplogEntry
+		if err := bson.Unmarshal(raw, &entry); err != nil {
+			return fmt.Errorf("malformed oplog entry: %w", err)
+		}
+		found, err := apply(entry)
+		if err != nil {
+			return fmt.Errorf("failed to apply oplog entry %s: %w", FormatOplogTimestamp(entry.TS), err)
+		}
+		switch {
+		case !found && mode == OplogFail:
+			id, _ := lookupField(entry.O2, "_id")
+			if entry.Op == "d" {
+				id, _ = lookupField(entry.O, "_id")
+			}
+			return fmt.Errorf("oplog entry %s targets document %v, which does not exist (use --oplog-mode skip or upsert)",
+				FormatOplogTimestamp(entry.TS), id)
+		case !found:
+			result.Missing++
+		case entry.Op == "i":
+			result.Inserted++
+		case entry.Op == "u":
+			result.Updated++
+		case entry.Op == "d":
+			result.Deleted++
+		}
+	}
+	return nil
+}
+
+// applyOplogEntry applies one entry and reports whether its target
+// document existed. Inserts always count as found. With OplogFail the
+// entry is not applied when the document is missing.
+func applyOplogEntry(ctx context.Context, coll *mongo.Collection, entry oplogEntry, mode string) (bool, error) {
+	switch entry.Op {
+	case "i":
+		id, ok := lookupField(entry.O, "_id")
+		if !ok {
+			return false, fmt.Errorf("insert without _id")
+		}
+		_, err := coll.ReplaceOne(ctx, bson.D{{Key: "_id", Value: id}}, entry.O, options.Replace().SetUpsert(true))
+		return true, err
+
+	case "d":
+		res, err := coll.DeleteOne(ctx, entry.O)
+		if err != nil {
+			return false, err
+		}
+		return res.DeletedCount > 0, nil
+
+	case "u":
+		upsert := mode == OplogUpsert
+		if isReplacement(entry.O) {
+			res, err := coll.ReplaceOne(ctx, entry.O2, entry.O, options.Replace().SetUpsert(upsert))
+			if err != nil {
+				return false, err
+			}
+			return res.MatchedCount > 0, nil
+		}
+		updates, err := oplogUpdates(entry.O)
+		if err != nil {
+			return false, err
+		}
+		if len(updates) == 0 {
+			if updates, err = matchOnlyUpdate(entry.O2); err != nil {
+				return false, err
+			}
+		}
+		found := false
+		for i, update := range updates {
+			// Only the first update may create the document
+			res, err := coll.UpdateOne(ctx, entry.O2, update, options.Update().SetUpsert(upsert && i == 0))
+			if err != nil {
+				return false, err
+			}
+			if i == 0 {
+				found = res.MatchedCount > 0
+			}
+			if !found && !upsert {
+				break
+			}
+		}
+		return found, nil
+	}
+	return false, fmt.Errorf("unsupported operation type %q", entry.Op)
+}
+
+// isReplacement reports whether the o field of an update entry is a whole
+// document rather than update operators
+func isReplacement(o bson.D) bool {
+	for _, elem := range o {
+		if strings.HasPrefix(elem.Key, "$") {
+			return false
+		}
+	}
+	return true
+}
+
+// oplogUpdates converts the o field of an update entry into update
+// documents. Entries before MongoDB 5.0 hold $set and $unset operators;
+// later ones hold a {$v: 2, diff: ...} description of the change, which is
+// rewritten into $set and $unset plus a $push with $slice for every array
+// that was shortened, applied as separate updates. An empty diff gives no
+// updates.
+func oplogUpdates(o bson.D) ([]bson.D, error) {
+	version, _ := lookupField(o, "$v")
+	if v, ok := numericValue(version); !ok || v != 2 {
+		update := make(bson.D, 0, len(o))
+		for _, elem := range o {
+			if elem.Key != "$v" {
+				update = append(update, elem)
+			}
+		}
+		return []bson.D{update}, nil
+	}
+
+	diff, ok := lookupField(o, "diff")
+	diffDoc, isDoc := diff.(bson.D)
+	if !ok || !isDoc {
+		return nil, fmt.Errorf("update has $v 2 but no diff")
+	}
+	var set, unset, truncate bson.D
+	if err := walkDiff(diffDoc, "", &set, &unset, &truncate); err != nil {
+		return nil, err
+	}
+
+	var first bson.D
+	if len(set) > 0 {
+		first = append(first, bson.E{Key: "$set", Value: set})
+	}
+	if len(unset) > 0 {
+		first = append(first, bson.E{Key: "$unset", Value: unset})
+	}
+	var updates []bson.D
+	if len(first) > 0 {
+		updates = append(updates, first)
+	}
+	for _, t := range truncate {
+		updates = append(updates, bson.D{{Key: "$push", Value: bson.D{{Key: t.Key, Value: bson.D{
+			{Key: "$each", Value: bson.A{}},
+			{Key: "$slice", Value: t.Value},
+		}}}}})
+	}
+	return updates, nil
+}
+
+// matchOnlyUpdate returns an update that changes nothing, for an entry
+// whose diff is empty but which still has to match, or with OplogUpsert
+// create, its document. An empty $set would do on MongoDB 5.0 and later,
+// but earlier servers reject it, so _id is set to the value it already
+// has.
+func matchOnlyUpdate(o2 bson.D) ([]bson.D, error) {
+	id, ok := lookupField(o2, "_id")
+	if !ok {
+		return nil, fmt.Errorf("update entry without _id in o2")
+	}
+	return []bson.D{{{Key: "$set", Value: bson.D{{Key: "_id", Value: id}}}}}, nil
+}
+
+// walkDiff collects the field changes of a $v 2 diff below path. Object
+// diffs use the sections u (update), i (insert), d (delete) and s<field>
+// (nested diff); array diffs are marked with a: true and use l (new
+// length), u<index> and s<index>.
+func walkDiff(diff bson.D, path string, set, unset, truncate *bson.D) error {
+	isArray := false
+	for _, elem := range diff {
+		if elem.Key == "a" {
+			isArray, _ = elem.Value.(bool)
+		}
+	}
+
+	for _, elem := range diff {
+		switch {
+		case isArray && elem.Key == "a":
+		case isArray && elem.Key == "l":
+			*truncate = append(*truncate, bson.E{Key: path, Value: elem.Value})
+		case isArray && strings.HasPrefix(elem.Key, "u"):
+			*set = append(*set, bson.E{Key: path + "." + elem.Key[1:], Value: elem.Value})
+		case !isArray && (elem.Key == "u" || elem.Key == "i"):
+			fields, ok := elem.Value.(bson.D)
+			if !ok {
+				return fmt.Errorf("malformed diff section %q at %q", elem.Key, path)
+			}
+			for _, field := range fields {
+				*set = append(*set, bson.E{Key: joinPath(path, field.Key), Value: field.Value})
+			}
+		case !isArray && elem.Key == "d":
+			fields, ok := elem.Value.(bson.D)
+			if !ok {
+				return fmt.Errorf("malformed diff section %q at %q", elem.Key, path)
+			}
+			for _, field := range fields {
+				*unset = append(*unset, bson.E{Key: joinPath(path, field.Key), Value: ""})
+			}
+		case strings.HasPrefix(elem.Key, "s"):
+			nested, ok := elem.Value.(bson.D)
+			if !ok {
+				return fmt.Errorf("malformed diff section %q at %q", elem.Key, path)
+			}
+			if err := walkDiff(nested, joinPath(path, elem.Key[1:]), set, unset, truncate); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unsupported diff section %q at %q", elem.Key, path)
+		}
+	}
+	return nil
+}
+
+// joinPath appends a field to a dotted path
+func joinPath(path, field string) string {
+	if path == "" {
+		return field
+	}
+	return path + "." + field
+}
@@ -0,0 +1,200 @@
+package db
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// v2 wraps a diff into the o field of a MongoDB 5.0 update entry
+func v2(diff bson.D) bson.D {
+	return bson.D{{Key: "$v", Value: int32(2)}, {Key: "diff", Value: diff}}
+}
+
+func TestOplogUpdates(t *testing.T) {
+	tests := []struct {
+		name string
+		o    bson.D
+		want []bson.D
+	}{
+		{
+			name: "operators before 5.0",
+			o: bson.D{
+				{Key: "$v", Value: int32(1)},
+				{Key: "$set", Value: bson.D{{Key: "a", Value: int32(1)}}},
+			},
+			want: []bson.D{{{Key: "$set", Value: bson.D{{Key: "a", Value: int32(1)}}}}},
+		},
+		{
+			name: "update insert and delete",
+			o: v2(bson.D{
+				{Key: "u", Value: bson.D{{Key: "a", Value: int32(2)}}},
+				{Key: "i", Value: bson.D{{Key: "b", Value: "new"}}},
+				{Key: "d", Value: bson.D{{Key: "c", Value: false}}},
+			}),
+			want: []bson.D{{
+				{Key: "$set", Value: bson.D{{Key: "a", Value: int32(2)}, {Key: "b", Value: "new"}}},
+				{Key: "$unset", Value: bson.D{{Key: "c", Value: ""}}},
+			}},
+		},
+		{
+			name: "nested document",
+			o: v2(bson.D{
+				{Key: "saddress", Value: bson.D{
+					{Key: "u", Value: bson.D{{Key: "city", Value: "Oslo"}}},
+					{Key: "sgeo", Value: bson.D{{Key: "d", Value: bson.D{{Key: "lat", Value: false}}}}},
+				}},
+			}),
+			want: []bson.D{{
+				{Key: "$set", Value: bson.D{{Key: "address.city", Value: "Oslo"}}},
+				{Key: "$unset", Value: bson.D{{Key: "address.geo.lat", Value: ""}}},
+			}},
+		},
+		{
+			name: "array elements",
+			o: v2(bson.D{
+				{Key: "stags", Value: bson.D{
+					{Key: "a", Value: true},
+					{Key: "u1", Value: "b"},
+					{Key: "s2", Value: bson.D{{Key: "u", Value: bson.D{{Key: "n", Value: int32(3)}}}}},
+				}},
+			}),
+			want: []bson.D{{
+				{Key: "$set", Value: bson.D{{Key: "tags.1", Value: "b"}, {Key: "tags.2.n", Value: int32(3)}}},
+			}},
+		},
+		{
+			name: "array truncated",
+			o: v2(bson.D{
+				{Key: "u", Value: bson.D{{Key: "count", Value: int32(2)}}},
+				{Key: "sitems", Value: bson.D{
+					{Key: "a", Value: true},
+					{Key: "l", Value: int32(2)},
+				}},
+			}),
+			want: []bson.D{
+				{{Key: "$set", Value: bson.D{{Key: "count", Value: int32(2)}}}},
+				{{Key: "$push", Value: bson.D{{Key: "items", Value: bson.D{
+					{Key: "$each", Value: bson.A{}},
+					{Key: "$slice", Value: int32(2)},
+				}}}}},
+			},
+		},
+		{
+			name: "empty diff",
+			o:    v2(bson.D{}),
+			want: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := oplogUpdates(tt.o)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("oplogUpdates(%v) = %v, want %v", tt.o, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOplogUpdatesErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		o    bson.D
+		want string
+	}{
+		{"no diff", bson.D{{Key: "$v", Value: int32(2)}}, "no diff"},
+		{"malformed section", v2(bson.D{{Key: "u", Value: int32(1)}}), "malformed diff section"},
+		{"malformed nested diff", v2(bson.D{{Key: "sa", Value: "x"}}), "malformed diff section"},
+		{"unsupported section", v2(bson.D{{Key: "x", Value: bson.D{}}}), "unsupported diff section"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := oplogUpdates(tt.o)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("oplogUpdates(%v) error = %v, want %q", tt.o, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchOnlyUpdate(t *testing.T) {
+	got, err := matchOnlyUpdate(bson.D{{Key: "_id", Value: int32(7)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []bson.D{{{Key: "$set", Value: bson.D{{Key: "_id", Value: int32(7)}}}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("matchOnlyUpdate = %v, want %v", got, want)
+	}
+	if _, err := matchOnlyUpdate(bson.D{}); err == nil {
+		t.Error("matchOnlyUpdate without _id succeeded")
+	}
+}
+
+func TestReplayEntriesMissingDocuments(t *testing.T) {
+	entry := func(op string, id int32) bson.D {
+		doc := bson.D{
+			{Key: "op", Value: op},
+			{Key: "ts", Value: primitive.Timestamp{T: 100, I: uint32(id)}},
+		}
+		if op == "u" {
+			return append(doc,
+				bson.E{Key: "o", Value: bson.D{{Key: "$set", Value: bson.D{{Key: "a", Value: int32(1)}}}}},
+				bson.E{Key: "o2", Value: bson.D{{Key: "_id", Value: id}}})
+		}
+		return append(doc, bson.E{Key: "o", Value: bson.D{{Key: "_id", Value: id}}})
+	}
+	batch := []bson.D{entry("i", 1), entry("u", 1), entry("u", 2), entry("d", 3), entry("d", 1)}
+	existing := map[int32]bool{}
+	apply := func(e oplogEntry) (bool, error) {
+		doc := e.O2
+		if e.Op != "u" {
+			doc = e.O
+		}
+		id, _ := lookupField(doc, "_id")
+		switch e.Op {
+		case "i":
+			existing[id.(int32)] = true
+			return true, nil
+		case "d":
+			found := existing[id.(int32)]
+			delete(existing, id.(int32))
+			return found, nil
+		}
+		return existing[id.(int32)], nil
+	}
+
+	for _, mode := range []string{OplogSkip, OplogUpsert} {
+		existing = map[int32]bool{}
+		var result ImportResult
+		if err := replayEntries(batch, mode, &result, apply); err != nil {
+			t.Fatalf("%s: %v", mode, err)
+		}
+		if result.Inserted != 1 || result.Updated != 1 || result.Deleted != 1 || result.Missing != 2 {
+			t.Errorf("%s: inserted %d, updated %d, deleted %d, missing %d; want 1, 1, 1, 2",
+				mode, result.Inserted, result.Updated, result.Deleted, result.Missing)
+		}
+	}
+
+	existing = map[int32]bool{}
+	var result ImportResult
+	err := replayEntries(batch, OplogFail, &result, apply)
+	if err == nil || !strings.Contains(err.Error(), "document 2") {
+		t.Fatalf("fail mode error = %v, want one naming document 2", err)
+	}
+	if result.Inserted != 1 || result.Updated != 1 || result.Deleted != 0 {
+		t.Errorf("fail mode went past the missing document: %+v", result)
+	}
+
+	failing := func(oplogEntry) (bool, error) { return false, fmt.Errorf("boom") }
+	if err := replayEntries(batch, OplogSkip, &result, failing); err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Errorf("apply error = %v, want it passed on", err)
+	}
+}
@@ -0,0 +1,158 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/sfi2k7/mc/internal/utils"
+)
+
+// idBucket is one bucket produced by $bucketAuto over _id
+type idBucket struct {
+	ID struct {
+		Min bson.RawValue `bson:"min"`
+		Max bson.RawValue `bson:"max"`
+	} `bson:"_id"`
+}
+
+// idRanges splits the documents matching filter into at most n _id ranges
+// of roughly equal size. Each range is returned as a complete filter.
+func idRanges(ctx context.Context, coll *mongo.Collection, filter bson.M, n int) ([]bson.D, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		{{Key: "$bucketAuto", Value: bson.D{
+			{Key: "groupBy", Value: "$_id"},
+			{Key: "buckets", Value: n},
+		}}},
+	}
+	cursor, err := coll.Aggregate(ctx, pipeline, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute _id ranges: %w", err)
+	}
+	var buckets []idBucket
+	if err := cursor.All(ctx, &buckets); err != nil {
+		return nil, fmt.Errorf("failed to compute _id ranges: %w", err)
+	}
+	if len(buckets) == 0 {
+		return nil, nil
+	}
+
+	// Range queries only match values of the bound's type
+	first, last := buckets[0].ID.Min.Type, buckets[len(buckets)-1].ID.Max.Type
+	if first != last {
+		return nil, fmt.Errorf("--parallel-scan needs a single _id type, found %s and %s", first, last)
+	}
+
+	// Bucket bounds are shared: max of one bucket is min of the next. The
+	// last range is left open so nothing past the final bound is missed.
+	ranges := make([]bson.D, len(buckets))
+	for i, bucket := range buckets {
+		bounds := bson.D{{Key: "$gte", Value: bucket.ID.Min}}
+		if i < len(buckets)-1 {
+			bounds = append(bounds, bson.E{Key: "$lt", Value: bucket.ID.Max})
+		}
+		idFilter := bson.D{{Key: "_id", Value: bounds}}
+		if len(filter) == 0 {
+			ranges[i] = idFilter
+		} else {
+			ranges[i] = bson.D{{Key: "$and", Value: bson.A{filter, idFilter}}}
+		}
+	}
+	return ranges, nil
+}
+
+// exportParallel scans _id ranges concurrently. Batches are written by the
+// calling goroutine, since the writer is not safe for concurrent use.
+func exportParallel(
+	ctx context.Context,
+	coll *mongo.Collection,
+	filter bson.M,
+	opts ExportOptions,
+	writer BatchWriter,
+	progress *utils.ProgressBar,
+	result *ExportResult,
+) error {
+	ranges, err := idRanges(ctx, coll, filter, opts.ParallelScan)
+	if err != nil {
+		return err
+	}
+	opts.Logger.Info("Scanning _id ranges in parallel", "ranges", len(ranges))
+
+	scan := func(ctx context.Context, i int, emit func(exportBatch) error) error {
+		return scanRange(ctx, coll, ranges[i], opts, progress, emit)
+	}
+	consume := func(batch exportBatch) error {
+		return processBatch(batch, writer, opts, progress, result)
+	}
+	return scanConcurrently(ctx, len(ranges), opts.QueueDepth, scan, consume)
+}
+
+// scanConcurrently runs n scans at once and hands their batches to consume
+// on the calling goroutine through a queue of depth batches (n when depth is
+// 0). Besides the queue, every scanner holds the batch it is waiting to
+// queue, so at most depth+n batches are buffered. The first error cancels
+// the remaining scans, and consume is not called after it fails.
+func scanConcurrently(
+	ctx context.Context,
+	n, depth int,
+	scan func(ctx context.Context, i int, emit func(exportBatch) error) error,
+	consume func(exportBatch) error,
+) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg      sync.WaitGroup
+		once    sync.Once
+		scanErr error
+	)
+	if depth <= 0 {
+		depth = n
+	}
+	batches := make(chan exportBatch, depth)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := scan(ctx, i, func(batch exportBatch) error {
+				select {
+				case batches <- batch:
+					return nil
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			})
+			if err != nil {
+				once.Do(func() {
+					scanErr = err
+					cancel()
+				})
+			}
+		}(i)
+	}
+	go func() {
+		wg.Wait()
+		close(batches)
+	}()
+
+	// Keep draining after a write error so the scanners can exit
+	var writeErr error
+	for batch := range batches {
+		if writeErr != nil {
+			continue
+		}
+		if err := consume(batch); err != nil {
+			writeErr = err
+			cancel()
+		}
+	}
+	if writeErr != nil {
+		return writeErr
+	}
+	return scanErr
+}
@@ -0,0 +1,129 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/sfi2k7/mc/internal/utils"
+)
+
+// slowWriter is a BatchWriter that takes a while for every batch and
+// records how many batches were buffered at the time
+type slowWriter struct {
+	delay    time.Duration
+	buffered *int64
+	maxSeen  int64
+	docs     int64
+}
+
+func (w *slowWriter) WriteBatch(batch []bson.D) error {
+	return w.WriteRawBatch(make([][]byte, len(batch)))
+}
+
+func (w *slowWriter) WriteRawBatch(batch [][]byte) error {
+	if n := atomic.LoadInt64(w.buffered); n > w.maxSeen {
+		w.maxSeen = n
+	}
+	w.docs += int64(len(batch))
+	time.Sleep(w.delay)
+	return nil
+}
+
+func TestScanConcurrentlyBoundsBufferedBatches(t *testing.T) {
+	const (
+		scanners         = 4
+		depth            = 3
+		batchesPerScan   = 40
+		documentsInBatch = 10
+	)
+	var buffered int64
+	writer := &slowWriter{delay: time.Millisecond, buffered: &buffered}
+	opts := ExportOptions{ProgressBytes: true}
+	progress := utils.NewProgressBar("test")
+	var result ExportResult
+
+	// A batch is held in memory from the moment a scanner has filled it
+	// until the writer is done with it
+	var maxBuffered int64
+	scan := func(ctx context.Context, i int, emit func(exportBatch) error) error {
+		for b := 0; b < batchesPerScan; b++ {
+			n := atomic.AddInt64(&buffered, 1)
+			for {
+				max := atomic.LoadInt64(&maxBuffered)
+				if n <= max || atomic.CompareAndSwapInt64(&maxBuffered, max, n) {
+					break
+				}
+			}
+			if err := emit(exportBatch{raw: make([][]byte, documentsInBatch)}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	consume := func(batch exportBatch) error {
+		defer atomic.AddInt64(&buffered, -1)
+		return processBatch(batch, writer, opts, progress, &result)
+	}
+
+	if err := scanConcurrently(context.Background(), scanners, depth, scan, consume); err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(scanners * batchesPerScan * documentsInBatch); result.Exported != want || writer.docs != want {
+		t.Fatalf("exported %d, wrote %d documents, want %d", result.Exported, writer.docs, want)
+	}
+	// The queue, one batch per scanner waiting to queue it, and the one
+	// being written
+	if limit := int64(depth + scanners + 1); maxBuffered > limit {
+		t.Fatalf("%d batches held at once, want at most %d", maxBuffered, limit)
+	}
+	// The slow writer must have let the queue fill up, or the bound was
+	// never tested
+	if writer.maxSeen < depth {
+		t.Fatalf("queue never filled: at most %d batches held", writer.maxSeen)
+	}
+}
+
+func TestScanConcurrentlyErrors(t *testing.T) {
+	errScan := errors.New("scan failed")
+	errWrite := errors.New("write failed")
+
+	// A failing scan cancels the others, which would otherwise run forever
+	endless := func(ctx context.Context, i int, emit func(exportBatch) error) error {
+		if i == 0 {
+			return errScan
+		}
+		for {
+			if err := emit(exportBatch{raw: make([][]byte, 1)}); err != nil {
+				return err
+			}
+		}
+	}
+	err := scanConcurrently(context.Background(), 3, 1, endless, func(exportBatch) error { return nil })
+	if !errors.Is(err, errScan) {
+		t.Fatalf("got %v, want the scan error", err)
+	}
+
+	// A failing write stops the scans and consume is not called again
+	calls := 0
+	err = scanConcurrently(context.Background(), 3, 1, func(ctx context.Context, i int, emit func(exportBatch) error) error {
+		for {
+			if err := emit(exportBatch{raw: make([][]byte, 1)}); err != nil {
+				return err
+			}
+		}
+	}, func(exportBatch) error {
+		calls++
+		return errWrite
+	})
+	if !errors.Is(err, errWrite) {
+		t.Fatalf("got %v, want the write error", err)
+	}
+	if calls != 1 {
+		t.Fatalf("consume called %d times, want once", calls)
+	}
+}
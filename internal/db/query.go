@@ -0,0 +1,168 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// dateOperators are the query operators whose string operands
+// CoerceQueryDates treats as dates
+var dateOperators = map[string]bool{
+	"$eq": true, "$ne": true, "$gt": true, "$gte": true, "$lt": true, "$lte": true,
+	"$in": true, "$nin": true,
+}
+
+// dateLayouts are the ISO-8601 forms recognized by CoerceQueryDates. Times
+// without an offset are taken as UTC.
+var dateLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+// NormalizeQuery checks that a query filter is well-formed JSON, reporting
+// the line and column of a syntax error. In relaxed mode // and /* */
+// comments and trailing commas are removed first.
+func NormalizeQuery(query string, relaxed bool) (string, error) {
+	if relaxed {
+		query = stripRelaxedJSON(query)
+	}
+
+	var value interface{}
+	if err := json.Unmarshal([]byte(query), &value); err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			line, col := position(query, syntaxErr.Offset)
+			hint := ""
+			if !relaxed && stripRelaxedJSON(query) != query {
+				hint = " (use --relaxed-json to allow comments and trailing commas)"
+			}
+			return "", fmt.Errorf("invalid query at line %d, column %d: %v%s", line, col, syntaxErr, hint)
+		}
+		return "", fmt.Errorf("invalid query: %w", err)
+	}
+	if _, ok := value.(map[string]interface{}); !ok {
+		return "", fmt.Errorf("invalid query: expected a JSON object")
+	}
+	return query, nil
+}
+
+// CoerceQueryDates rewrites ISO-8601 strings used as operands of comparison
+// operators ($eq, $ne, $gt, $gte, $lt, $lte, and the elements of $in and
+// $nin) into dates, so {"created":{"$gt":"2024-01-01"}} matches date fields.
+// Plain equality such as {"created":"2024-01-01"} is left alone, and so is
+// any string that does not parse as a full date, which means a string field
+// holding ISO dates can no longer be compared as text. The result is
+// canonical extended JSON.
+func CoerceQueryDates(query string) (string, error) {
+	var filter bson.D
+	if err := bson.UnmarshalExtJSON([]byte(query), true, &filter); err != nil {
+		return "", fmt.Errorf("invalid query: %w", err)
+	}
+	coerced, err := bson.MarshalExtJSON(coerceDates(filter, false), true, false)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode query: %w", err)
+	}
+	return string(coerced), nil
+}
+
+// coerceDates walks a parsed query. operand is true for the values of the
+// operators in dateOperators.
+func coerceDates(value interface{}, operand bool) interface{} {
+	switch v := value.(type) {
+	case bson.D:
+		for i, elem := range v {
+			v[i].Value = coerceDates(elem.Value, dateOperators[elem.Key])
+		}
+		return v
+	case bson.A:
+		for i, elem := range v {
+			v[i] = coerceDates(elem, operand)
+		}
+		return v
+	case string:
+		if !operand {
+			return v
+		}
+		for _, layout := range dateLayouts {
+			if t, err := time.Parse(layout, v); err == nil {
+				return primitive.NewDateTimeFromTime(t)
+			}
+		}
+	}
+	return value
+}
+
+// stripRelaxedJSON blanks out comments and trailing commas. Removed text is
+// replaced with spaces and newlines are kept, so error positions still
+// match the original input.
+func stripRelaxedJSON(s string) string {
+	out := []byte(s)
+	inString, escaped := false, false
+
+	for i := 0; i < len(out); i++ {
+		c := out[i]
+		if inString {
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				inString = false
+			}
+			continue
+		}
+
+		switch {
+		case c == '"':
+			inString = true
+		case c == '/' && i+1 < len(out) && out[i+1] == '/':
+			for ; i < len(out) && out[i] != '\n'; i++ {
+				out[i] = ' '
+			}
+		case c == '/' && i+1 < len(out) && out[i+1] == '*':
+			end := strings.Index(string(out[i+2:]), "*/")
+			stop := len(out)
+			if end >= 0 {
+				stop = i + 2 + end + 2
+			}
+			for ; i < stop; i++ {
+				if out[i] != '\n' {
+					out[i] = ' '
+				}
+			}
+			i--
+		case c == '}' || c == ']':
+			// Drop a comma directly before the closing bracket
+			for j := i - 1; j >= 0; j-- {
+				if out[j] == ',' {
+					out[j] = ' '
+					break
+				}
+				if out[j] != ' ' && out[j] != '\t' && out[j] != '\n' && out[j] != '\r' {
+					break
+				}
+			}
+		}
+	}
+	return string(out)
+}
+
+// position converts a byte offset into a 1-based line and column
+func position(s string, offset int64) (int, int) {
+	if offset > int64(len(s)) {
+		offset = int64(len(s))
+	}
+	before := s[:offset]
+	line := strings.Count(before, "\n") + 1
+	col := len(before) - strings.LastIndex(before, "\n")
+	return line, col
+}
@@ -0,0 +1,169 @@
+package db
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// _id remapping modes selectable with --remap-ids
+const (
+	// RemapSequential numbers ids 1, 2, 3... in the order they are first seen
+	RemapSequential = "sequential"
+	// RemapHash derives an ObjectId from the SHA-256 of the original value,
+	// so separate exports map the same id to the same value
+	RemapHash = "hash"
+)
+
+// ValidRemapMode reports whether s is a known --remap-ids mode
+func ValidRemapMode(s string) bool {
+	return s == RemapSequential || s == RemapHash
+}
+
+// IDRemapper replaces document ids, and the references to them in chosen
+// fields, with stable values that do not reveal the originals. Every value
+// gets its new id the first time it is seen, as _id or as a reference, so a
+// reference to a document exported later still matches it. Each mapping is
+// written once to the mapping writer as a line of canonical extended JSON
+// {"old": ..., "new": ...}. The mappings are kept in memory for the whole
+// export.
+//
+// Only fields listed as references are rewritten, so ids embedded anywhere
+// else keep their original values. References into other collections only
+// line up when those are exported with RemapHash as well, and the mapping
+// file reveals every original id.
+type IDRemapper struct {
+	mode    string
+	fields  [][]string
+	mapping io.Writer
+	ids     map[string]interface{}
+	next    int64
+}
+
+// NewIDRemapper creates a remapper for the given mode. refFields are dotted
+// paths whose values are rewritten with the same mapping as _id; arrays
+// along the path are followed.
+func NewIDRemapper(mode string, refFields []string, mapping io.Writer) *IDRemapper {
+	fields := make([][]string, len(refFields))
+	for i, field := range refFields {
+		fields[i] = strings.Split(field, ".")
+	}
+	return &IDRemapper{
+		mode:    mode,
+		fields:  fields,
+		mapping: mapping,
+		ids:     make(map[string]interface{}),
+	}
+}
+
+// Mapped returns the number of distinct ids remapped so far
+func (r *IDRemapper) Mapped() int {
+	return len(r.ids)
+}
+
+// remap rewrites the _id and reference fields of a document in place
+func (r *IDRemapper) remap(doc bson.D) error {
+	for i, elem := range doc {
+		if elem.Key == "_id" {
+			id, err := r.newID(elem.Value)
+			if err != nil {
+				return err
+			}
+			doc[i].Value = id
+			break
+		}
+	}
+	for _, path := range r.fields {
+		if err := r.remapPath(doc, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remapPath rewrites the values at path below doc
+func (r *IDRemapper) remapPath(doc bson.D, path []string) error {
+	for i, elem := range doc {
+		if elem.Key != path[0] {
+			continue
+		}
+		if len(path) == 1 {
+			value, err := r.remapValue(elem.Value)
+			if err != nil {
+				return err
+			}
+			doc[i].Value = value
+			return nil
+		}
+		switch nested := elem.Value.(type) {
+		case bson.D:
+			return r.remapPath(nested, path[1:])
+		case bson.A:
+			for _, item := range nested {
+				if itemDoc, ok := item.(bson.D); ok {
+					if err := r.remapPath(itemDoc, path[1:]); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		return nil
+	}
+	return nil
+}
+
+// remapValue maps a reference, or each element of an array of references.
+// Null references stay null.
+func (r *IDRemapper) remapValue(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case nil, primitive.Null:
+		return value, nil
+	case bson.A:
+		for i, item := range v {
+			mapped, err := r.remapValue(item)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = mapped
+		}
+		return v, nil
+	}
+	return r.newID(value)
+}
+
+// newID returns the replacement of an original id, assigning one on first
+// sight. Ids are keyed by their BSON type and bytes, so 1 and "1" differ.
+func (r *IDRemapper) newID(original interface{}) (interface{}, error) {
+	key, err := valueKey(original)
+	if err != nil {
+		return nil, fmt.Errorf("failed to remap id: %w", err)
+	}
+	if id, ok := r.ids[key]; ok {
+		return id, nil
+	}
+
+	var id interface{}
+	if r.mode == RemapHash {
+		sum := sha256.Sum256([]byte(key))
+		var oid primitive.ObjectID
+		copy(oid[:], sum[:])
+		id = oid
+	} else {
+		r.next++
+		id = r.next
+	}
+	r.ids[key] = id
+
+	line, err := bson.MarshalExtJSON(bson.D{{Key: "old", Value: original}, {Key: "new", Value: id}}, true, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record id mapping: %w", err)
+	}
+	if _, err := r.mapping.Write(append(line, '\n')); err != nil {
+		return nil, fmt.Errorf("failed to write id mapping: %w", err)
+	}
+	return id, nil
+}
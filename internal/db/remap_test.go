@@ -0,0 +1,160 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// readIDMap reads a mapping sidecar into a map from the original ids, as
+// keyed by valueKey, to the new ones
+func readIDMap(t *testing.T, path string) map[string]interface{} {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	mapping := map[string]interface{}{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var line bson.D
+		if err := bson.UnmarshalExtJSON(scanner.Bytes(), true, &line); err != nil {
+			t.Fatalf("bad mapping line %s: %v", scanner.Text(), err)
+		}
+		if len(line) != 2 || line[0].Key != "old" || line[1].Key != "new" {
+			t.Fatalf("mapping line %s, want {old, new}", scanner.Text())
+		}
+		key, err := valueKey(line[0].Value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := mapping[key]; ok {
+			t.Errorf("id %v mapped twice", line[0].Value)
+		}
+		mapping[key] = line[1].Value
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return mapping
+}
+
+func TestIDRemapperAcrossBatches(t *testing.T) {
+	orderID := primitive.NewObjectID()
+	batches := [][]bson.D{
+		{
+			{{Key: "_id", Value: "u1"}, {Key: "manager", Value: "u2"}},
+			{{Key: "_id", Value: orderID}, {Key: "owner", Value: "u1"}},
+		},
+		{
+			// u2 was first seen as a reference in the batch before
+			{{Key: "_id", Value: "u2"}, {Key: "manager", Value: nil}},
+			{
+				{Key: "_id", Value: int32(3)},
+				{Key: "friends", Value: bson.A{"u1", "u2", int32(3)}},
+				{Key: "items", Value: bson.A{
+					bson.D{{Key: "owner", Value: orderID}},
+					bson.D{{Key: "owner", Value: "u9"}},
+				}},
+			},
+		},
+	}
+
+	path := filepath.Join(t.TempDir(), "users.mcbz.idmap.jsonl")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := bufio.NewWriter(f)
+	r := NewIDRemapper(RemapSequential, []string{"manager", "owner", "friends", "items.owner"}, w)
+	for _, batch := range batches {
+		for _, doc := range batch {
+			if err := r.remap(doc); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	u1, u2, order, three, u9 := int64(1), int64(2), int64(3), int64(4), int64(5)
+	want := [][]bson.D{
+		{
+			{{Key: "_id", Value: u1}, {Key: "manager", Value: u2}},
+			{{Key: "_id", Value: order}, {Key: "owner", Value: u1}},
+		},
+		{
+			{{Key: "_id", Value: u2}, {Key: "manager", Value: nil}},
+			{
+				{Key: "_id", Value: three},
+				{Key: "friends", Value: bson.A{u1, u2, three}},
+				{Key: "items", Value: bson.A{
+					bson.D{{Key: "owner", Value: order}},
+					bson.D{{Key: "owner", Value: u9}},
+				}},
+			},
+		},
+	}
+	if !reflect.DeepEqual(batches, want) {
+		t.Errorf("remapped documents\n%v\nwant\n%v", batches, want)
+	}
+	if r.Mapped() != 5 {
+		t.Errorf("Mapped() = %d, want 5", r.Mapped())
+	}
+
+	mapping := readIDMap(t, path)
+	originals := map[interface{}]int64{"u1": u1, "u2": u2, orderID: order, int32(3): three, "u9": u9}
+	if len(mapping) != len(originals) {
+		t.Errorf("mapping has %d ids, want %d", len(mapping), len(originals))
+	}
+	for original, id := range originals {
+		key, _ := valueKey(original)
+		if got := mapping[key]; got != id {
+			t.Errorf("mapping of %v = %v, want %d", original, got, id)
+		}
+	}
+}
+
+func TestIDRemapperHash(t *testing.T) {
+	remapOne := func(id interface{}) interface{} {
+		doc := bson.D{{Key: "_id", Value: id}}
+		var mapping bytes.Buffer
+		if err := NewIDRemapper(RemapHash, nil, &mapping).remap(doc); err != nil {
+			t.Fatal(err)
+		}
+		return doc[0].Value
+	}
+	a := remapOne("u1")
+	if _, ok := a.(primitive.ObjectID); !ok {
+		t.Fatalf("hash mode gave %T, want an ObjectId", a)
+	}
+	if b := remapOne("u1"); b != a {
+		t.Errorf("separate remappers gave %v and %v for the same id", a, b)
+	}
+	if b := remapOne(int32(1)); b == remapOne("1") {
+		t.Error("1 and \"1\" got the same id")
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) { return 0, errors.New("disk full") }
+
+func TestIDRemapperMappingWriteError(t *testing.T) {
+	r := NewIDRemapper(RemapSequential, nil, failingWriter{})
+	if err := r.remap(bson.D{{Key: "_id", Value: "u1"}}); err == nil {
+		t.Error("remap succeeded although the mapping could not be written")
+	}
+}
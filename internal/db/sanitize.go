@@ -0,0 +1,88 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Key sanitizing strategies for field names containing dots or a leading $
+const (
+	SanitizeEscape  = "escape"
+	SanitizeReplace = "replace"
+	SanitizeError   = "error"
+)
+
+// ValidSanitizeStrategy reports whether s is a known key sanitizing strategy
+func ValidSanitizeStrategy(s string) bool {
+	return s == SanitizeEscape || s == SanitizeReplace || s == SanitizeError
+}
+
+// sanitizeKeys rewrites field names containing dots or a leading $ according
+// to the strategy, recursing into embedded documents and arrays. It reports
+// whether any key was changed.
+func sanitizeKeys(doc bson.D, strategy string) (bson.D, bool, error) {
+	changed := false
+	out := make(bson.D, len(doc))
+
+	for i, elem := range doc {
+		key := elem.Key
+		if strings.Contains(key, ".") || strings.HasPrefix(key, "$") {
+			switch strategy {
+			case SanitizeEscape:
+				// Full-width look-alikes keep the key readable and reversible
+				key = strings.ReplaceAll(key, ".", "．")
+				if strings.HasPrefix(key, "$") {
+					key = "＄" + key[1:]
+				}
+			case SanitizeReplace:
+				key = strings.ReplaceAll(key, ".", "_")
+				if strings.HasPrefix(key, "$") {
+					key = "_" + key[1:]
+				}
+			default:
+				return nil, false, fmt.Errorf("field name %q contains a dot or leading $", elem.Key)
+			}
+			changed = true
+		}
+
+		value, valueChanged, err := sanitizeValue(elem.Value, strategy)
+		if err != nil {
+			return nil, false, err
+		}
+		changed = changed || valueChanged
+		out[i] = bson.E{Key: key, Value: value}
+	}
+
+	if !changed {
+		return doc, false, nil
+	}
+	return out, true, nil
+}
+
+// sanitizeValue sanitizes the keys of embedded documents inside a value
+func sanitizeValue(value interface{}, strategy string) (interface{}, bool, error) {
+	switch v := value.(type) {
+	case bson.D:
+		return sanitizeKeys(v, strategy)
+	case primitive.A:
+		changed := false
+		out := make(primitive.A, len(v))
+		for i, item := range v {
+			sanitized, itemChanged, err := sanitizeValue(item, strategy)
+			if err != nil {
+				return nil, false, err
+			}
+			changed = changed || itemChanged
+			out[i] = sanitized
+		}
+		if !changed {
+			return value, false, nil
+		}
+		return out, true, nil
+	default:
+		return value, false, nil
+	}
+}
@@ -0,0 +1,243 @@
+package db
+
+import (
+	"bytes"
+	"math"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// sortBatch orders a batch by the value at a dotted field path so similar
+// documents end up next to each other. Documents without the field or with
+// a null value come first, and the sort is stable so ties keep their cursor
+// order.
+func sortBatch(batch []bson.D, field string) {
+	keys := make([]interface{}, len(batch))
+	for i, doc := range batch {
+		keys[i], _ = lookupField(doc, field)
+	}
+	sort.Stable(batchSorter{batch: batch, keys: keys})
+}
+
+// batchSorter sorts documents together with their precomputed sort keys
+type batchSorter struct {
+	batch []bson.D
+	keys  []interface{}
+}
+
+func (s batchSorter) Len() int { return len(s.batch) }
+
+func (s batchSorter) Less(i, j int) bool { return compareValues(s.keys[i], s.keys[j]) < 0 }
+
+func (s batchSorter) Swap(i, j int) {
+	s.batch[i], s.batch[j] = s.batch[j], s.batch[i]
+	s.keys[i], s.keys[j] = s.keys[j], s.keys[i]
+}
+
+// compareValues orders two BSON values, first by type and then by value.
+// Values of types without a natural order compare as equal.
+func compareValues(a, b interface{}) int {
+	rankA, rankB := typeRank(a), typeRank(b)
+	if rankA != rankB {
+		if rankA < rankB {
+			return -1
+		}
+		return 1
+	}
+
+	switch a := a.(type) {
+	case string:
+		return strings.Compare(a, b.(string))
+	case primitive.ObjectID:
+		other := b.(primitive.ObjectID)
+		return bytes.Compare(a[:], other[:])
+	case bool:
+		switch {
+		case a == b.(bool):
+			return 0
+		case !a:
+			return -1
+		default:
+			return 1
+		}
+	case primitive.DateTime:
+		return compareFloats(float64(a), float64(b.(primitive.DateTime)))
+	case time.Time:
+		return compareFloats(float64(a.UnixNano()), float64(b.(time.Time).UnixNano()))
+	case primitive.Timestamp:
+		return primitive.CompareTimestamp(a, b.(primitive.Timestamp))
+	}
+	if typeRank(a) == numberRank {
+		return compareNumbers(a, b)
+	}
+	return 0
+}
+
+// numberRank is the rank typeRank gives every numeric type
+const numberRank = 1
+
+// typeRank groups values so that comparable types share a rank
+func typeRank(v interface{}) int {
+	switch v.(type) {
+	case nil, primitive.Null:
+		return 0
+	case int32, int64, float64, int, primitive.Decimal128:
+		return numberRank
+	case string:
+		return 2
+	case bson.D, bson.M:
+		return 3
+	case bson.A:
+		return 4
+	case primitive.Binary:
+		return 5
+	case primitive.ObjectID:
+		return 6
+	case bool:
+		return 7
+	case primitive.DateTime, time.Time:
+		return 8
+	case primitive.Timestamp:
+		return 9
+	default:
+		return 10
+	}
+}
+
+// numericValue converts a BSON number to float64
+func numericValue(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+// compareNumbers orders two numbers of any BSON numeric type. Integers are
+// compared exactly, as are mixed types and Decimal128 values, which go
+// through big.Rat. NaN sorts before every other number, as in MongoDB.
+func compareNumbers(a, b interface{}) int {
+	if x, ok := integerValue(a); ok {
+		if y, ok := integerValue(b); ok {
+			switch {
+			case x < y:
+				return -1
+			case x > y:
+				return 1
+			}
+			return 0
+		}
+	}
+	if x, ok := a.(float64); ok {
+		if y, ok := b.(float64); ok && !math.IsNaN(x) && !math.IsNaN(y) {
+			return compareFloats(x, y)
+		}
+	}
+
+	x, specialA := exactNumber(a)
+	y, specialB := exactNumber(b)
+	if specialA != specialB || specialA != finite {
+		return compareInts(specialA, specialB)
+	}
+	return x.Cmp(y)
+}
+
+// Order of the non-finite numbers around the finite ones
+const (
+	notANumber = iota
+	negativeInfinity
+	finite
+	positiveInfinity
+)
+
+// integerValue returns an integral BSON number as int64
+func integerValue(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	case int:
+		return int64(n), true
+	}
+	return 0, false
+}
+
+// exactNumber returns a number as an exact rational, or which of the
+// non-finite values it is
+func exactNumber(v interface{}) (*big.Rat, int) {
+	if n, ok := integerValue(v); ok {
+		return new(big.Rat).SetInt64(n), finite
+	}
+	switch n := v.(type) {
+	case float64:
+		switch {
+		case math.IsNaN(n):
+			return nil, notANumber
+		case math.IsInf(n, -1):
+			return nil, negativeInfinity
+		case math.IsInf(n, 1):
+			return nil, positiveInfinity
+		}
+		return new(big.Rat).SetFloat64(n), finite
+	case primitive.Decimal128:
+		if n.IsNaN() {
+			return nil, notANumber
+		}
+		switch n.IsInf() {
+		case -1:
+			return nil, negativeInfinity
+		case 1:
+			return nil, positiveInfinity
+		}
+		coefficient, exponent, err := n.BigInt()
+		if err != nil {
+			return nil, notANumber
+		}
+		r := new(big.Rat).SetInt(coefficient)
+		scale := new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(abs(exponent))), nil))
+		if exponent < 0 {
+			return r.Quo(r, scale), finite
+		}
+		return r.Mul(r, scale), finite
+	}
+	return nil, notANumber
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+func compareInts(x, y int) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+func compareFloats(x, y float64) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
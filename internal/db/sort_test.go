@@ -0,0 +1,193 @@
+package db
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"path/filepath"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/sfi2k7/mc/internal/storage"
+)
+
+func decimal(t *testing.T, s string) primitive.Decimal128 {
+	t.Helper()
+	d, err := primitive.ParseDecimal128(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestCompareNumbers(t *testing.T) {
+	const large = int64(1) << 60
+	tests := []struct {
+		a, b interface{}
+		want int
+	}{
+		{int32(1), int64(2), -1},
+		{large + 1, large, 1},
+		{large, large + 1, -1},
+		{large, float64(large), 0},
+		{2.5, int32(2), 1},
+		{decimal(t, "1.10"), decimal(t, "1.1"), 0},
+		{decimal(t, "1.11"), decimal(t, "1.1"), 1},
+		{decimal(t, "9999999999999999999"), decimal(t, "1E+19"), -1},
+		{decimal(t, "2.5"), 2.5, 0},
+		{decimal(t, "-1"), int32(0), -1},
+		{math.NaN(), math.Inf(-1), -1},
+		{decimal(t, "NaN"), int32(0), -1},
+		{math.Inf(1), decimal(t, "1E+6000"), 1},
+		{math.NaN(), math.NaN(), 0},
+	}
+	for _, tt := range tests {
+		if got := compareValues(tt.a, tt.b); got != tt.want {
+			t.Errorf("compareValues(%v, %v) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+		if got := compareValues(tt.b, tt.a); got != -tt.want {
+			t.Errorf("compareValues(%v, %v) = %d, want %d", tt.b, tt.a, got, -tt.want)
+		}
+	}
+}
+
+func TestTrackRawMax(t *testing.T) {
+	values := []interface{}{
+		decimal(t, "10.5"), decimal(t, "7"), decimal(t, "10.25"), nil,
+	}
+	var batch [][]byte
+	for _, v := range values {
+		doc := bson.D{{Key: "_id", Value: 1}}
+		if v != nil {
+			doc = append(doc, bson.E{Key: "amount", Value: v})
+		}
+		data, err := bson.Marshal(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		batch = append(batch, data)
+	}
+
+	var result ExportResult
+	trackRawMax(batch, "amount", &result)
+	if result.MaxValue != decimal(t, "10.5") {
+		t.Fatalf("max = %v, want 10.5", result.MaxValue)
+	}
+
+	// Values close to 2^63 differ by less than float64 can tell apart
+	result = ExportResult{}
+	for _, v := range []int64{math.MaxInt64 - 1, math.MaxInt64, math.MaxInt64 - 2} {
+		trackMax(v, &result)
+	}
+	if result.MaxValue != int64(math.MaxInt64) {
+		t.Fatalf("max = %v, want %d", result.MaxValue, int64(math.MaxInt64))
+	}
+}
+
+func TestSortBatch(t *testing.T) {
+	id := func(i int) bson.E { return bson.E{Key: "_id", Value: int32(i)} }
+	batch := []bson.D{
+		{id(0), {Key: "k", Value: "b"}},
+		{id(1), {Key: "k", Value: int32(2)}},
+		{id(2)},
+		{id(3), {Key: "k", Value: "a"}},
+		{id(4), {Key: "k", Value: 1.5}},
+		{id(5), {Key: "k", Value: "a"}},
+		{id(6), {Key: "k", Value: nil}},
+		{id(7)},
+		{id(8), {Key: "k", Value: int64(2)}},
+	}
+	sortBatch(batch, "k")
+
+	// Missing and null fields first, then numbers and strings; equal keys,
+	// including missing and null, keep their cursor order
+	want := []int32{2, 6, 7, 4, 1, 8, 3, 5, 0}
+	for i, doc := range batch {
+		if got := doc[0].Value.(int32); got != want[i] {
+			t.Fatalf("position %d holds document %d, want %d (order %v)", i, got, want[i], ids(batch))
+		}
+	}
+}
+
+func TestSortBatchDottedField(t *testing.T) {
+	batch := []bson.D{
+		{{Key: "_id", Value: int32(0)}, {Key: "a", Value: bson.D{{Key: "b", Value: "z"}}}},
+		{{Key: "_id", Value: int32(1)}, {Key: "a", Value: bson.D{{Key: "b", Value: "y"}}}},
+		{{Key: "_id", Value: int32(2)}, {Key: "a", Value: "not a document"}},
+	}
+	sortBatch(batch, "a.b")
+	if got := ids(batch); fmt.Sprint(got) != "[2 1 0]" {
+		t.Fatalf("order %v, want [2 1 0]", got)
+	}
+}
+
+func ids(batch []bson.D) []int32 {
+	out := make([]int32, len(batch))
+	for i, doc := range batch {
+		out[i] = doc[0].Value.(int32)
+	}
+	return out
+}
+
+// shapedBatch returns documents of many shapes, told apart by a type field,
+// in random order
+func shapedBatch(rng *rand.Rand, size, shapes int) []bson.D {
+	batch := make([]bson.D, size)
+	for i := range batch {
+		shape := rng.Intn(shapes)
+		doc := bson.D{
+			{Key: "_id", Value: primitive.NewObjectID()},
+			{Key: "type", Value: fmt.Sprintf("shape_%03d", shape)},
+		}
+		for f := 0; f < 6; f++ {
+			doc = append(doc, bson.E{Key: fmt.Sprintf("field_%d_%d", shape, f), Value: fmt.Sprintf("value %d of shape %d", f, shape)})
+		}
+		doc = append(doc, bson.E{Key: "n", Value: int32(rng.Intn(1000))})
+		batch[i] = doc
+	}
+	return batch
+}
+
+// compressedSize writes batches to a file and returns the size of the
+// compressed documents
+func compressedSize(t *testing.T, batches [][]bson.D) int64 {
+	t.Helper()
+	writer, err := storage.NewFileWriter(filepath.Join(t.TempDir(), "out"+storage.FileExtension), storage.DefaultCompressionOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+	if err := writer.WriteHeader(storage.Metadata{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, batch := range batches {
+		if err := writer.WriteBatch(batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.WriteFooter(storage.Metadata{}); err != nil {
+		t.Fatal(err)
+	}
+	return writer.Metadata().CompressedSize
+}
+
+func TestSortBatchImprovesCompression(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	var unsorted, sorted [][]bson.D
+	for i := 0; i < 10; i++ {
+		batch := shapedBatch(rng, 1000, 200)
+		unsorted = append(unsorted, batch)
+		copied := append([]bson.D(nil), batch...)
+		sortBatch(copied, "type")
+		sorted = append(sorted, copied)
+	}
+
+	before, after := compressedSize(t, unsorted), compressedSize(t, sorted)
+	t.Logf("10 batches of 1000 documents in 200 shapes: %d bytes unsorted, %d sorted by type (%.0f%% smaller)",
+		before, after, 100*(1-float64(after)/float64(before)))
+	if after >= before {
+		t.Fatalf("sorting did not help: %d bytes sorted, %d unsorted", after, before)
+	}
+}
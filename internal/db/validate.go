@@ -0,0 +1,148 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// BSON validation levels for imported documents
+const (
+	// ValidateStrict rejects documents that fail the checks
+	ValidateStrict = "strict"
+	// ValidateRelaxed counts documents that fail the field checks but
+	// inserts them, leaving the decision to the server
+	ValidateRelaxed = "relaxed"
+	// ValidateOff skips the checks
+	ValidateOff = "off"
+)
+
+// maxDocumentSize is the server's limit on the size of a single document
+const maxDocumentSize = 16 * 1024 * 1024
+
+// ValidValidationLevel reports whether s is a known BSON validation level
+func ValidValidationLevel(s string) bool {
+	return s == ValidateStrict || s == ValidateRelaxed || s == ValidateOff
+}
+
+// validateDocument reports the first problem found in a document: an empty
+// field name, one with a leading $, a dot or a null character, or a value
+// of a deprecated BSON type. With checkSize the document is also
+// re-marshaled and held to the server's size limit.
+func validateDocument(doc bson.D, checkSize bool) error {
+	if err := validateFields(doc, ""); err != nil {
+		return err
+	}
+	if !checkSize {
+		return nil
+	}
+
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return fmt.Errorf("cannot be marshaled: %w", err)
+	}
+	if len(data) > maxDocumentSize {
+		return fmt.Errorf("%d bytes exceeds the %d byte document limit", len(data), maxDocumentSize)
+	}
+	return nil
+}
+
+// validateFields checks the field names and values of an embedded document
+// at path
+func validateFields(doc bson.D, path string) error {
+	for _, elem := range doc {
+		name := path + elem.Key
+		switch {
+		case elem.Key == "":
+			return fmt.Errorf("empty field name in %q", strings.TrimSuffix(path, "."))
+		case strings.HasPrefix(elem.Key, "$"):
+			return fmt.Errorf("field name %q starts with $", name)
+		case strings.Contains(elem.Key, "."):
+			return fmt.Errorf("field name %q contains a dot", name)
+		case strings.ContainsRune(elem.Key, 0):
+			return fmt.Errorf("field name %q contains a null character", name)
+		}
+		if err := validateValue(elem.Value, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateValue checks a value for deprecated types, recursing into
+// embedded documents and arrays
+func validateValue(value interface{}, path string) error {
+	switch v := value.(type) {
+	case bson.D:
+		return validateFields(v, path+".")
+	case bson.A:
+		for i, item := range v {
+			if err := validateValue(item, fmt.Sprintf("%s.%d", path, i)); err != nil {
+				return err
+			}
+		}
+	case primitive.Undefined, primitive.DBPointer, primitive.Symbol:
+		return fmt.Errorf("field %q has the deprecated type %T", path, v)
+	}
+	return nil
+}
+
+// validateRawDocument is validateDocument for a document that has not been
+// decoded; the size check needs no re-marshal
+func validateRawDocument(doc bson.Raw, checkSize bool) error {
+	if err := validateRawFields(doc, ""); err != nil {
+		return err
+	}
+	if checkSize && len(doc) > maxDocumentSize {
+		return fmt.Errorf("%d bytes exceeds the %d byte document limit", len(doc), maxDocumentSize)
+	}
+	return nil
+}
+
+// validateRawFields is validateFields for an undecoded embedded document
+func validateRawFields(doc bson.Raw, path string) error {
+	elems, err := doc.Elements()
+	if err != nil {
+		return fmt.Errorf("cannot be parsed: %w", err)
+	}
+	for _, elem := range elems {
+		key := elem.Key()
+		name := path + key
+		switch {
+		case key == "":
+			return fmt.Errorf("empty field name in %q", strings.TrimSuffix(path, "."))
+		case strings.HasPrefix(key, "$"):
+			return fmt.Errorf("field name %q starts with $", name)
+		case strings.Contains(key, "."):
+			return fmt.Errorf("field name %q contains a dot", name)
+		}
+		if err := validateRawValue(elem.Value(), name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateRawValue is validateValue for an undecoded value
+func validateRawValue(value bson.RawValue, path string) error {
+	switch value.Type {
+	case bsontype.EmbeddedDocument:
+		return validateRawFields(value.Document(), path+".")
+	case bsontype.Array:
+		values, err := value.Array().Values()
+		if err != nil {
+			return fmt.Errorf("cannot be parsed: %w", err)
+		}
+		for i, item := range values {
+			if err := validateRawValue(item, fmt.Sprintf("%s.%d", path, i)); err != nil {
+				return err
+			}
+		}
+	case bsontype.Undefined, bsontype.DBPointer, bsontype.Symbol:
+		return fmt.Errorf("field %q has the deprecated type %s", path, value.Type)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// maxAuxFileSize bounds the decompressed size of an auxiliary file, so a
+// corrupt or hostile archive cannot exhaust memory
+const maxAuxFileSize = 64 << 20
+
+// ReadAuxFile reads a small auxiliary input such as a query file. Files
+// starting with the gzip or zstd magic are decompressed, whatever their
+// extension, so pipelines can keep them compressed.
+func ReadAuxFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	wrapper := wrapperOf(data)
+	if wrapper == "" {
+		return data, nil
+	}
+	decoded, err := unwrapReader(bytes.NewReader(data), wrapper)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	defer decoded.Close()
+
+	out, err := io.ReadAll(io.LimitReader(decoded, maxAuxFileSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("%s: failed to decompress: %w", path, err)
+	}
+	if len(out) > maxAuxFileSize {
+		return nil, fmt.Errorf("%s: decompresses to more than %d bytes", path, maxAuxFileSize)
+	}
+	return out, nil
+}
+
+// Whole-file compression wrappers recognized by their magic bytes
+const (
+	WrapperGzip = "gzip"
+	WrapperZstd = "zstd"
+)
+
+// wrapperOf returns the compression wrapper data starts with, or "" for
+// none. MCBZ files have their own magic, so they are never mistaken for a
+// wrapped file.
+func wrapperOf(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte{0x1f, 0x8b}):
+		return WrapperGzip
+	case bytes.HasPrefix(data, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return WrapperZstd
+	}
+	return ""
+}
+
+// unwrapReader returns a reader of the decompressed content of r
+func unwrapReader(r io.Reader, wrapper string) (io.ReadCloser, error) {
+	switch wrapper {
+	case WrapperGzip:
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzip data: %w", err)
+		}
+		return gz, nil
+	case WrapperZstd:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid zstd data: %w", err)
+		}
+		return zr.IOReadCloser(), nil
+	}
+	return nil, fmt.Errorf("unknown compression wrapper %q", wrapper)
+}
+
+// DetectWrapper reports whether the file at path is compressed as a whole,
+// e.g. an MCBZ file passed through gzip, returning WrapperGzip, WrapperZstd
+// or "" for none
+func DetectWrapper(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	magic := make([]byte, 4)
+	n, err := io.ReadFull(file, magic)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	return wrapperOf(magic[:n]), nil
+}
+
+// UnwrapFile decompresses a file compressed as a whole into a temporary
+// file next to it and returns its path; the caller removes it. Reading an
+// MCBZ file needs seeking, so the content cannot be streamed instead.
+func UnwrapFile(path, wrapper string) (string, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	decoded, err := unwrapReader(in, wrapper)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", path, err)
+	}
+	defer decoded.Close()
+
+	out, err := os.CreateTemp(filepath.Dir(path), ".mc-unwrap-*"+FileExtension)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(out, decoded); err != nil {
+		out.Close()
+		os.Remove(out.Name())
+		return "", fmt.Errorf("%s: failed to decompress: %w", path, err)
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(out.Name())
+		return "", err
+	}
+	return out.Name(), nil
+}
@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+func gzipBytes(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func zstdBytes(t *testing.T, data []byte) []byte {
+	t.Helper()
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encoder.Close()
+	return encoder.EncodeAll(data, nil)
+}
+
+func TestReadAuxFile(t *testing.T) {
+	query := []byte(`{"status": "active", "createdAt": {"$gte": {"$date": "2024-01-01T00:00:00Z"}}}`)
+	corrupt := gzipBytes(t, query)
+	corrupt = corrupt[:len(corrupt)-12]
+	badFrame := zstdBytes(t, query)
+	badFrame[len(badFrame)/2] ^= 0xff
+
+	tests := []struct {
+		name    string
+		content []byte
+		wantErr bool
+	}{
+		{"plain", query, false},
+		{"gzip", gzipBytes(t, query), false},
+		{"zstd", zstdBytes(t, query), false},
+		{"empty", nil, false},
+		{"truncated gzip", corrupt, true},
+		{"corrupt zstd", badFrame, true},
+		{"gzip magic only", []byte{0x1f, 0x8b}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The extension is deliberately misleading: only the content counts
+			path := filepath.Join(t.TempDir(), "query.json")
+			if err := os.WriteFile(path, tt.content, 0644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := ReadAuxFile(path)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := query
+			if tt.content == nil {
+				want = nil
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestReadAuxFileTooLarge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "query.json.gz")
+	if err := os.WriteFile(path, gzipBytes(t, make([]byte, maxAuxFileSize+1)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadAuxFile(path); err == nil {
+		t.Fatal("expected an error for content over the size limit")
+	}
+}
+
+func TestReadAuxFileMissing(t *testing.T) {
+	if _, err := ReadAuxFile(filepath.Join(t.TempDir(), "none.json")); !os.IsNotExist(err) {
+		t.Fatalf("got %v, want a not-exist error", err)
+	}
+}
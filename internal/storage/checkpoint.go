@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// CheckpointExtension is appended to a file name to form the path of its
+// import checkpoint
+const CheckpointExtension = ".checkpoint"
+
+// Checkpoint records how far an import of a file has progressed. The size
+// and export timestamp tie it to one particular file.
+type Checkpoint struct {
+	Database   string `json:"database"`
+	Collection string `json:"collection"`
+	FileSize   int64  `json:"fileSize"`
+	Timestamp  int64  `json:"timestamp"`
+	// Documents is the number of documents from the start of the file
+	// that have been committed
+	Documents int64 `json:"documents"`
+	// BatchSize is the largest batch the import inserts at once. The batch
+	// after Documents may have been inserted before the import stopped.
+	BatchSize int `json:"batchSize,omitempty"`
+}
+
+// Matches reports whether the checkpoint was recorded for the same target
+// and file as other
+func (c Checkpoint) Matches(other Checkpoint) bool {
+	return c.Database == other.Database &&
+		c.Collection == other.Collection &&
+		c.FileSize == other.FileSize &&
+		c.Timestamp == other.Timestamp
+}
+
+// WriteCheckpoint saves a checkpoint next to the file at path. The write
+// goes through a temporary file so a crash never leaves a partial
+// checkpoint behind.
+func WriteCheckpoint(path string, checkpoint Checkpoint) error {
+	data, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+
+	checkpointPath := path + CheckpointExtension
+	tmpPath := checkpointPath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, checkpointPath)
+}
+
+// ReadCheckpoint loads the checkpoint of the file at path. It returns false
+// when there is none.
+func ReadCheckpoint(path string) (Checkpoint, bool, error) {
+	data, err := os.ReadFile(path + CheckpointExtension)
+	if errors.Is(err, os.ErrNotExist) {
+		return Checkpoint{}, false, nil
+	}
+	if err != nil {
+		return Checkpoint{}, false, err
+	}
+
+	var checkpoint Checkpoint
+	if err := json.Unmarshal(data, &checkpoint); err != nil {
+		return Checkpoint{}, false, fmt.Errorf("invalid checkpoint: %w", err)
+	}
+	return checkpoint, true, nil
+}
+
+// RemoveCheckpoint deletes the checkpoint of the file at path, if any
+func RemoveCheckpoint(path string) error {
+	err := os.Remove(path + CheckpointExtension)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
@@ -4,11 +4,100 @@ package storage
 import (
 	"fmt"
 	"io"
+	"os"
+	"runtime"
+	"sort"
 	"strings"
 
 	"github.com/klauspost/compress/zstd"
 )
 
+// Codec is the name of the compression algorithm used for the data region
+const Codec = "zstd"
+
+// Bounds of CompressionOptions.WindowLog, the zstd window sizes from 1 KiB
+// to 512 MiB that the decoder accepts by default
+const (
+	MinWindowLog = 10
+	MaxWindowLog = 29
+)
+
+// CompressionOptions configures the compressor
+type CompressionOptions struct {
+	// Level is a zstd compression level (1-22)
+	Level int
+	// Concurrency is the number of encoder goroutines
+	Concurrency int
+	// WindowLog sets the zstd window to 1<<WindowLog bytes; 0 keeps the
+	// level's default. The compressor holds about twice the window in
+	// memory and readers need the window once, so large windows trade
+	// memory for ratio on data that repeats far apart.
+	WindowLog int
+	// CompressMetadata stores the header metadata block zstd-compressed
+	CompressMetadata bool
+	// Dictionary is a trained zstd dictionary shared by all frames
+	Dictionary []byte
+	// DedupBatches writes a batch identical to the one before it as a
+	// short reference instead of repeating its documents
+	DedupBatches bool
+	// FileMode is the permission of newly created files before the umask
+	// is applied; 0 means 0666 like os.Create
+	FileMode os.FileMode
+	// NoFooterSeek stores the header as a trailer after the data instead of
+	// seeking back to the start of the file, for filesystems that mishandle
+	// the seek. Writers fall back to it when the seek fails.
+	NoFooterSeek bool
+}
+
+// compressionPresets maps human-friendly preset names to encoder settings
+var compressionPresets = map[string]CompressionOptions{
+	"fast":     {Level: 1, Concurrency: runtime.GOMAXPROCS(0)},
+	"balanced": {Level: 3, Concurrency: runtime.GOMAXPROCS(0)},
+	"max":      {Level: 19, Concurrency: runtime.GOMAXPROCS(0)},
+}
+
+// DefaultCompressionOptions returns the settings of the "balanced" preset
+func DefaultCompressionOptions() CompressionOptions {
+	return compressionPresets["balanced"]
+}
+
+// ResolveCompression turns a preset name and an optional explicit level into
+// concrete compressor settings. A non-zero level overrides the preset's level.
+func ResolveCompression(preset string, level int) (CompressionOptions, error) {
+	opts, ok := compressionPresets[strings.ToLower(preset)]
+	if !ok {
+		names := make([]string, 0, len(compressionPresets))
+		for name := range compressionPresets {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return CompressionOptions{}, fmt.Errorf("unknown compression preset %q (expected one of %s)", preset, strings.Join(names, ", "))
+	}
+
+	if level != 0 {
+		if level < 1 || level > 22 {
+			return CompressionOptions{}, fmt.Errorf("invalid compression level %d (expected 1-22)", level)
+		}
+		opts.Level = level
+	}
+
+	return opts, nil
+}
+
+// ValidateWindowLog rejects window logs outside MinWindowLog-MaxWindowLog;
+// 0 selects the default window
+func ValidateWindowLog(windowLog int) error {
+	if windowLog != 0 && (windowLog < MinWindowLog || windowLog > MaxWindowLog) {
+		return fmt.Errorf("invalid window log %d (expected %d-%d)", windowLog, MinWindowLog, MaxWindowLog)
+	}
+	return nil
+}
+
+// EncoderLevel returns the name of the zstd encoder level used for the settings
+func (o CompressionOptions) EncoderLevel() string {
+	return zstd.EncoderLevelFromZstd(o.Level).String()
+}
+
 // Compressor wraps a zstd encoder for writing compressed data
 type Compressor struct {
 	writer *zstd.Encoder
@@ -20,8 +109,21 @@ type Decompressor struct {
 }
 
 // NewCompressor creates a new compressor
-func NewCompressor(w io.Writer) (*Compressor, error) {
-	encoder, err := zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedDefault))
+func NewCompressor(w io.Writer, opts CompressionOptions) (*Compressor, error) {
+	encoderOpts := []zstd.EOption{
+		zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(opts.Level)),
+	}
+	if opts.Concurrency > 0 {
+		encoderOpts = append(encoderOpts, zstd.WithEncoderConcurrency(opts.Concurrency))
+	}
+	if len(opts.Dictionary) > 0 {
+		encoderOpts = append(encoderOpts, zstd.WithEncoderDict(opts.Dictionary))
+	}
+	if opts.WindowLog != 0 {
+		encoderOpts = append(encoderOpts, zstd.WithWindowSize(1<<opts.WindowLog))
+	}
+
+	encoder, err := zstd.NewWriter(w, encoderOpts...)
 	if err != nil {
 		return nil, err
 	}
@@ -33,14 +135,28 @@ func (c *Compressor) Write(p []byte) (n int, err error) {
 	return c.writer.Write(p)
 }
 
+// Flush writes any buffered data as a complete block
+func (c *Compressor) Flush() error {
+	return c.writer.Flush()
+}
+
 // Close finalizes the compressed data
 func (c *Compressor) Close() error {
 	return c.writer.Close()
 }
 
-// NewDecompressor creates a new decompressor
-func NewDecompressor(r io.Reader) (*Decompressor, error) {
-	decoder, err := zstd.NewReader(r)
+// NewDecompressor creates a new decompressor, optionally using a dictionary.
+// A concurrency of 0 uses the decoder's default number of goroutines.
+func NewDecompressor(r io.Reader, dict []byte, concurrency int) (*Decompressor, error) {
+	var decoderOpts []zstd.DOption
+	if concurrency > 0 {
+		decoderOpts = append(decoderOpts, zstd.WithDecoderConcurrency(concurrency))
+	}
+	if len(dict) > 0 {
+		decoderOpts = append(decoderOpts, zstd.WithDecoderDicts(dict))
+	}
+
+	decoder, err := zstd.NewReader(r, decoderOpts...)
 	if err != nil {
 		if strings.Contains(err.Error(), "invalid header") {
 			return nil, fmt.Errorf("invalid input: compressed data is corrupted or not in zstd format")
@@ -60,3 +176,21 @@ func (d *Decompressor) Close() error {
 	d.reader.Close()
 	return nil
 }
+
+// compressBlock compresses a small in-memory block such as the metadata
+func compressBlock(data []byte) []byte {
+	encoder, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	defer encoder.Close()
+	return encoder.EncodeAll(data, nil)
+}
+
+// decompressBlock decompresses a block written by compressBlock, refusing to
+// produce more than maxSize bytes
+func decompressBlock(data []byte, maxSize uint64) ([]byte, error) {
+	decoder, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(maxSize))
+	if err != nil {
+		return nil, err
+	}
+	defer decoder.Close()
+	return decoder.DecodeAll(data, nil)
+}
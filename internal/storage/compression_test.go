@@ -0,0 +1,53 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+// countingWriter counts the bytes written to it and discards them
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// BenchmarkWindowLog compresses a corpus that repeats itself after about
+// 10 MiB, beyond the default window, at several levels and window logs.
+// The ratio shows what the window buys and B/op what it costs.
+func BenchmarkWindowLog(b *testing.B) {
+	var block bytes.Buffer
+	if err := writeStream(&block, marshalDocuments(b, smallDocuments(rand.New(rand.NewSource(1)), 100000))); err != nil {
+		b.Fatal(err)
+	}
+	corpus := append(append([]byte(nil), block.Bytes()...), block.Bytes()...)
+
+	for _, level := range []int{1, 3, 19} {
+		for _, windowLog := range []int{0, 20, 24} {
+			b.Run(fmt.Sprintf("level=%d/window=%d", level, windowLog), func(b *testing.B) {
+				b.SetBytes(int64(len(corpus)))
+				b.ReportAllocs()
+				var out countingWriter
+				for i := 0; i < b.N; i++ {
+					compressor, err := NewCompressor(&out, CompressionOptions{Level: level, Concurrency: 1, WindowLog: windowLog})
+					if err != nil {
+						b.Fatal(err)
+					}
+					if _, err := io.Copy(compressor, bytes.NewReader(corpus)); err != nil {
+						b.Fatal(err)
+					}
+					if err := compressor.Close(); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.ReportMetric(float64(len(corpus))*float64(b.N)/float64(out.n), "ratio")
+			})
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"fmt"
+	"hash/crc32"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// maxDictionaryHistory caps the sample content kept in a dictionary
+	maxDictionaryHistory = 64 * 1024
+	// minDictionarySamples is the fewest documents worth training on
+	minDictionarySamples = 8
+)
+
+// BuildDictionary trains a zstd dictionary from sample documents. The most
+// recent samples up to maxDictionaryHistory bytes become the shared history.
+func BuildDictionary(samples [][]byte, opts CompressionOptions) (dict []byte, err error) {
+	if len(samples) < minDictionarySamples {
+		return nil, fmt.Errorf("not enough samples to train a dictionary: got %d, need at least %d", len(samples), minDictionarySamples)
+	}
+
+	// Find the oldest sample that still fits, then keep samples in order
+	start, size := len(samples), 0
+	for start > 0 && size+len(samples[start-1]) <= maxDictionaryHistory {
+		start--
+		size += len(samples[start])
+	}
+	history := make([]byte, 0, size)
+	for _, sample := range samples[start:] {
+		history = append(history, sample...)
+	}
+	if len(history) == 0 {
+		last := samples[len(samples)-1]
+		history = append(history, last[len(last)-maxDictionaryHistory:]...)
+	}
+
+	// Dictionary IDs must be non-zero; derive one from the content
+	id := crc32.ChecksumIEEE(history) | 1
+
+	// BuildDict panics when the samples produce too few sequences to build
+	// entropy tables from, so report that as an ordinary error
+	defer func() {
+		if r := recover(); r != nil {
+			dict, err = nil, fmt.Errorf("failed to build dictionary: samples too small or too uniform (%v)", r)
+		}
+	}()
+
+	dict, err = zstd.BuildDict(zstd.BuildDictOptions{
+		ID:       id,
+		Contents: samples,
+		History:  history,
+		Offsets:  [3]int{1, 4, 8},
+		Level:    zstd.EncoderLevelFromZstd(opts.Level),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to build dictionary: %w", err)
+	}
+	return dict, nil
+}
@@ -0,0 +1,194 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// smallDocuments returns n tiny documents of one shape, like events or
+// session records
+func smallDocuments(rng *rand.Rand, n int) []bson.D {
+	statuses := []string{"active", "pending", "closed", "archived"}
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	docs := make([]bson.D, n)
+	for i := range docs {
+		docs[i] = bson.D{
+			{Key: "_id", Value: primitive.NewObjectIDFromTimestamp(base.Add(time.Duration(i) * time.Second))},
+			{Key: "user", Value: fmt.Sprintf("user_%05d", rng.Intn(50000))},
+			{Key: "status", Value: statuses[rng.Intn(len(statuses))]},
+			{Key: "score", Value: int32(rng.Intn(1000))},
+			{Key: "createdAt", Value: primitive.NewDateTimeFromTime(base.Add(time.Duration(rng.Intn(86400)) * time.Second))},
+		}
+	}
+	return docs
+}
+
+// marshalDocuments returns docs as BSON
+func marshalDocuments(t testing.TB, docs []bson.D) [][]byte {
+	t.Helper()
+	data := make([][]byte, len(docs))
+	for i, doc := range docs {
+		var err error
+		if data[i], err = bson.Marshal(doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return data
+}
+
+// writeDocuments writes docs in one batch to a new file, with dict if
+// given, then appends each of appends in its own run. It returns the size
+// of the compressed documents, not counting the stored dictionary.
+func writeDocuments(t *testing.T, path string, docs []bson.D, dict []byte, appends ...[]bson.D) int64 {
+	t.Helper()
+	metadata := Metadata{Database: "db", Collection: "events"}
+	writer, err := NewFileWriter(path, DefaultCompressionOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dict != nil {
+		if err := writer.SetDictionary(dict); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.WriteHeader(metadata); err != nil {
+		t.Fatal(err)
+	}
+	for _, batch := range append([][]bson.D{docs}, appends...) {
+		if writer == nil {
+			if writer, err = NewAppendWriter(path, DefaultCompressionOptions()); err != nil {
+				t.Fatal(err)
+			}
+			if err := writer.WriteHeader(metadata); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := writer.WriteBatch(batch); err != nil {
+			t.Fatal(err)
+		}
+		if err := writer.WriteFooter(Metadata{DocumentCount: int64(len(batch))}); err != nil {
+			t.Fatal(err)
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatal(err)
+		}
+		writer = nil
+	}
+
+	reader, err := NewFileReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	stored, err := reader.ReadHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := stored.CompressedSize
+	if dict != nil {
+		size -= int64(4 + len(dict))
+	}
+	return size
+}
+
+// readDocuments returns every document stored in a file, read at most
+// maxBatchSize at a time
+func readDocuments(t *testing.T, path string, maxBatchSize int) []bson.D {
+	t.Helper()
+	reader, err := NewFileReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if _, err := reader.ReadHeader(); err != nil {
+		t.Fatal(err)
+	}
+	var docs []bson.D
+	for {
+		batch, err := reader.ReadBatch(maxBatchSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(batch) == 0 {
+			return docs
+		}
+		docs = append(docs, batch...)
+	}
+}
+
+// The data region is a single zstd stream per run, so a dictionary only
+// helps until the stream has built up its own history: small exports and
+// the small frames of repeated appends, which is what these cases measure.
+// On long streams its benefit fades, and the stored dictionary of up to
+// 64 KiB outweighs it.
+func TestDictionaryImprovesSmallDocuments(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	samples := marshalDocuments(t, smallDocuments(rng, 1000))
+	dict, err := BuildDictionary(samples, DefaultCompressionOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Documents other than the samples, as in a real export
+	var appends [][]bson.D
+	for i := 0; i < 10; i++ {
+		appends = append(appends, smallDocuments(rng, 10))
+	}
+	tests := []struct {
+		name    string
+		docs    []bson.D
+		appends [][]bson.D
+	}{
+		{"small export", smallDocuments(rng, 30), nil},
+		{"repeated appends", smallDocuments(rng, 10), appends},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var want []bson.D
+			for _, batch := range append([][]bson.D{tt.docs}, tt.appends...) {
+				want = append(want, batch...)
+			}
+			wantData := marshalDocuments(t, want)
+			var raw int
+			for _, doc := range wantData {
+				raw += len(doc)
+			}
+
+			dir := t.TempDir()
+			plain := writeDocuments(t, filepath.Join(dir, "plain.mcbz"), tt.docs, nil, tt.appends...)
+			dictPath := filepath.Join(dir, "dict.mcbz")
+			withDict := writeDocuments(t, dictPath, tt.docs, dict, tt.appends...)
+
+			t.Logf("%d documents, %d bytes: %d compressed without a dictionary (%.2f:1), %d with it (%.2f:1)",
+				len(want), raw, plain, float64(raw)/float64(plain), withDict, float64(raw)/float64(withDict))
+			if withDict >= plain {
+				t.Fatalf("dictionary did not help: %d bytes with it, %d without", withDict, plain)
+			}
+
+			// The dictionary is loaded from the file to read it back
+			read := marshalDocuments(t, readDocuments(t, dictPath, 1000))
+			if len(read) != len(wantData) {
+				t.Fatalf("read %d documents, want %d", len(read), len(wantData))
+			}
+			for i := range wantData {
+				if !bytes.Equal(read[i], wantData[i]) {
+					t.Fatalf("document %d differs after the round trip", i)
+				}
+			}
+		})
+	}
+}
+
+func TestBuildDictionaryTooFewSamples(t *testing.T) {
+	samples := marshalDocuments(t, smallDocuments(rand.New(rand.NewSource(1)), minDictionarySamples-1))
+	if _, err := BuildDictionary(samples, DefaultCompressionOptions()); err == nil {
+		t.Fatal("expected an error")
+	}
+}
@@ -0,0 +1,17 @@
+package storage
+
+import "errors"
+
+var (
+	// ErrInvalidMagic indicates the file does not start with the MCBZ magic number
+	ErrInvalidMagic = errors.New("invalid file format")
+	// ErrUnsupportedVersion indicates the file was written with an unknown format version
+	ErrUnsupportedVersion = errors.New("unsupported file version")
+	// ErrMetadataTooLarge indicates the metadata block exceeds the allowed size
+	ErrMetadataTooLarge = errors.New("metadata too large")
+	// ErrCorruptBatch indicates a batch could not be decoded from the data region
+	ErrCorruptBatch = errors.New("corrupt batch")
+	// ErrDataRegionMismatch indicates the file does not end where the header
+	// says the data region ends
+	ErrDataRegionMismatch = errors.New("data region mismatch")
+)
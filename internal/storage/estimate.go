@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+)
+
+// estimateGroups is the number of groups the sample is split into to
+// measure how much the compression ratio varies
+const estimateGroups = 10
+
+// CompressionEstimate describes how well a sample of documents compresses
+type CompressionEstimate struct {
+	// Documents is the number of sampled documents
+	Documents int
+	// RawBytes is the size of the sample in the file's batch framing, with
+	// the length prefix of each document
+	RawBytes int64
+	// SizeStdDev is the standard deviation of the framed document size
+	SizeStdDev float64
+	// CompressedBytes is the size of the sample compressed as one stream
+	CompressedBytes int64
+	// Ratio is CompressedBytes / RawBytes
+	Ratio float64
+	// groupRatio is the mean ratio of the sample compressed in
+	// estimateGroups separate parts, and margin is the 95% confidence
+	// margin of Ratio from their spread. Both are zero when the sample is
+	// too small to split.
+	groupRatio float64
+	margin     float64
+}
+
+// RatioRange returns the likely range of the compression ratio of an export
+// of total documents. The high end is the sample's ratio plus its sampling
+// margin. The low end also extrapolates how much better the sample
+// compressed as one stream than in groups a tenth its size, since a full
+// export is a much longer stream; data that repeats across documents
+// benefits most.
+func (e CompressionEstimate) RatioRange(total int64) (low, high float64) {
+	low, high = e.Ratio-e.margin, e.Ratio+e.margin
+	if e.groupRatio > e.Ratio && total > int64(e.Documents) {
+		growth := math.Log10(float64(total) / float64(e.Documents))
+		low *= math.Pow(e.Ratio/e.groupRatio, growth)
+	}
+	return math.Max(low, 0), high
+}
+
+// EstimateCompression compresses sample documents the way an export writes
+// them and reports the ratio achieved
+func EstimateCompression(samples [][]byte, opts CompressionOptions) (CompressionEstimate, error) {
+	var estimate CompressionEstimate
+	if len(samples) == 0 {
+		return estimate, fmt.Errorf("no documents to sample")
+	}
+
+	raw, compressed, err := compressSample(samples, opts)
+	if err != nil {
+		return estimate, err
+	}
+	sizes := make([]float64, len(samples))
+	for i, data := range samples {
+		sizes[i] = float64(len(data) + 4)
+	}
+	estimate.Documents = len(samples)
+	estimate.RawBytes = raw
+	estimate.SizeStdDev = stdDev(sizes)
+	estimate.CompressedBytes = compressed
+	estimate.Ratio = float64(compressed) / float64(raw)
+
+	groups := estimateGroups
+	if len(samples) < 2*groups {
+		return estimate, nil
+	}
+	ratios := make([]float64, groups)
+	for i := range ratios {
+		group := samples[i*len(samples)/groups : (i+1)*len(samples)/groups]
+		raw, compressed, err := compressSample(group, opts)
+		if err != nil {
+			return estimate, err
+		}
+		ratios[i] = float64(compressed) / float64(raw)
+	}
+	for _, ratio := range ratios {
+		estimate.groupRatio += ratio / float64(groups)
+	}
+	estimate.margin = 1.96 * stdDev(ratios) / math.Sqrt(float64(groups))
+	return estimate, nil
+}
+
+// compressSample returns the framed and the compressed size of documents
+// written as one batch
+func compressSample(docs [][]byte, opts CompressionOptions) (raw, compressed int64, err error) {
+	length := make([]byte, 4)
+	byteOrder.PutUint32(length, uint32(len(docs)))
+	framed := append([]byte(nil), length...)
+	for _, data := range docs {
+		byteOrder.PutUint32(length, uint32(len(data)))
+		framed = append(framed, length...)
+		framed = append(framed, data...)
+	}
+
+	var buf bytes.Buffer
+	compressor, err := NewCompressor(&buf, opts)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to create compressor: %w", err)
+	}
+	if _, err := compressor.Write(framed); err != nil {
+		return 0, 0, fmt.Errorf("failed to compress sample: %w", err)
+	}
+	if err := compressor.Close(); err != nil {
+		return 0, 0, fmt.Errorf("failed to compress sample: %w", err)
+	}
+	return int64(len(framed)), int64(buf.Len()), nil
+}
+
+// stdDev returns the sample standard deviation of values
+func stdDev(values []float64) float64 {
+	if len(values) < 2 {
+		return 0
+	}
+	var mean float64
+	for _, v := range values {
+		mean += v
+	}
+	mean /= float64(len(values))
+	var sum float64
+	for _, v := range values {
+		sum += (v - mean) * (v - mean)
+	}
+	return math.Sqrt(sum / float64(len(values)-1))
+}
@@ -4,21 +4,82 @@
 package storage
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
 	"fmt"
 	"io"
 	"os"
 
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+// FileExtension is the canonical extension of MCBZ files. Readers identify
+// files by their magic number, so any extension is accepted.
+const FileExtension = ".mcbz"
+
 const (
 	// Magic number for file format identification
 	magicNumber = "MCBZ"
 	// Version of the file format
-	fileVersion = 1
+	fileVersion = 2
+	// Version written when the data region contains batch references.
+	// The layout matches version 2; the bump makes older readers refuse
+	// the file instead of misreading it.
+	batchRefsVersion = 3
+	// Space reserved at the start of version 1 files for the header
+	// (magic + version + metadata length + metadata). The first writer
+	// reserved only 100 bytes for metadata without bumping the version,
+	// but its metadata never took less than 171 bytes and overwrote the
+	// start of the zstd frame, so no readable file with that layout
+	// exists; such files fail to decompress.
+	v1HeaderSize = 4 + 1 + 4 + 4096
+	// Fixed part of the version 2 header
+	// (magic + version + flags + data offset + metadata length)
+	headerPrefixSize = 4 + 1 + 1 + 4 + 4
+	// Space reserved at the start of new files for the header
+	defaultHeaderSize = 16 * 1024
+	// Maximum size of the decoded metadata block
+	maxMetadataSize = 16 * 1024 * 1024
+	// trailerMagic ends a file whose header was written after the data
+	// region because the writer could not seek back to the start
+	trailerMagic = "MCBT"
+	// trailerFooterSize is the fixed end of such a file
+	// (header length + trailer magic)
+	trailerFooterSize = 4 + 4
+	// ioBufferSize is the buffer between the zstd stream and the file, so
+	// compressed blocks reach the file in large writes and reads
+	ioBufferSize = 1024 * 1024
 )
 
+// Header flags
+const (
+	// flagCompressedMetadata marks a zstd-compressed metadata block
+	flagCompressedMetadata = 1 << 0
+	// flagDictionary marks a zstd dictionary at the start of the data region
+	flagDictionary = 1 << 1
+	// flagBatchRefs marks a data region that may contain batch references
+	flagBatchRefs = 1 << 2
+	// flagOplog marks a file of oplog entries rather than documents, so
+	// readers that cannot replay them refuse the file
+	flagOplog = 1 << 3
+	// knownFlags are the flags this version understands
+	knownFlags = flagCompressedMetadata | flagDictionary | flagBatchRefs | flagOplog
+)
+
+// batchRepeatMarker replaces the document count of a batch that repeats
+// the previous batch; no documents follow it
+const batchRepeatMarker = 0xFFFFFFFF
+
+// maxDictionarySize caps the dictionary stored in a file
+const maxDictionarySize = 1024 * 1024
+
+// FormatOplog is the Format of files holding oplog entries of one
+// namespace instead of its documents
+const FormatOplog = "oplog"
+
 // Use a consistent byte order across all architectures
 var byteOrder = binary.LittleEndian
 
@@ -31,13 +92,55 @@ type Metadata struct {
 	Source         string
 	OriginalSize   int64
 	CompressedSize int64
+	// Options are the collection options reported by listCollections
+	Options bson.D
+	// Indexes are the collection's index specifications, without _id
+	Indexes []bson.D
+	// CollectionUUID is the 16-byte UUID listCollections reported for the
+	// source collection, empty when it was not captured
+	CollectionUUID []byte
+	// Part is the 1-based volume number of a split export, 0 otherwise
+	Part int
+	// Codec and Level describe the compression of the data region. Files
+	// written before they were recorded leave them empty.
+	Codec string
+	Level int
+	// Writer names the tool version that wrote the file, e.g. "mc 1.2.3"
+	Writer string
+	// Format is FormatOplog for oplog exports and empty for documents
+	Format string
+	// OplogEnd is the timestamp of the last oplog entry an oplog export
+	// covered, from which the next one continues
+	OplogEnd primitive.Timestamp
+}
+
+// fileHeader holds the layout information from the start of the file
+type fileHeader struct {
+	version    byte
+	flags      byte
+	dataOffset int64
 }
 
 // FileWriter handles writing data to the export file
 type FileWriter struct {
-	file       *os.File
-	compressor *Compressor
-	metadata   Metadata
+	file *os.File
+	// buf buffers the compressed stream; it must be flushed before the
+	// file is seeked or its size is taken
+	buf              *bufio.Writer
+	compressor       *Compressor
+	metadata         Metadata
+	opts             CompressionOptions
+	dataOffset       int64
+	compressMetadata bool
+	hasDictionary    bool
+	hasBatchRefs     bool
+	lastBatchHash    []byte
+	appending        bool
+	baseCount        int64
+	appendAt         int64
+	// trailerSize is the size of the header written as a trailer, 0 when
+	// the header is at the start of the file
+	trailerSize int64
 }
 
 // FileReader handles reading data from the export file
@@ -45,45 +148,267 @@ type FileReader struct {
 	file         *os.File
 	decompressor *Decompressor
 	metadata     Metadata
+	header       fileHeader
+	// concurrency is the number of decoder goroutines, 0 for the default
+	concurrency int
+	// pending is the number of documents left in the stored batch
+	// currently being read
+	pending int
+	// lastBatch holds the documents of the latest stored batch when the
+	// file contains batch references; replayNext is the position in it
+	// while a reference is being expanded
+	lastBatch  [][]byte
+	replaying  bool
+	replayNext int
+	// bytesRead counts document bytes as OriginalSize does
+	bytesRead int64
+	// input counts the bytes of the data region handed to the decoder
+	input *countingReader
+	// trailerSize is the size of the header trailer, 0 when the header is
+	// at the start of the file
+	trailerSize int64
 }
 
 // NewFileWriter creates a new file writer
-func NewFileWriter(path string) (*FileWriter, error) {
-	file, err := os.Create(path)
+func NewFileWriter(path string, opts CompressionOptions) (*FileWriter, error) {
+	mode := opts.FileMode
+	if mode == 0 {
+		mode = 0666
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, mode)
 	if err != nil {
 		return nil, err
 	}
 
-	// Reserve space for the header (will be written later)
-	headerSize := 4 + 1 + 4 + 100 // magic + version + metadata length + estimated metadata
-	if _, err := file.Seek(int64(headerSize), io.SeekStart); err != nil {
+	// Reserve space for the header (will be written later). Without
+	// footer seeks the space is filled with zeros, which also tells
+	// readers to look for the header at the end.
+	if opts.NoFooterSeek {
+		_, err = file.Write(make([]byte, defaultHeaderSize))
+	} else {
+		_, err = file.Seek(defaultHeaderSize, io.SeekStart)
+	}
+	if err != nil {
 		file.Close()
 		return nil, err
 	}
 
-	compressor, err := NewCompressor(file)
+	buf := bufio.NewWriterSize(file, ioBufferSize)
+	compressor, err := NewCompressor(buf, opts)
 	if err != nil {
 		file.Close()
 		return nil, err
 	}
 
 	return &FileWriter{
-		file:       file,
-		compressor: compressor,
+		file:             file,
+		buf:              buf,
+		compressor:       compressor,
+		opts:             opts,
+		dataOffset:       defaultHeaderSize,
+		compressMetadata: opts.CompressMetadata,
 	}, nil
 }
 
+// NewAppendWriter opens an existing export file so that more batches can be
+// appended to it. The data region is extended in place and the header is
+// rewritten with the combined totals by WriteFooter.
+func NewAppendWriter(path string, opts CompressionOptions) (*FileWriter, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if hasTrailer(file) {
+		file.Close()
+		return nil, fmt.Errorf("cannot append to a file whose header is stored as a trailer")
+	}
+	metadata, header, err := readHeader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	// Position at the end of the existing data region, discarding anything
+	// past it (e.g. a partial write from an interrupted run)
+	dataEnd := header.dataOffset + metadata.CompressedSize
+
+	// New frames must use the dictionary the file was written with
+	if header.flags&flagDictionary != 0 {
+		if _, err := file.Seek(header.dataOffset, io.SeekStart); err != nil {
+			file.Close()
+			return nil, err
+		}
+		dict, err := readDictionary(file)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		opts.Dictionary = dict
+	}
+
+	if err := file.Truncate(dataEnd); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err := file.Seek(dataEnd, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	// Each append writes a new zstd frame; the decoder reads concatenated
+	// frames as a single stream
+	buf := bufio.NewWriterSize(file, ioBufferSize)
+	compressor, err := NewCompressor(buf, opts)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	// The header is rewritten in the current format, keeping the
+	// existing data offset
+	return &FileWriter{
+		file:             file,
+		buf:              buf,
+		compressor:       compressor,
+		metadata:         metadata,
+		opts:             opts,
+		dataOffset:       header.dataOffset,
+		compressMetadata: opts.CompressMetadata || header.flags&flagCompressedMetadata != 0,
+		hasDictionary:    header.flags&flagDictionary != 0,
+		hasBatchRefs:     header.flags&flagBatchRefs != 0,
+		appending:        true,
+		baseCount:        metadata.DocumentCount,
+		appendAt:         dataEnd,
+	}, nil
+}
+
+// Metadata returns the writer's current metadata. For an append writer this
+// starts out as the metadata of the existing file.
+func (w *FileWriter) Metadata() Metadata {
+	return w.metadata
+}
+
+// BytesWritten returns the total size of the file on disk, including the
+// header. It is only final after WriteFooter.
+func (w *FileWriter) BytesWritten() int64 {
+	return w.dataOffset + w.metadata.CompressedSize + w.trailerSize
+}
+
+// WroteTrailer reports whether WriteFooter stored the header as a trailer
+// after the data instead of at the start of the file
+func (w *FileWriter) WroteTrailer() bool {
+	return w.trailerSize > 0
+}
+
+// Size flushes buffered compressed data and returns the current size of
+// the file on disk
+func (w *FileWriter) Size() (int64, error) {
+	if w.compressor != nil {
+		if err := w.compressor.Flush(); err != nil {
+			return 0, err
+		}
+	}
+	if err := w.buf.Flush(); err != nil {
+		return 0, err
+	}
+	return w.file.Seek(0, io.SeekCurrent)
+}
+
+// SetDictionary makes the writer compress with a trained zstd dictionary.
+// The dictionary is stored at the start of the data region, so it must be
+// set on a new file before any batch is written.
+func (w *FileWriter) SetDictionary(dict []byte) error {
+	if w.appending || w.metadata.OriginalSize > 0 {
+		return fmt.Errorf("a dictionary can only be set before writing data to a new file")
+	}
+	if len(dict) > maxDictionarySize {
+		return fmt.Errorf("dictionary too large: %d bytes (max %d)", len(dict), maxDictionarySize)
+	}
+
+	// Replace the compressor; nothing has been written through it yet
+	w.compressor.Close()
+	if err := w.buf.Flush(); err != nil {
+		return err
+	}
+	if _, err := w.file.Seek(w.dataOffset, io.SeekStart); err != nil {
+		return err
+	}
+	if err := w.file.Truncate(w.dataOffset); err != nil {
+		return err
+	}
+
+	lengthBytes := make([]byte, 4)
+	byteOrder.PutUint32(lengthBytes, uint32(len(dict)))
+	if _, err := w.file.Write(lengthBytes); err != nil {
+		return err
+	}
+	if _, err := w.file.Write(dict); err != nil {
+		return err
+	}
+
+	w.opts.Dictionary = dict
+	compressor, err := NewCompressor(w.buf, w.opts)
+	if err != nil {
+		return err
+	}
+	w.compressor = compressor
+	w.hasDictionary = true
+	return nil
+}
+
 // WriteHeader writes the file header with metadata
 func (w *FileWriter) WriteHeader(metadata Metadata) error {
+	if w.appending {
+		// Only allow extending a file with data from the same collection
+		if metadata.Database != w.metadata.Database || metadata.Collection != w.metadata.Collection {
+			return fmt.Errorf("cannot append %s.%s to a file containing %s.%s",
+				metadata.Database, metadata.Collection, w.metadata.Database, w.metadata.Collection)
+		}
+		if metadata.Format != w.metadata.Format {
+			return fmt.Errorf("cannot append to a file of format %q with format %q", w.metadata.Format, metadata.Format)
+		}
+		w.metadata.Timestamp = metadata.Timestamp
+		w.metadata.Source = metadata.Source
+		w.metadata.Writer = metadata.Writer
+		return nil
+	}
+
 	w.metadata = metadata
+	w.metadata.Codec = Codec
+	w.metadata.Level = w.opts.Level
 
 	// We'll actually write the full header when closing the file
 	// because we need final document count and size information
 	return nil
 }
 
-// WriteBatch writes a batch of BSON documents to the file
+// WriteBatch writes a batch of BSON documents to the file. All documents
+// are marshaled before anything is written, so a failure leaves the file
+// unchanged.
 func (w *FileWriter) WriteBatch(batch []bson.D) error {
+	raw := make([][]byte, len(batch))
+	for i, doc := range batch {
+		data, err := bson.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		raw[i] = data
+	}
+	return w.WriteRawBatch(raw)
+}
+
+// WriteRawBatch writes a batch of already marshaled BSON documents
+func (w *FileWriter) WriteRawBatch(batch [][]byte) error {
+	if w.opts.DedupBatches {
+		hash := batchHash(batch)
+		repeated := bytes.Equal(hash, w.lastBatchHash)
+		w.lastBatchHash = hash
+		if repeated {
+			return w.writeBatchReference(batch)
+		}
+	}
+
 	// Write batch length
 	batchLengthBytes := make([]byte, 4)
 	byteOrder.PutUint32(batchLengthBytes, uint32(len(batch)))
@@ -92,12 +417,7 @@ func (w *FileWriter) WriteBatch(batch []bson.D) error {
 	}
 
 	// Write each document
-	for _, doc := range batch {
-		data, err := bson.Marshal(doc)
-		if err != nil {
-			return err
-		}
-
+	for _, data := range batch {
 		// Write document length and data
 		docLengthBytes := make([]byte, 4)
 		byteOrder.PutUint32(docLengthBytes, uint32(len(data)))
@@ -117,18 +437,47 @@ func (w *FileWriter) WriteBatch(batch []bson.D) error {
 	return nil
 }
 
+// writeBatchReference writes a marker standing for a repeat of the previous
+// batch. The documents still count towards the original size.
+func (w *FileWriter) writeBatchReference(batch [][]byte) error {
+	marker := make([]byte, 4)
+	byteOrder.PutUint32(marker, batchRepeatMarker)
+	if _, err := w.compressor.Write(marker); err != nil {
+		return err
+	}
+	for _, data := range batch {
+		w.metadata.OriginalSize += int64(len(data) + 4)
+	}
+	w.hasBatchRefs = true
+	return nil
+}
+
+// batchHash returns a SHA-256 over the documents of a batch
+func batchHash(batch [][]byte) []byte {
+	h := sha256.New()
+	length := make([]byte, 4)
+	for _, data := range batch {
+		byteOrder.PutUint32(length, uint32(len(data)))
+		h.Write(length)
+		h.Write(data)
+	}
+	return h.Sum(nil)
+}
+
 // WriteFooter finalizes the file by writing the footer
 func (w *FileWriter) WriteFooter(metadata Metadata) error {
 	// Update metadata
-	w.metadata.DocumentCount = metadata.DocumentCount
+	w.metadata.DocumentCount = w.baseCount + metadata.DocumentCount
+	if !metadata.OplogEnd.IsZero() {
+		w.metadata.OplogEnd = metadata.OplogEnd
+	}
 
 	// Flush and close the compressor
-	originalPosition, err := w.file.Seek(0, io.SeekCurrent)
-	if err != nil {
+	if err := w.compressor.Close(); err != nil {
 		return err
 	}
-
-	if err := w.compressor.Close(); err != nil {
+	w.compressor = nil
+	if err := w.buf.Flush(); err != nil {
 		return err
 	}
 
@@ -137,58 +486,140 @@ func (w *FileWriter) WriteFooter(metadata Metadata) error {
 	if err != nil {
 		return err
 	}
-	w.metadata.CompressedSize = endPosition - int64(4+1+4+100) // Subtract header size
+	w.metadata.CompressedSize = endPosition - w.dataOffset
+
+	// With no documents nothing was written past the reserved header
+	// space, so the file must be extended to where the data region starts
+	if info, err := w.file.Stat(); err != nil {
+		return err
+	} else if info.Size() < endPosition {
+		if err := w.file.Truncate(endPosition); err != nil {
+			return err
+		}
+	}
+
+	header, err := w.encodeHeader()
+	if err != nil {
+		return err
+	}
 
-	// Go back to the beginning to write the header
+	// Go back to the beginning to write the header. When that is not
+	// possible, the header follows the data instead.
+	if w.opts.NoFooterSeek {
+		return w.writeTrailer(header)
+	}
 	if _, err := w.file.Seek(0, io.SeekStart); err != nil {
+		// An appended file already has its header at the start
+		if w.appending {
+			return err
+		}
+		return w.writeTrailer(header)
+	}
+	if _, err := w.file.Write(header); err != nil {
 		return err
 	}
 
-	// Write magic number
-	if _, err := w.file.Write([]byte(magicNumber)); err != nil {
+	// Go back to the end of the data
+	if _, err := w.file.Seek(endPosition, io.SeekStart); err != nil {
 		return err
 	}
 
-	// Write version
-	if _, err := w.file.Write([]byte{fileVersion}); err != nil {
+	return nil
+}
+
+// writeTrailer writes the header after the data region, followed by its
+// length and the trailer magic. The reserved space at the start of the
+// file must still be zero.
+func (w *FileWriter) writeTrailer(header []byte) error {
+	footer := make([]byte, trailerFooterSize)
+	byteOrder.PutUint32(footer[:4], uint32(len(header)))
+	copy(footer[4:], trailerMagic)
+	if _, err := w.file.Write(append(header, footer...)); err != nil {
 		return err
 	}
+	w.trailerSize = int64(len(header) + trailerFooterSize)
+	return nil
+}
 
-	// Marshal metadata
-	metadataDoc := bson.D{
-		{Key: "database", Value: w.metadata.Database},
-		{Key: "collection", Value: w.metadata.Collection},
-		{Key: "documentCount", Value: w.metadata.DocumentCount},
-		{Key: "timestamp", Value: w.metadata.Timestamp},
-		{Key: "source", Value: w.metadata.Source},
-		{Key: "originalSize", Value: w.metadata.OriginalSize},
-		{Key: "compressedSize", Value: w.metadata.CompressedSize},
-		{Key: "architecture", Value: "cross-platform"}, // Add this to indicate cross-platform compatibility
+// hasTrailer reports whether a file starts with the zeroed header space of
+// a file whose header is stored as a trailer
+func hasTrailer(file io.ReaderAt) bool {
+	magic := make([]byte, len(magicNumber))
+	if _, err := file.ReadAt(magic, 0); err != nil {
+		return false
 	}
+	return bytes.Equal(magic, make([]byte, len(magicNumber)))
+}
 
-	metadataBytes, err := bson.Marshal(metadataDoc)
+// readTrailer reads the header stored at the end of a file
+func readTrailer(file *os.File) (Metadata, fileHeader, int64, error) {
+	info, err := file.Stat()
 	if err != nil {
-		return err
+		return Metadata{}, fileHeader{}, 0, err
+	}
+	if info.Size() < defaultHeaderSize+trailerFooterSize {
+		return Metadata{}, fileHeader{}, 0, fmt.Errorf("%w: file starts with zeros and is too short for a header trailer", ErrInvalidMagic)
+	}
+	footer := make([]byte, trailerFooterSize)
+	if _, err := file.ReadAt(footer, info.Size()-trailerFooterSize); err != nil {
+		return Metadata{}, fileHeader{}, 0, err
+	}
+	if string(footer[4:]) != trailerMagic {
+		return Metadata{}, fileHeader{}, 0, fmt.Errorf("%w: file starts with zeros but has no header trailer; the export was probably interrupted", ErrInvalidMagic)
 	}
+	headerLength := int64(byteOrder.Uint32(footer[:4]))
+	start := info.Size() - trailerFooterSize - headerLength
+	if start < defaultHeaderSize {
+		return Metadata{}, fileHeader{}, 0, fmt.Errorf("%w: header trailer of %d bytes does not fit the file", ErrMetadataTooLarge, headerLength)
+	}
+	metadata, header, err := readHeader(io.NewSectionReader(file, start, headerLength))
+	if err != nil {
+		return Metadata{}, fileHeader{}, 0, err
+	}
+	return metadata, header, headerLength + trailerFooterSize, nil
+}
 
-	// Write metadata length
-	metadataLengthBytes := make([]byte, 4)
-	byteOrder.PutUint32(metadataLengthBytes, uint32(len(metadataBytes)))
-	if _, err := w.file.Write(metadataLengthBytes); err != nil {
-		return err
+// encodeHeader builds the header: magic number, version, flags, data
+// offset, metadata length and the (optionally compressed) metadata
+func (w *FileWriter) encodeHeader() ([]byte, error) {
+	metadataBytes, err := bson.Marshal(metadataToDoc(w.metadata))
+	if err != nil {
+		return nil, err
 	}
 
-	// Write metadata
-	if _, err := w.file.Write(metadataBytes); err != nil {
-		return err
+	var flags byte
+	if w.compressMetadata {
+		metadataBytes = compressBlock(metadataBytes)
+		flags |= flagCompressedMetadata
+	}
+	if w.hasDictionary {
+		flags |= flagDictionary
+	}
+	if w.metadata.Format == FormatOplog {
+		flags |= flagOplog
+	}
+	version := byte(fileVersion)
+	if w.hasBatchRefs {
+		flags |= flagBatchRefs
+		version = batchRefsVersion
 	}
 
-	// Go back to where we were
-	if _, err := w.file.Seek(originalPosition, io.SeekStart); err != nil {
-		return err
+	available := w.dataOffset - headerPrefixSize
+	if int64(len(metadataBytes)) > available {
+		hint := ""
+		if !w.compressMetadata {
+			hint = " (try --compress-metadata)"
+		}
+		return nil, fmt.Errorf("%w: %d bytes (max %d)%s", ErrMetadataTooLarge, len(metadataBytes), available, hint)
 	}
 
-	return nil
+	header := make([]byte, headerPrefixSize, headerPrefixSize+len(metadataBytes))
+	copy(header, magicNumber)
+	header[4] = version
+	header[5] = flags
+	byteOrder.PutUint32(header[6:10], uint32(w.dataOffset))
+	byteOrder.PutUint32(header[10:14], uint32(len(metadataBytes)))
+	return append(header, metadataBytes...), nil
 }
 
 // Close closes the file writer
@@ -196,9 +627,18 @@ func (w *FileWriter) Close() error {
 	if w.compressor != nil {
 		w.compressor.Close()
 		w.compressor = nil
+		w.buf.Flush()
+
+		// An unfinished append must not leave data past the region
+		// described by the header
+		if w.appending {
+			w.file.Truncate(w.appendAt)
+		}
 	}
 	if w.file != nil {
-		return w.file.Close()
+		err := w.file.Close()
+		w.file = nil
+		return err
 	}
 	return nil
 }
@@ -218,113 +658,472 @@ func NewFileReader(path string) (*FileReader, error) {
 	return reader, nil
 }
 
+// SetConcurrency sets the number of decoder goroutines. It must be called
+// before ReadHeader; 0 keeps the decoder's default.
+func (r *FileReader) SetConcurrency(n int) {
+	r.concurrency = n
+}
+
 // ReadHeader reads the file header with metadata
 func (r *FileReader) ReadHeader() (Metadata, error) {
+	var (
+		metadata Metadata
+		header   fileHeader
+		err      error
+	)
+	if hasTrailer(r.file) {
+		metadata, header, r.trailerSize, err = readTrailer(r.file)
+	} else {
+		metadata, header, err = readHeader(r.file)
+	}
+	if err != nil {
+		return Metadata{}, err
+	}
+	r.metadata = metadata
+	r.header = header
+
+	// Skip the rest of the reserved header space
+	if _, err := r.file.Seek(header.dataOffset, io.SeekStart); err != nil {
+		return Metadata{}, err
+	}
+
+	// Load the dictionary stored ahead of the compressed stream
+	var dict []byte
+	if header.flags&flagDictionary != 0 {
+		dict, err = readDictionary(r.file)
+		if err != nil {
+			return Metadata{}, err
+		}
+	}
+
+	// Initialize decompressor
+	position, err := r.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return Metadata{}, err
+	}
+	// Keep the decoder from reading into a header trailer
+	var data io.Reader = r.file
+	if r.trailerSize > 0 {
+		data = io.LimitReader(r.file, header.dataOffset+metadata.CompressedSize-position)
+	}
+	r.input = &countingReader{r: data, n: position}
+	decompressor, err := NewDecompressor(bufio.NewReaderSize(r.input, ioBufferSize), dict, r.concurrency)
+	if err != nil {
+		return Metadata{}, err
+	}
+	r.decompressor = decompressor
+
+	return r.metadata, nil
+}
+
+// readHeader parses the magic number, version and metadata block. Both the
+// version 1 layout and the current layout are supported.
+func readHeader(file io.Reader) (Metadata, fileHeader, error) {
 	// Read magic number
 	magicBytes := make([]byte, 4)
-	if _, err := io.ReadFull(r.file, magicBytes); err != nil {
-		return Metadata{}, err
+	if _, err := io.ReadFull(file, magicBytes); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return Metadata{}, fileHeader{}, fmt.Errorf("%w: file is too short", ErrInvalidMagic)
+		}
+		return Metadata{}, fileHeader{}, err
 	}
 	if string(magicBytes) != magicNumber {
-		return Metadata{}, fmt.Errorf("invalid file format: expected %s, got %s", magicNumber, string(magicBytes))
+		return Metadata{}, fileHeader{}, fmt.Errorf("%w: expected %s, got %s", ErrInvalidMagic, magicNumber, describeMagic(magicBytes))
 	}
 
 	// Read version
 	versionByte := make([]byte, 1)
-	if _, err := io.ReadFull(r.file, versionByte); err != nil {
-		return Metadata{}, err
+	if _, err := io.ReadFull(file, versionByte); err != nil {
+		return Metadata{}, fileHeader{}, err
 	}
-	if versionByte[0] != fileVersion {
-		return Metadata{}, fmt.Errorf("unsupported file version: %d", versionByte[0])
+	header := fileHeader{version: versionByte[0]}
+
+	switch header.version {
+	case 1:
+		header.dataOffset = v1HeaderSize
+	case fileVersion, batchRefsVersion:
+		// Read flags and data offset
+		layoutBytes := make([]byte, 5)
+		if _, err := io.ReadFull(file, layoutBytes); err != nil {
+			return Metadata{}, fileHeader{}, err
+		}
+		header.flags = layoutBytes[0]
+		header.dataOffset = int64(byteOrder.Uint32(layoutBytes[1:]))
+		if header.flags&^knownFlags != 0 {
+			return Metadata{}, fileHeader{}, fmt.Errorf("%w: unknown header flags %#x", ErrUnsupportedVersion, header.flags&^knownFlags)
+		}
+	default:
+		return Metadata{}, fileHeader{}, fmt.Errorf("%w: %d", ErrUnsupportedVersion, header.version)
 	}
 
 	// Read metadata length
 	metadataLengthBytes := make([]byte, 4)
-	if _, err := io.ReadFull(r.file, metadataLengthBytes); err != nil {
-		return Metadata{}, err
+	if _, err := io.ReadFull(file, metadataLengthBytes); err != nil {
+		return Metadata{}, fileHeader{}, err
 	}
 	metadataLength := byteOrder.Uint32(metadataLengthBytes)
+	if int64(metadataLength) > header.dataOffset {
+		return Metadata{}, fileHeader{}, fmt.Errorf("%w: %d bytes exceeds the header size %d", ErrMetadataTooLarge, metadataLength, header.dataOffset)
+	}
 
 	// Read metadata
 	metadataBytes := make([]byte, metadataLength)
-	if _, err := io.ReadFull(r.file, metadataBytes); err != nil {
-		return Metadata{}, err
+	if _, err := io.ReadFull(file, metadataBytes); err != nil {
+		return Metadata{}, fileHeader{}, err
+	}
+
+	if header.flags&flagCompressedMetadata != 0 {
+		decoded, err := decompressBlock(metadataBytes, maxMetadataSize)
+		if err != nil {
+			return Metadata{}, fileHeader{}, fmt.Errorf("failed to decompress metadata: %w", err)
+		}
+		metadataBytes = decoded
 	}
 
 	// Unmarshal metadata
 	var metadataDoc bson.M
 	if err := bson.Unmarshal(metadataBytes, &metadataDoc); err != nil {
-		return Metadata{}, err
+		return Metadata{}, fileHeader{}, err
 	}
 
-	// Extract metadata fields
-	r.metadata = Metadata{
-		Database:       metadataDoc["database"].(string),
-		Collection:     metadataDoc["collection"].(string),
-		DocumentCount:  metadataDoc["documentCount"].(int64),
-		Timestamp:      metadataDoc["timestamp"].(int64),
-		Source:         metadataDoc["source"].(string),
-		OriginalSize:   metadataDoc["originalSize"].(int64),
-		CompressedSize: metadataDoc["compressedSize"].(int64),
+	metadata := metadataFromDoc(metadataDoc)
+	metadata.Options, metadata.Indexes = structureFromBytes(metadataBytes)
+	return metadata, header, nil
+}
+
+// describeMagic names the format of a file that is not an MCBZ file, based
+// on its leading bytes
+func describeMagic(magic []byte) string {
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return "a bare zstd stream"
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return "a gzip stream"
+	case magic[0] == '{' || magic[0] == '[':
+		return "JSON text"
+	default:
+		return fmt.Sprintf("%q", string(magic))
 	}
+}
 
-	// Initialize decompressor
-	decompressor, err := NewDecompressor(r.file)
+// readDictionary reads a length-prefixed dictionary from the data region
+func readDictionary(file io.Reader) ([]byte, error) {
+	lengthBytes := make([]byte, 4)
+	if _, err := io.ReadFull(file, lengthBytes); err != nil {
+		return nil, fmt.Errorf("failed to read dictionary length: %w", err)
+	}
+	length := byteOrder.Uint32(lengthBytes)
+	if length > maxDictionarySize {
+		return nil, fmt.Errorf("dictionary too large: %d bytes (max %d)", length, maxDictionarySize)
+	}
+
+	dict := make([]byte, length)
+	if _, err := io.ReadFull(file, dict); err != nil {
+		return nil, fmt.Errorf("failed to read dictionary: %w", err)
+	}
+	return dict, nil
+}
+
+// metadataToDoc converts metadata to the BSON document stored in the header
+func metadataToDoc(metadata Metadata) bson.D {
+	doc := bson.D{
+		{Key: "database", Value: metadata.Database},
+		{Key: "collection", Value: metadata.Collection},
+		{Key: "documentCount", Value: metadata.DocumentCount},
+		{Key: "timestamp", Value: metadata.Timestamp},
+		{Key: "source", Value: metadata.Source},
+		{Key: "originalSize", Value: metadata.OriginalSize},
+		{Key: "compressedSize", Value: metadata.CompressedSize},
+		{Key: "architecture", Value: "cross-platform"}, // Add this to indicate cross-platform compatibility
+	}
+	if len(metadata.Options) > 0 {
+		doc = append(doc, bson.E{Key: "options", Value: metadata.Options})
+	}
+	if len(metadata.Indexes) > 0 {
+		doc = append(doc, bson.E{Key: "indexes", Value: metadata.Indexes})
+	}
+	if len(metadata.CollectionUUID) > 0 {
+		doc = append(doc, bson.E{Key: "uuid", Value: primitive.Binary{Subtype: bson.TypeBinaryUUID, Data: metadata.CollectionUUID}})
+	}
+	if metadata.Part > 0 {
+		doc = append(doc, bson.E{Key: "part", Value: int64(metadata.Part)})
+	}
+	if metadata.Writer != "" {
+		doc = append(doc, bson.E{Key: "writer", Value: metadata.Writer})
+	}
+	if metadata.Codec != "" {
+		doc = append(doc,
+			bson.E{Key: "codec", Value: metadata.Codec},
+			bson.E{Key: "level", Value: int64(metadata.Level)})
+	}
+	if metadata.Format != "" {
+		doc = append(doc, bson.E{Key: "format", Value: metadata.Format})
+	}
+	if !metadata.OplogEnd.IsZero() {
+		doc = append(doc, bson.E{Key: "oplogEnd", Value: metadata.OplogEnd})
+	}
+	return doc
+}
+
+// metadataFromDoc extracts metadata from the header document. Missing
+// fields are left at their zero value.
+func metadataFromDoc(doc bson.M) Metadata {
+	return Metadata{
+		Database:       stringField(doc, "database"),
+		Collection:     stringField(doc, "collection"),
+		DocumentCount:  int64Field(doc, "documentCount"),
+		Timestamp:      int64Field(doc, "timestamp"),
+		Source:         stringField(doc, "source"),
+		OriginalSize:   int64Field(doc, "originalSize"),
+		CompressedSize: int64Field(doc, "compressedSize"),
+		CollectionUUID: uuidField(doc, "uuid"),
+		Part:           int(int64Field(doc, "part")),
+		Codec:          stringField(doc, "codec"),
+		Level:          int(int64Field(doc, "level")),
+		Writer:         stringField(doc, "writer"),
+		Format:         stringField(doc, "format"),
+		OplogEnd:       timestampField(doc, "oplogEnd"),
+	}
+}
+
+// structureFromBytes extracts the collection options and indexes from the
+// header document. They are decoded separately from the other fields so
+// field order, which matters for index keys, is preserved. Malformed values
+// are ignored like other metadata fields.
+func structureFromBytes(metadataBytes []byte) (bson.D, []bson.D) {
+	var structure struct {
+		Options bson.D   `bson:"options"`
+		Indexes []bson.D `bson:"indexes"`
+	}
+	if err := bson.Unmarshal(metadataBytes, &structure); err != nil {
+		return nil, nil
+	}
+	return structure.Options, structure.Indexes
+}
+
+// stringField returns a string field from a metadata document
+func stringField(doc bson.M, key string) string {
+	value, _ := doc[key].(string)
+	return value
+}
+
+// uuidField returns the data of a UUID binary field from a metadata document
+func uuidField(doc bson.M, key string) []byte {
+	value, _ := doc[key].(primitive.Binary)
+	if value.Subtype != bson.TypeBinaryUUID || len(value.Data) != 16 {
+		return nil
+	}
+	return value.Data
+}
+
+// timestampField returns a timestamp field from a metadata document
+func timestampField(doc bson.M, key string) primitive.Timestamp {
+	value, _ := doc[key].(primitive.Timestamp)
+	return value
+}
+
+// int64Field returns an integer field from a metadata document
+func int64Field(doc bson.M, key string) int64 {
+	switch value := doc[key].(type) {
+	case int64:
+		return value
+	case int32:
+		return int64(value)
+	default:
+		return 0
+	}
+}
+
+// DataRegion returns the offset and length of the data region recorded in
+// the header. The length is the CompressedSize metadata field and covers the
+// optional dictionary as well as the compressed batches. ReadHeader must be
+// called first.
+func (r *FileReader) DataRegion() (int64, int64) {
+	return r.header.dataOffset, r.metadata.CompressedSize
+}
+
+// CheckDataRegion confirms that the file ends exactly where the data region
+// recorded in the header ends, catching truncated files and trailing bytes
+// without decoding any documents. ReadHeader must be called first.
+func (r *FileReader) CheckDataRegion() error {
+	info, err := r.file.Stat()
 	if err != nil {
-		return Metadata{}, err
+		return err
 	}
-	r.decompressor = decompressor
+	offset, length := r.DataRegion()
+	dataEnd := offset + length + r.trailerSize
+	switch {
+	case info.Size() < dataEnd:
+		return fmt.Errorf("%w: file is %d bytes but the data region ends at %d; the file is truncated",
+			ErrDataRegionMismatch, info.Size(), dataEnd)
+	case info.Size() > dataEnd:
+		return fmt.Errorf("%w: %d trailing bytes after the data region ending at %d",
+			ErrDataRegionMismatch, info.Size()-dataEnd, dataEnd)
+	}
+	return nil
+}
 
-	return r.metadata, nil
+// Outdated reports whether the file uses an older layout than the one
+// written by this version. ReadHeader must be called first.
+func (r *FileReader) Outdated() bool {
+	return r.header.version < fileVersion
+}
+
+// HasTrailer reports whether the header was read from a trailer at the end
+// of the file. ReadHeader must be called first.
+func (r *FileReader) HasTrailer() bool {
+	return r.trailerSize > 0
 }
 
-// ReadBatch reads a batch of BSON documents from the file
+// ReadBatch reads up to maxBatchSize BSON documents from the file. A stored
+// batch larger than maxBatchSize is returned over several calls, and batch
+// references are expanded transparently.
 func (r *FileReader) ReadBatch(maxBatchSize int) ([]bson.D, error) {
-	// Read batch length
-	batchLengthBytes := make([]byte, 4)
-	if _, err := io.ReadFull(r.decompressor, batchLengthBytes); err != nil {
-		if err == io.EOF {
-			return []bson.D{}, nil
+	raw, readErr := r.readRawBatch(maxBatchSize, false)
+	batch := make([]bson.D, 0, len(raw))
+	for _, docBytes := range raw {
+		var doc bson.D
+		if err := bson.Unmarshal(docBytes, &doc); err != nil {
+			return batch, fmt.Errorf("%w: %v", ErrCorruptBatch, err)
+		}
+		batch = append(batch, doc)
+	}
+	return batch, readErr
+}
+
+// ReadRawBatch is ReadBatch without decoding: it returns the documents as
+// stored, each checked to be well-formed BSON. The two can be mixed on the
+// same reader.
+func (r *FileReader) ReadRawBatch(maxBatchSize int) ([]bson.Raw, error) {
+	return r.readRawBatch(maxBatchSize, true)
+}
+
+// readRawBatch reads up to maxBatchSize documents, optionally validating
+// them; on error the documents read before it are returned
+func (r *FileReader) readRawBatch(maxBatchSize int, validate bool) ([]bson.Raw, error) {
+	if r.pending == 0 {
+		// Read batch length
+		batchLengthBytes := make([]byte, 4)
+		if _, err := io.ReadFull(r.decompressor, batchLengthBytes); err != nil {
+			if err == io.EOF {
+				return []bson.Raw{}, nil
+			}
+			return nil, fmt.Errorf("%w: failed to read batch length: %v", ErrCorruptBatch, err)
+		}
+		batchLength := byteOrder.Uint32(batchLengthBytes)
+
+		r.replaying = batchLength == batchRepeatMarker && r.header.flags&flagBatchRefs != 0
+		if r.replaying {
+			if len(r.lastBatch) == 0 {
+				return nil, fmt.Errorf("%w: batch reference without a preceding batch", ErrCorruptBatch)
+			}
+			r.pending = len(r.lastBatch)
+			r.replayNext = 0
+		} else {
+			r.pending = int(batchLength)
+			if r.header.flags&flagBatchRefs != 0 {
+				r.lastBatch = make([][]byte, 0, r.pending)
+			}
 		}
-		return nil, err
 	}
-	batchLength := byteOrder.Uint32(batchLengthBytes)
 
 	// Limit batch size
-	actualBatchSize := int(batchLength)
+	actualBatchSize := r.pending
 	if actualBatchSize > maxBatchSize {
 		actualBatchSize = maxBatchSize
 	}
 
-	batch := make([]bson.D, 0, actualBatchSize)
+	batch := make([]bson.Raw, 0, actualBatchSize)
 
 	// Read documents
 	for i := 0; i < actualBatchSize; i++ {
-		// Read document length
-		docLengthBytes := make([]byte, 4)
-		if _, err := io.ReadFull(r.decompressor, docLengthBytes); err != nil {
-			return batch, err
-		}
-		docLength := byteOrder.Uint32(docLengthBytes)
-
-		// Read document data
-		docBytes := make([]byte, docLength)
-		if _, err := io.ReadFull(r.decompressor, docBytes); err != nil {
+		docBytes, err := r.nextDocument()
+		if err != nil {
 			return batch, err
 		}
-
-		// Unmarshal document
-		var doc bson.D
-		if err := bson.Unmarshal(docBytes, &doc); err != nil {
-			return batch, err
+		if validate {
+			if err := bson.Raw(docBytes).Validate(); err != nil {
+				return batch, fmt.Errorf("%w: %v", ErrCorruptBatch, err)
+			}
 		}
 
-		batch = append(batch, doc)
+		batch = append(batch, docBytes)
+		r.pending--
 	}
 
 	return batch, nil
 }
 
+// nextDocument returns the next document of the current stored batch,
+// either from the data region or from the batch being replayed
+func (r *FileReader) nextDocument() ([]byte, error) {
+	if r.replaying {
+		docBytes := r.lastBatch[r.replayNext]
+		r.replayNext++
+		r.bytesRead += int64(len(docBytes) + 4)
+		return docBytes, nil
+	}
+
+	// Read document length
+	docLengthBytes := make([]byte, 4)
+	if _, err := io.ReadFull(r.decompressor, docLengthBytes); err != nil {
+		return nil, fmt.Errorf("%w: failed to read document length: %v", ErrCorruptBatch, err)
+	}
+	docLength := byteOrder.Uint32(docLengthBytes)
+
+	// Read document data
+	docBytes := make([]byte, docLength)
+	if _, err := io.ReadFull(r.decompressor, docBytes); err != nil {
+		return nil, fmt.Errorf("%w: failed to read document: %v", ErrCorruptBatch, err)
+	}
+
+	if r.header.flags&flagBatchRefs != 0 {
+		r.lastBatch = append(r.lastBatch, docBytes)
+	}
+	r.bytesRead += int64(len(docBytes) + 4)
+	return docBytes, nil
+}
+
+// BytesRead returns the size of the documents read so far, counted like
+// the OriginalSize metadata field
+func (r *FileReader) BytesRead() int64 {
+	return r.bytesRead
+}
+
+// Offset returns the position in the file up to which compressed data has
+// been consumed. The decoder reads ahead, so the position runs slightly
+// ahead of the documents returned. ReadHeader must be called first.
+func (r *FileReader) Offset() int64 {
+	if r.input == nil {
+		return 0
+	}
+	return r.input.n
+}
+
+// DataEnd returns the offset at which the data region ends in the file: the
+// file size, less the trailer if there is one. Unlike DataRegion it does not
+// rely on the header, so it holds for truncated files too. ReadHeader must
+// be called first.
+func (r *FileReader) DataEnd() (int64, error) {
+	info, err := r.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size() - r.trailerSize, nil
+}
+
+// countingReader counts the bytes read through it, starting from n
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
 // Close closes the file reader
 func (r *FileReader) Close() error {
 	if r.decompressor != nil {
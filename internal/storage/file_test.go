@@ -0,0 +1,557 @@
+package storage
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestEmptyFileRoundTrip(t *testing.T) {
+	t.Run("header", func(t *testing.T) { testEmptyFileRoundTrip(t, false) })
+	t.Run("trailer", func(t *testing.T) { testEmptyFileRoundTrip(t, true) })
+}
+
+func testEmptyFileRoundTrip(t *testing.T, noFooterSeek bool) {
+	path := filepath.Join(t.TempDir(), "empty"+FileExtension)
+	metadata := Metadata{Database: "db", Collection: "empty", Timestamp: 1700000000, Source: "test"}
+
+	opts := DefaultCompressionOptions()
+	opts.NoFooterSeek = noFooterSeek
+	writer, err := NewFileWriter(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.WriteHeader(metadata); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.WriteFooter(metadata); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := NewFileReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	got, err := reader.ReadHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Database != "db" || got.Collection != "empty" || got.DocumentCount != 0 || got.OriginalSize != 0 {
+		t.Fatalf("unexpected metadata %+v", got)
+	}
+	if err := reader.CheckDataRegion(); err != nil {
+		t.Fatalf("CheckDataRegion: %v", err)
+	}
+
+	batch, err := reader.ReadBatch(1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batch) != 0 {
+		t.Fatalf("read %d documents from an empty file", len(batch))
+	}
+}
+
+func TestReadBatchSmallerThanStoredBatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "batches.mcbz")
+	writer, err := NewFileWriter(path, DefaultCompressionOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.WriteHeader(Metadata{Database: "db", Collection: "c"}); err != nil {
+		t.Fatal(err)
+	}
+	// Two stored batches, of 10 and 5 documents
+	var n int32
+	for _, size := range []int{10, 5} {
+		batch := make([]bson.D, size)
+		for i := range batch {
+			batch[i] = bson.D{{Key: "_id", Value: n}}
+			n++
+		}
+		if err := writer.WriteBatch(batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.WriteFooter(Metadata{DocumentCount: int64(n)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := NewFileReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if _, err := reader.ReadHeader(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A call never crosses into the next stored batch
+	var sizes []int
+	var next int32
+	for {
+		batch, err := reader.ReadBatch(3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(batch) == 0 {
+			break
+		}
+		sizes = append(sizes, len(batch))
+		for _, doc := range batch {
+			if id := doc[0].Value; id != next {
+				t.Fatalf("read _id %v, want %d", id, next)
+			}
+			next++
+		}
+	}
+	if next != n {
+		t.Fatalf("read %d documents, want %d", next, n)
+	}
+	want := []int{3, 3, 3, 1, 3, 2}
+	if len(sizes) != len(want) {
+		t.Fatalf("read batches of %v, want %v", sizes, want)
+	}
+	for i := range want {
+		if sizes[i] != want[i] {
+			t.Fatalf("read batches of %v, want %v", sizes, want)
+		}
+	}
+}
+
+// snapshot returns a batch of n documents; batches with the same id are
+// identical
+func snapshot(id, n int) []bson.D {
+	batch := make([]bson.D, n)
+	for i := range batch {
+		batch[i] = bson.D{
+			{Key: "_id", Value: fmt.Sprintf("%d-%d", id, i)},
+			{Key: "snapshot", Value: int32(id)},
+			{Key: "payload", Value: strings.Repeat(fmt.Sprintf("item %d of snapshot %d ", i, id), 4)},
+		}
+	}
+	return batch
+}
+
+// writeRuns writes every run of batches to path: the first run creates the
+// file, later ones append to it. It returns the documents written.
+func writeRuns(t testing.TB, path string, opts CompressionOptions, runs ...[][]bson.D) []bson.D {
+	t.Helper()
+	var written []bson.D
+	for i, run := range runs {
+		open := NewFileWriter
+		if i > 0 {
+			open = NewAppendWriter
+		}
+		writer, err := open(path, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := writer.WriteHeader(Metadata{Database: "db", Collection: "snapshots"}); err != nil {
+			t.Fatal(err)
+		}
+		var count int64
+		for _, batch := range run {
+			if err := writer.WriteBatch(batch); err != nil {
+				t.Fatal(err)
+			}
+			count += int64(len(batch))
+			written = append(written, batch...)
+		}
+		if err := writer.WriteFooter(Metadata{DocumentCount: count}); err != nil {
+			t.Fatal(err)
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return written
+}
+
+// readFileHeader returns the metadata and header of a file
+func readFileHeader(t testing.TB, path string) (Metadata, fileHeader) {
+	t.Helper()
+	reader, err := NewFileReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	metadata, err := reader.ReadHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return metadata, reader.header
+}
+
+// checkDocuments fails unless got and want marshal to the same documents
+func checkDocuments(t *testing.T, got, want []bson.D) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("read %d documents, want %d", len(got), len(want))
+	}
+	gotData, wantData := marshalDocuments(t, got), marshalDocuments(t, want)
+	for i := range wantData {
+		if string(gotData[i]) != string(wantData[i]) {
+			t.Fatalf("document %d is %v, want %v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestBatchReferencesRoundTrip(t *testing.T) {
+	dedup := DefaultCompressionOptions()
+	dedup.DedupBatches = true
+	// Only the second and the last batch repeat the batch before them
+	batches := [][]bson.D{snapshot(1, 10), snapshot(1, 10), snapshot(2, 10), snapshot(1, 10), snapshot(1, 10)}
+
+	dir := t.TempDir()
+	plainPath := filepath.Join(dir, "plain"+FileExtension)
+	writeRuns(t, plainPath, DefaultCompressionOptions(), batches)
+	path := filepath.Join(dir, "dedup"+FileExtension)
+	want := writeRuns(t, path, dedup, batches)
+
+	plain, _ := readFileHeader(t, plainPath)
+	metadata, header := readFileHeader(t, path)
+	if header.version != batchRefsVersion || header.flags&flagBatchRefs == 0 {
+		t.Fatalf("version %d, flags %#x: want version %d with batch references", header.version, header.flags, batchRefsVersion)
+	}
+	if metadata.DocumentCount != 50 || metadata.OriginalSize != plain.OriginalSize {
+		t.Fatalf("%d documents of %d bytes, want 50 of %d", metadata.DocumentCount, metadata.OriginalSize, plain.OriginalSize)
+	}
+
+	// Reading in calls smaller than a stored batch splits the replayed
+	// batches the same way as stored ones
+	for _, maxBatchSize := range []int{1000, 10, 3, 1} {
+		t.Run(fmt.Sprintf("batch size %d", maxBatchSize), func(t *testing.T) {
+			checkDocuments(t, readDocuments(t, path, maxBatchSize), want)
+		})
+	}
+}
+
+func TestBatchReferenceAfterAppend(t *testing.T) {
+	dedup := DefaultCompressionOptions()
+	dedup.DedupBatches = true
+
+	tests := []struct {
+		name           string
+		first, appends CompressionOptions
+		wantRefs       bool
+	}{
+		// The append writes the first reference into a version 2 file
+		{"reference in the appended frame", DefaultCompressionOptions(), dedup, true},
+		// Appending without the option keeps the earlier references readable
+		{"reference before a plain append", dedup, DefaultCompressionOptions(), true},
+		{"no repeats", DefaultCompressionOptions(), DefaultCompressionOptions(), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "appended"+FileExtension)
+			first := [][]bson.D{snapshot(1, 10), snapshot(1, 10)}
+			want := writeRuns(t, path, tt.first, first)
+
+			// An append starts a new frame and does not compare its first
+			// batch with the last batch of the file
+			writer, err := NewAppendWriter(path, tt.appends)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := writer.WriteHeader(Metadata{Database: "db", Collection: "snapshots"}); err != nil {
+				t.Fatal(err)
+			}
+			for _, batch := range [][]bson.D{snapshot(1, 10), snapshot(1, 10), snapshot(2, 5)} {
+				if err := writer.WriteBatch(batch); err != nil {
+					t.Fatal(err)
+				}
+				want = append(want, batch...)
+			}
+			if err := writer.WriteFooter(Metadata{DocumentCount: 25}); err != nil {
+				t.Fatal(err)
+			}
+			if err := writer.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			metadata, header := readFileHeader(t, path)
+			if hasRefs := header.flags&flagBatchRefs != 0; hasRefs != tt.wantRefs || (header.version == batchRefsVersion) != tt.wantRefs {
+				t.Fatalf("version %d, flags %#x: want batch references %v", header.version, header.flags, tt.wantRefs)
+			}
+			if metadata.DocumentCount != int64(len(want)) {
+				t.Fatalf("header counts %d documents, want %d", metadata.DocumentCount, len(want))
+			}
+			checkDocuments(t, readDocuments(t, path, 4), want)
+		})
+	}
+}
+
+func TestBatchReferencesRejectedByOtherVersions(t *testing.T) {
+	dedup := DefaultCompressionOptions()
+	dedup.DedupBatches = true
+	path := filepath.Join(t.TempDir(), "dedup"+FileExtension)
+	writeRuns(t, path, dedup, [][]bson.D{snapshot(1, 3), snapshot(1, 3)})
+	original, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if original[4] != batchRefsVersion {
+		t.Fatalf("written as version %d, want %d", original[4], batchRefsVersion)
+	}
+
+	// A reader only accepts the versions and flags it knows. Releases
+	// before batch references stopped at version 2, so they refuse this
+	// file the way this reader refuses a later version or an unknown flag.
+	tests := []struct {
+		name  string
+		patch func(data []byte)
+	}{
+		{"later version", func(data []byte) { data[4] = batchRefsVersion + 1 }},
+		{"unknown flag", func(data []byte) { data[5] |= 1 << 7 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := append([]byte(nil), original...)
+			tt.patch(data)
+			patched := filepath.Join(t.TempDir(), "patched"+FileExtension)
+			if err := os.WriteFile(patched, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			reader, err := NewFileReader(patched)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer reader.Close()
+			if _, err := reader.ReadHeader(); !errors.Is(err, ErrUnsupportedVersion) {
+				t.Fatalf("got %v, want %v", err, ErrUnsupportedVersion)
+			}
+		})
+	}
+}
+
+// Snapshots of a collection taken one after another and exported into one
+// file repeat whole batches, which is the case --content-hash-dedup is for
+func TestBatchReferencesShrinkRepeatedSnapshots(t *testing.T) {
+	var batches [][]bson.D
+	for id := 0; id < 5; id++ {
+		for repeat := 0; repeat < 10; repeat++ {
+			batches = append(batches, snapshot(id, 200))
+		}
+	}
+	dedup := DefaultCompressionOptions()
+	dedup.DedupBatches = true
+
+	dir := t.TempDir()
+	plainPath, dedupPath := filepath.Join(dir, "plain"+FileExtension), filepath.Join(dir, "dedup"+FileExtension)
+	writeRuns(t, plainPath, DefaultCompressionOptions(), batches)
+	writeRuns(t, dedupPath, dedup, batches)
+	plain, _ := readFileHeader(t, plainPath)
+	deduped, _ := readFileHeader(t, dedupPath)
+
+	t.Logf("50 batches of 200 documents, 5 snapshots repeated 10 times: %d bytes (%d compressed) without references, %d with them",
+		plain.OriginalSize, plain.CompressedSize, deduped.CompressedSize)
+	if deduped.CompressedSize >= plain.CompressedSize {
+		t.Fatalf("references did not help: %d bytes with them, %d without", deduped.CompressedSize, plain.CompressedSize)
+	}
+}
+
+// writeBenchFile writes n small documents in batches of 1000 and returns
+// the path and the total size of the documents
+func writeBenchFile(b *testing.B, n int) (string, int64) {
+	b.Helper()
+	docs := smallDocuments(rand.New(rand.NewSource(1)), n)
+	var batches [][]bson.D
+	for start := 0; start < len(docs); start += 1000 {
+		end := start + 1000
+		if end > len(docs) {
+			end = len(docs)
+		}
+		batches = append(batches, docs[start:end])
+	}
+	path := filepath.Join(b.TempDir(), "bench"+FileExtension)
+	writeRuns(b, path, DefaultCompressionOptions(), batches)
+	metadata, _ := readFileHeader(b, path)
+	return path, metadata.OriginalSize
+}
+
+// readAll reads a file to the end with ReadBatch
+func readAll(b *testing.B, path string, concurrency, maxBatchSize int) {
+	reader, err := NewFileReader(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer reader.Close()
+	reader.SetConcurrency(concurrency)
+	if _, err := reader.ReadHeader(); err != nil {
+		b.Fatal(err)
+	}
+	for {
+		batch, err := reader.ReadBatch(maxBatchSize)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(batch) == 0 {
+			return
+		}
+	}
+}
+
+// Decoding documents is most of the work of ReadBatch, so more decoder
+// goroutines only help as far as decompression is the bottleneck
+func BenchmarkReadBatchConcurrency(b *testing.B) {
+	path, size := writeBenchFile(b, 100000)
+	for _, concurrency := range []int{1, 4} {
+		b.Run(fmt.Sprintf("decoders=%d", concurrency), func(b *testing.B) {
+			b.SetBytes(size)
+			for i := 0; i < b.N; i++ {
+				readAll(b, path, concurrency, 1000)
+			}
+		})
+	}
+}
+
+// syscallCounter counts the reads and writes that reach a file
+type syscallCounter struct {
+	file  *os.File
+	calls int
+}
+
+func (c *syscallCounter) Write(p []byte) (int, error) {
+	c.calls++
+	return c.file.Write(p)
+}
+
+func (c *syscallCounter) Read(p []byte) (int, error) {
+	c.calls++
+	return c.file.Read(p)
+}
+
+// writeStream writes documents the way WriteRawBatch does, a length prefix
+// and the data for each
+func writeStream(w io.Writer, docs [][]byte) error {
+	length := make([]byte, 4)
+	for _, data := range docs {
+		byteOrder.PutUint32(length, uint32(len(data)))
+		if _, err := w.Write(length); err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readStream reads documents back the way nextDocument does
+func readStream(r io.Reader, n int) error {
+	length := make([]byte, 4)
+	for i := 0; i < n; i++ {
+		if _, err := io.ReadFull(r, length); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(r, make([]byte, byteOrder.Uint32(length))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BenchmarkFileBuffering compares the zstd stream going to the file
+// directly with going through the ioBufferSize buffers FileWriter and
+// FileReader put in between, reporting the reads or writes reaching the
+// file per pass
+func BenchmarkFileBuffering(b *testing.B) {
+	docs := marshalDocuments(b, smallDocuments(rand.New(rand.NewSource(1)), 100000))
+	var size int64
+	for _, data := range docs {
+		size += int64(len(data) + 4)
+	}
+	opts := CompressionOptions{Level: 1, Concurrency: 1}
+	path := filepath.Join(b.TempDir(), "stream.zst")
+
+	for _, buffered := range []bool{false, true} {
+		name := "unbuffered"
+		if buffered {
+			name = "buffered"
+		}
+		b.Run("write/"+name, func(b *testing.B) {
+			b.SetBytes(size)
+			calls := 0
+			for i := 0; i < b.N; i++ {
+				file, err := os.Create(path)
+				if err != nil {
+					b.Fatal(err)
+				}
+				counter := &syscallCounter{file: file}
+				var w io.Writer = counter
+				buf := bufio.NewWriterSize(counter, ioBufferSize)
+				if buffered {
+					w = buf
+				}
+				compressor, err := NewCompressor(w, opts)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if err := writeStream(compressor, docs); err != nil {
+					b.Fatal(err)
+				}
+				if err := compressor.Close(); err != nil {
+					b.Fatal(err)
+				}
+				if err := buf.Flush(); err != nil {
+					b.Fatal(err)
+				}
+				if err := file.Close(); err != nil {
+					b.Fatal(err)
+				}
+				calls += counter.calls
+			}
+			b.ReportMetric(float64(calls)/float64(b.N), "writes/op")
+		})
+	}
+
+	for _, buffered := range []bool{false, true} {
+		name := "unbuffered"
+		if buffered {
+			name = "buffered"
+		}
+		b.Run("read/"+name, func(b *testing.B) {
+			b.SetBytes(size)
+			calls := 0
+			for i := 0; i < b.N; i++ {
+				file, err := os.Open(path)
+				if err != nil {
+					b.Fatal(err)
+				}
+				counter := &syscallCounter{file: file}
+				var r io.Reader = counter
+				if buffered {
+					r = bufio.NewReaderSize(counter, ioBufferSize)
+				}
+				decompressor, err := NewDecompressor(r, nil, 1)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if err := readStream(decompressor, len(docs)); err != nil {
+					b.Fatal(err)
+				}
+				decompressor.Close()
+				file.Close()
+				calls += counter.calls
+			}
+			b.ReportMetric(float64(calls)/float64(b.N), "reads/op")
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ManifestExtension is appended to a file name to form its manifest path
+const ManifestExtension = ".sha256"
+
+// Manifest holds the checksum sidecar information for an export file
+type Manifest struct {
+	SHA256        string
+	FileName      string
+	DocumentCount int64
+}
+
+// FileSHA256 computes the hex-encoded SHA-256 of a file
+func FileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// WriteManifest writes a sha256sum-compatible sidecar for the file at path,
+// followed by a comment line with the document count
+func WriteManifest(path string, documentCount int64) (string, error) {
+	sum, err := FileSHA256(path)
+	if err != nil {
+		return "", err
+	}
+
+	manifestPath := path + ManifestExtension
+	content := fmt.Sprintf("%s  %s\n# documents: %d\n", sum, filepath.Base(path), documentCount)
+	if err := os.WriteFile(manifestPath, []byte(content), 0644); err != nil {
+		return "", err
+	}
+	return manifestPath, nil
+}
+
+// ReadManifest parses a manifest written by WriteManifest
+func ReadManifest(manifestPath string) (Manifest, error) {
+	file, err := os.Open(manifestPath)
+	if err != nil {
+		return Manifest{}, err
+	}
+	defer file.Close()
+
+	manifest := Manifest{DocumentCount: -1}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+			continue
+		case strings.HasPrefix(line, "# documents:"):
+			count, err := strconv.ParseInt(strings.TrimSpace(strings.TrimPrefix(line, "# documents:")), 10, 64)
+			if err != nil {
+				return Manifest{}, fmt.Errorf("invalid document count in manifest: %w", err)
+			}
+			manifest.DocumentCount = count
+		case strings.HasPrefix(line, "#"):
+			continue
+		default:
+			fields := strings.Fields(line)
+			if len(fields) != 2 {
+				return Manifest{}, fmt.Errorf("invalid manifest line: %q", line)
+			}
+			manifest.SHA256 = strings.ToLower(fields[0])
+			manifest.FileName = strings.TrimPrefix(fields[1], "*")
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return Manifest{}, err
+	}
+	if manifest.SHA256 == "" {
+		return Manifest{}, fmt.Errorf("manifest %s contains no checksum", manifestPath)
+	}
+
+	return manifest, nil
+}
@@ -0,0 +1,407 @@
+package storage
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+const (
+	// PartitionMissing names the partition of documents without the field
+	PartitionMissing = "_missing"
+	// PartitionNull names the partition of documents whose field is null
+	PartitionNull = "_null"
+	// PartitionEmpty names the partition of documents whose field is an
+	// empty string
+	PartitionEmpty = "_empty"
+	// maxPartitionName caps the escaped value in a partition file name;
+	// longer values are shortened and given a hash suffix
+	maxPartitionName = 100
+)
+
+// partition is one output file of a partitioned export
+type partition struct {
+	key  string
+	name string
+	// path is a temporary name while the export runs; WriteFooter renames
+	// the file to its final name
+	path string
+	// writer is nil while the file is closed to stay within the open file
+	// limit
+	writer *FileWriter
+	// docs counts all documents of the partition, openDocs those written
+	// since the writer was last opened
+	docs     int64
+	openDocs int64
+	size     int64
+	elem     *list.Element
+}
+
+// PartitionWriter routes each document of an export to a file named after
+// the value of a field, e.g. region=US.mcbz. Every file is a complete MCBZ
+// file with the same metadata. At most maxOpen files are open at a time:
+// opening another one finishes the least recently used file, which is
+// reopened for append when more documents arrive for it.
+//
+// Values whose file names collide, such as 1 and "1", or US and us on a
+// case-insensitive filesystem, get separate files. Names are only given once
+// all values are known, so they do not depend on the order in which values
+// arrive: the files are written under temporary names and renamed by
+// WriteFooter. Closing the writer before WriteFooter has succeeded removes
+// the files still under temporary names.
+type PartitionWriter struct {
+	dir      string
+	field    string
+	path     []string
+	opts     CompressionOptions
+	maxOpen  int
+	dict     []byte
+	metadata Metadata
+
+	// partitions are keyed by the value's BSON type and name, so values
+	// whose names coincide still get separate files
+	partitions map[string]*partition
+	// lru holds the keys of open partitions, most recently used first
+	lru     *list.List
+	trailer bool
+	// named is set once WriteFooter has renamed every partition
+	named bool
+}
+
+// NewPartitionWriter creates a writer of partitions by field, which may be a
+// dotted path, in dir
+func NewPartitionWriter(dir, field string, opts CompressionOptions, maxOpen int) (*PartitionWriter, error) {
+	if field == "" {
+		return nil, fmt.Errorf("partition field must not be empty")
+	}
+	if maxOpen < 1 {
+		return nil, fmt.Errorf("open partition limit must be at least 1")
+	}
+	return &PartitionWriter{
+		dir:        dir,
+		field:      field,
+		path:       strings.Split(field, "."),
+		opts:       opts,
+		maxOpen:    maxOpen,
+		partitions: make(map[string]*partition),
+		lru:        list.New(),
+	}, nil
+}
+
+// PartitionPath returns the file a partition value is written to
+func PartitionPath(dir, field, value string) string {
+	return filepath.Join(dir, escapePartitionName(field)+"="+escapePartitionName(value)+FileExtension)
+}
+
+// escapePartitionName makes a field name or value safe to use in a file
+// name: bytes other than letters, digits, '.', '_' and '-' are %-escaped,
+// and overly long names are shortened with a hash suffix so distinct values
+// stay distinct
+func escapePartitionName(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '.', c == '_', c == '-':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	name := b.String()
+	if len(name) > maxPartitionName {
+		sum := sha256.Sum256([]byte(s))
+		name = fmt.Sprintf("%s~%x", name[:maxPartitionName-17], sum[:8])
+	}
+	return name
+}
+
+// partitionKey returns the key identifying the partition of a document and
+// the name its file is given. Values of different types with the same name,
+// such as 1 and "1", have different keys.
+func (w *PartitionWriter) partitionKey(doc bson.Raw) (key, name string) {
+	value, err := doc.LookupErr(w.path...)
+	if err != nil {
+		return "", PartitionMissing
+	}
+	name = partitionName(value)
+	return string(value.Type) + name, name
+}
+
+// partitionName returns the file name part for a field value
+func partitionName(value bson.RawValue) string {
+	switch value.Type {
+	case bsontype.Null, bsontype.Undefined:
+		return PartitionNull
+	case bsontype.String:
+		if s := value.StringValue(); s != "" {
+			return s
+		}
+		return PartitionEmpty
+	case bsontype.Int32:
+		return strconv.FormatInt(int64(value.Int32()), 10)
+	case bsontype.Int64:
+		return strconv.FormatInt(value.Int64(), 10)
+	case bsontype.Double:
+		f := value.Double()
+		if f == math.Trunc(f) && math.Abs(f) < 1e15 {
+			return strconv.FormatInt(int64(f), 10)
+		}
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	case bsontype.Boolean:
+		return strconv.FormatBool(value.Boolean())
+	case bsontype.ObjectID:
+		return value.ObjectID().Hex()
+	case bsontype.DateTime:
+		return value.Time().UTC().Format("2006-01-02T15:04:05.000Z")
+	}
+	return value.String()
+}
+
+// SetDictionary makes every partition compress with a trained dictionary.
+// It must be called before any batch is written.
+func (w *PartitionWriter) SetDictionary(dict []byte) error {
+	w.dict = dict
+	return nil
+}
+
+// WriteHeader records the metadata written to the header of every partition
+func (w *PartitionWriter) WriteHeader(metadata Metadata) error {
+	w.metadata = metadata
+	return nil
+}
+
+// WriteBatch writes a batch of BSON documents to their partitions
+func (w *PartitionWriter) WriteBatch(batch []bson.D) error {
+	raw := make([][]byte, len(batch))
+	for i, doc := range batch {
+		data, err := bson.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		raw[i] = data
+	}
+	return w.WriteRawBatch(raw)
+}
+
+// WriteRawBatch splits a batch of marshaled documents by partition and
+// writes each part, keeping the order of documents within a partition
+func (w *PartitionWriter) WriteRawBatch(batch [][]byte) error {
+	var order []string
+	names := make(map[string]string)
+	groups := make(map[string][][]byte)
+	for _, data := range batch {
+		key, name := w.partitionKey(data)
+		if _, ok := groups[key]; !ok {
+			order = append(order, key)
+			names[key] = name
+		}
+		groups[key] = append(groups[key], data)
+	}
+
+	for _, key := range order {
+		p, err := w.open(key, names[key])
+		if err != nil {
+			return err
+		}
+		if err := p.writer.WriteRawBatch(groups[key]); err != nil {
+			return fmt.Errorf("failed to write to %s: %w", p.path, err)
+		}
+		p.docs += int64(len(groups[key]))
+		p.openDocs += int64(len(groups[key]))
+	}
+	return nil
+}
+
+// partialPath returns the temporary path a partition is written to until
+// WriteFooter gives it its final name
+func (w *PartitionWriter) partialPath(key string) string {
+	return filepath.Join(w.dir, fmt.Sprintf(".%s~%s.partial%s", escapePartitionName(w.field), keyHash(key), FileExtension))
+}
+
+// keyHash returns a short hash of a partition key, which tells apart values
+// whose file names collide
+func keyHash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return fmt.Sprintf("%x", sum[:4])
+}
+
+// finalPaths names the file of every partition. Partitions whose paths
+// differ only in case form a group; the one whose key sorts first, i.e. the
+// lowest BSON type and then the lowest name, keeps the plain name and the
+// others get a suffix derived from their key, e.g. region=us~1a2b3c4d.mcbz.
+func (w *PartitionWriter) finalPaths() map[string]string {
+	groups := make(map[string][]*partition)
+	for _, p := range w.partitions {
+		folded := strings.ToLower(PartitionPath(w.dir, w.field, p.name))
+		groups[folded] = append(groups[folded], p)
+	}
+
+	paths := make(map[string]string, len(w.partitions))
+	for _, group := range groups {
+		sort.Slice(group, func(i, j int) bool { return group[i].key < group[j].key })
+		for i, p := range group {
+			path := PartitionPath(w.dir, w.field, p.name)
+			if i > 0 {
+				path = strings.TrimSuffix(path, FileExtension) + "~" + keyHash(p.key) + FileExtension
+			}
+			paths[p.key] = path
+		}
+	}
+	return paths
+}
+
+// open returns the partition of a key with its writer open, creating the
+// file on first use and closing the least recently used one when the limit
+// of open files is reached
+func (w *PartitionWriter) open(key, name string) (*partition, error) {
+	p, ok := w.partitions[key]
+	if ok && p.writer != nil {
+		w.lru.MoveToFront(p.elem)
+		return p, nil
+	}
+	if w.lru.Len() >= w.maxOpen {
+		oldest := w.lru.Back().Value.(string)
+		if err := w.finish(w.partitions[oldest]); err != nil {
+			return nil, err
+		}
+	}
+
+	if !ok {
+		p = &partition{key: key, name: name, path: w.partialPath(key)}
+		writer, err := NewFileWriter(p.path, w.opts)
+		if err != nil {
+			return nil, err
+		}
+		if w.dict != nil {
+			if err := writer.SetDictionary(w.dict); err != nil {
+				writer.Close()
+				return nil, err
+			}
+		}
+		if err := writer.WriteHeader(w.metadata); err != nil {
+			writer.Close()
+			return nil, err
+		}
+		p.writer = writer
+		w.partitions[key] = p
+	} else {
+		writer, err := NewAppendWriter(p.path, w.opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to reopen %s: %w", p.path, err)
+		}
+		if err := writer.WriteHeader(w.metadata); err != nil {
+			writer.Close()
+			return nil, err
+		}
+		p.writer = writer
+	}
+	p.openDocs = 0
+	p.elem = w.lru.PushFront(key)
+	return p, nil
+}
+
+// finish writes the footer of an open partition and closes its file
+func (w *PartitionWriter) finish(p *partition) error {
+	metadata := w.metadata
+	metadata.DocumentCount = p.openDocs
+	if err := p.writer.WriteFooter(metadata); err != nil {
+		return fmt.Errorf("failed to finish %s: %w", p.path, err)
+	}
+	p.size = p.writer.BytesWritten()
+	w.trailer = w.trailer || p.writer.WroteTrailer()
+	err := p.writer.Close()
+	p.writer = nil
+	w.lru.Remove(p.elem)
+	p.elem = nil
+	return err
+}
+
+// WriteFooter finalizes every open partition and renames all of them to
+// their final names. Each partition's document count is tracked by the
+// writer; only the other fields of metadata, such as OplogEnd, are used.
+func (w *PartitionWriter) WriteFooter(metadata Metadata) error {
+	w.metadata.OplogEnd = metadata.OplogEnd
+	for w.lru.Len() > 0 {
+		if err := w.finish(w.partitions[w.lru.Front().Value.(string)]); err != nil {
+			return err
+		}
+	}
+
+	for key, path := range w.finalPaths() {
+		p := w.partitions[key]
+		if err := os.Rename(p.path, path); err != nil {
+			return fmt.Errorf("failed to name partition %s: %w", p.name, err)
+		}
+		p.path = path
+	}
+	w.named = true
+	return nil
+}
+
+// WroteTrailer reports whether any finished partition stored its header as
+// a trailer
+func (w *PartitionWriter) WroteTrailer() bool {
+	return w.trailer
+}
+
+// Metadata returns the metadata shared by all partitions
+func (w *PartitionWriter) Metadata() Metadata {
+	return w.metadata
+}
+
+// BytesWritten returns the total size of the partitions as of the last time
+// each was finished
+func (w *PartitionWriter) BytesWritten() int64 {
+	var total int64
+	for _, p := range w.partitions {
+		total += p.size
+	}
+	return total
+}
+
+// Partitions returns the files written, ordered by path
+func (w *PartitionWriter) Partitions() []Volume {
+	files := make([]Volume, 0, len(w.partitions))
+	for _, p := range w.partitions {
+		files = append(files, Volume{Path: p.path, DocumentCount: p.docs, Partition: p.name})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return files
+}
+
+// Close closes the open partition files without finishing them. Unless
+// WriteFooter has named every partition, the export failed and the
+// partitions still under temporary names are removed.
+func (w *PartitionWriter) Close() error {
+	var firstErr error
+	for elem := w.lru.Front(); elem != nil; elem = elem.Next() {
+		p := w.partitions[elem.Value.(string)]
+		if err := p.writer.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		p.writer = nil
+	}
+	w.lru.Init()
+	if w.named {
+		return firstErr
+	}
+	for key, p := range w.partitions {
+		if p.path != w.partialPath(key) {
+			continue
+		}
+		if err := os.Remove(p.path); err != nil && !os.IsNotExist(err) && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,170 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// writePartitions routes docs by region in batches of batchSize and returns
+// the written files, keyed by base name, with their document counts
+func writePartitions(t *testing.T, dir string, docs []bson.D, batchSize, maxOpen int) map[string]int64 {
+	t.Helper()
+	writer, err := NewPartitionWriter(dir, "region", DefaultCompressionOptions(), maxOpen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+	if err := writer.WriteHeader(Metadata{Database: "db", Collection: "coll"}); err != nil {
+		t.Fatal(err)
+	}
+	for start := 0; start < len(docs); start += batchSize {
+		end := start + batchSize
+		if end > len(docs) {
+			end = len(docs)
+		}
+		if err := writer.WriteBatch(docs[start:end]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.WriteFooter(Metadata{}); err != nil {
+		t.Fatal(err)
+	}
+
+	files := make(map[string]int64)
+	for _, volume := range writer.Partitions() {
+		files[filepath.Base(volume.Path)] = volume.DocumentCount
+	}
+	return files
+}
+
+func partitionDocs(values ...interface{}) []bson.D {
+	docs := make([]bson.D, len(values))
+	for i, value := range values {
+		docs[i] = bson.D{{Key: "_id", Value: int32(i)}}
+		if value != nil {
+			docs[i] = append(docs[i], bson.E{Key: "region", Value: value})
+		}
+	}
+	return docs
+}
+
+func TestPartitionNamesDoNotDependOnOrder(t *testing.T) {
+	values := []interface{}{"us", int32(1), "US", "1", "EU", nil, int64(1), "us", "_missing"}
+	reversed := make([]interface{}, len(values))
+	for i, value := range values {
+		reversed[len(values)-1-i] = value
+	}
+
+	first := writePartitions(t, t.TempDir(), partitionDocs(values...), 2, 2)
+	second := writePartitions(t, t.TempDir(), partitionDocs(reversed...), 3, 64)
+	if len(first) != 8 {
+		t.Fatalf("got %d files, want 8: %v", len(first), first)
+	}
+	for name, count := range first {
+		if second[name] != count {
+			t.Errorf("%s: %d documents in one order, %d in the other", name, count, second[name])
+		}
+	}
+
+	// The lowest type keeps the plain name: int32 1 sorts before int64 1
+	// and "1", and among strings "US" sorts before "us"
+	for _, name := range []string{"region=1.mcbz", "region=US.mcbz", "region=EU.mcbz", "region=_missing.mcbz"} {
+		if _, ok := first[name]; !ok {
+			t.Errorf("missing %s in %v", name, names(first))
+		}
+	}
+	if first["region=us~"+keyHash(string(bson.TypeString)+"us")+".mcbz"] != 2 {
+		t.Errorf("us documents not in their suffixed file: %v", names(first))
+	}
+}
+
+func TestPartitionRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	var values []interface{}
+	for i := 0; i < 60; i++ {
+		values = append(values, []string{"a", "b", "c", "d", "e"}[i%5])
+	}
+	// Two open files for five partitions forces closing and reopening
+	files := writePartitions(t, dir, partitionDocs(values...), 4, 2)
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 5 {
+		t.Fatalf("directory holds %d entries, want 5 (temporary files left?)", len(entries))
+	}
+	for name, count := range files {
+		reader, err := NewFileReader(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		metadata, err := reader.ReadHeader()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var read int64
+		for {
+			batch, err := reader.ReadBatch(1000)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(batch) == 0 {
+				break
+			}
+			read += int64(len(batch))
+		}
+		reader.Close()
+		if count != 12 || read != count || metadata.DocumentCount != count {
+			t.Errorf("%s: %d documents written, %d read, header says %d", name, count, read, metadata.DocumentCount)
+		}
+	}
+}
+
+func TestPartitionCloseRemovesUnfinishedFiles(t *testing.T) {
+	dir := t.TempDir()
+	other := filepath.Join(dir, "notes.txt")
+	if err := os.WriteFile(other, []byte("kept"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	writer, err := NewPartitionWriter(dir, "region", DefaultCompressionOptions(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.WriteHeader(Metadata{Database: "db", Collection: "coll"}); err != nil {
+		t.Fatal(err)
+	}
+	// Five partitions with two open files leaves both open and finished
+	// partitions under temporary names when the export fails
+	if err := writer.WriteBatch(partitionDocs("a", "b", "c", "d", "e")); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "notes.txt" {
+		var left []string
+		for _, entry := range entries {
+			left = append(left, entry.Name())
+		}
+		t.Fatalf("directory holds %v after a failed export, want only notes.txt", left)
+	}
+}
+
+func names(files map[string]int64) []string {
+	out := make([]string, 0, len(files))
+	for name := range files {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,189 @@
+package storage
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Volume describes one finished file of a split or partitioned export
+type Volume struct {
+	Path          string
+	DocumentCount int64
+	// Partition is the field value named by a partition file
+	Partition string
+}
+
+// VolumeWriter writes an export as a series of complete MCBZ files, rolling
+// over to the next volume once the current one reaches the size limit. The
+// limit is checked after each batch, so a volume can exceed it by up to one
+// compressed batch.
+type VolumeWriter struct {
+	path     string
+	opts     CompressionOptions
+	limit    int64
+	dict     []byte
+	metadata Metadata
+
+	current    *FileWriter
+	volumeDocs int64
+	volumes    []Volume
+	written    int64
+	trailer    bool
+}
+
+// VolumePath returns the path of a volume: the part number is inserted
+// before the extension, e.g. out.part002.mcbz
+func VolumePath(path string, part int) string {
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s.part%03d%s", strings.TrimSuffix(path, ext), part, ext)
+}
+
+// NewVolumeWriter creates a volume writer and its first volume
+func NewVolumeWriter(path string, opts CompressionOptions, limit int64) (*VolumeWriter, error) {
+	if limit <= 0 {
+		return nil, fmt.Errorf("volume size must be positive")
+	}
+	w := &VolumeWriter{path: path, opts: opts, limit: limit}
+	if err := w.openVolume(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// openVolume starts the next volume
+func (w *VolumeWriter) openVolume() error {
+	part := len(w.volumes) + 1
+	writer, err := NewFileWriter(VolumePath(w.path, part), w.opts)
+	if err != nil {
+		return err
+	}
+	if w.dict != nil {
+		if err := writer.SetDictionary(w.dict); err != nil {
+			writer.Close()
+			return err
+		}
+	}
+
+	metadata := w.metadata
+	metadata.Part = part
+	if err := writer.WriteHeader(metadata); err != nil {
+		writer.Close()
+		return err
+	}
+
+	w.current = writer
+	w.volumeDocs = 0
+	w.volumes = append(w.volumes, Volume{Path: VolumePath(w.path, part)})
+	return nil
+}
+
+// finishVolume writes the footer of the current volume and closes it
+func (w *VolumeWriter) finishVolume() error {
+	if err := w.current.WriteFooter(Metadata{DocumentCount: w.volumeDocs}); err != nil {
+		return err
+	}
+	w.written += w.current.BytesWritten()
+	w.trailer = w.trailer || w.current.WroteTrailer()
+	w.volumes[len(w.volumes)-1].DocumentCount = w.volumeDocs
+	err := w.current.Close()
+	w.current = nil
+	return err
+}
+
+// SetDictionary makes every volume compress with a trained dictionary. It
+// must be called before any batch is written.
+func (w *VolumeWriter) SetDictionary(dict []byte) error {
+	if err := w.current.SetDictionary(dict); err != nil {
+		return err
+	}
+	w.dict = dict
+	return nil
+}
+
+// WriteHeader records the metadata written to the header of every volume
+func (w *VolumeWriter) WriteHeader(metadata Metadata) error {
+	w.metadata = metadata
+	metadata.Part = len(w.volumes)
+	return w.current.WriteHeader(metadata)
+}
+
+// WriteBatch writes a batch of BSON documents to the current volume
+func (w *VolumeWriter) WriteBatch(batch []bson.D) error {
+	raw := make([][]byte, len(batch))
+	for i, doc := range batch {
+		data, err := bson.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		raw[i] = data
+	}
+	return w.WriteRawBatch(raw)
+}
+
+// WriteRawBatch writes a batch of marshaled documents to the current
+// volume, rolling over when it has reached the size limit
+func (w *VolumeWriter) WriteRawBatch(batch [][]byte) error {
+	// The next volume is only opened once there is data for it
+	if w.current == nil {
+		if err := w.openVolume(); err != nil {
+			return err
+		}
+	}
+
+	if err := w.current.WriteRawBatch(batch); err != nil {
+		return err
+	}
+	w.volumeDocs += int64(len(batch))
+
+	size, err := w.current.Size()
+	if err != nil {
+		return err
+	}
+	if size >= w.limit {
+		return w.finishVolume()
+	}
+	return nil
+}
+
+// WriteFooter finalizes the last volume. Each volume's document count is
+// tracked by the writer, so the count in metadata is ignored.
+func (w *VolumeWriter) WriteFooter(metadata Metadata) error {
+	if w.current == nil {
+		return nil
+	}
+	return w.finishVolume()
+}
+
+// WroteTrailer reports whether any finished volume stored its header as a
+// trailer
+func (w *VolumeWriter) WroteTrailer() bool {
+	return w.trailer
+}
+
+// Metadata returns the metadata shared by all volumes
+func (w *VolumeWriter) Metadata() Metadata {
+	return w.metadata
+}
+
+// BytesWritten returns the total size of the finished volumes
+func (w *VolumeWriter) BytesWritten() int64 {
+	return w.written
+}
+
+// Volumes returns the volumes written so far
+func (w *VolumeWriter) Volumes() []Volume {
+	return w.volumes
+}
+
+// Close closes the current volume
+func (w *VolumeWriter) Close() error {
+	if w.current == nil {
+		return nil
+	}
+	err := w.current.Close()
+	w.current = nil
+	return err
+}
@@ -0,0 +1,57 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Watermark records the largest value of a field seen by an incremental
+// export, from which the next run continues
+type Watermark struct {
+	Database   string      `bson:"database"`
+	Collection string      `bson:"collection"`
+	Field      string      `bson:"field"`
+	Value      interface{} `bson:"value"`
+	// Timestamp is the Unix time of the export that recorded the value
+	Timestamp int64 `bson:"timestamp"`
+}
+
+// WriteWatermark saves a watermark as canonical extended JSON, which keeps
+// the BSON type of the value. The write goes through a temporary file so a
+// crash never leaves a partial watermark behind.
+func WriteWatermark(path string, watermark Watermark) error {
+	data, err := bson.MarshalExtJSON(watermark, true, false)
+	if err != nil {
+		return fmt.Errorf("failed to encode watermark: %w", err)
+	}
+
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// ReadWatermark loads the watermark at path. It returns false when there
+// is none yet.
+func ReadWatermark(path string) (Watermark, bool, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return Watermark{}, false, nil
+	}
+	if err != nil {
+		return Watermark{}, false, err
+	}
+
+	var watermark Watermark
+	if err := bson.UnmarshalExtJSON(data, true, &watermark); err != nil {
+		return Watermark{}, false, fmt.Errorf("invalid watermark %s: %w", path, err)
+	}
+	if watermark.Field == "" || watermark.Value == nil {
+		return Watermark{}, false, fmt.Errorf("invalid watermark %s: field and value are required", path)
+	}
+	return watermark, true, nil
+}
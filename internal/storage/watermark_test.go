@@ -0,0 +1,69 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestWatermarkRoundTrip(t *testing.T) {
+	decimal, err := primitive.ParseDecimal128("12345.678")
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := map[string]interface{}{
+		"date":     primitive.NewDateTimeFromTime(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)),
+		"objectid": primitive.NewObjectID(),
+		"int64":    int64(1) << 60,
+		"decimal":  decimal,
+		"string":   "2024-05-01",
+	}
+	for name, value := range values {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "watermark.json")
+			want := Watermark{Database: "db", Collection: "coll", Field: "f", Value: value, Timestamp: 1700000000}
+			if err := WriteWatermark(path, want); err != nil {
+				t.Fatal(err)
+			}
+			got, ok, err := ReadWatermark(path)
+			if err != nil || !ok {
+				t.Fatalf("ReadWatermark = %v, %v", ok, err)
+			}
+			if got != want {
+				t.Fatalf("got %#v, want %#v", got, want)
+			}
+			if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+				t.Fatalf("temporary file left behind: %v", err)
+			}
+		})
+	}
+}
+
+func TestReadWatermarkMissing(t *testing.T) {
+	_, ok, err := ReadWatermark(filepath.Join(t.TempDir(), "none.json"))
+	if ok || err != nil {
+		t.Fatalf("ReadWatermark = %v, %v; want false, nil", ok, err)
+	}
+}
+
+func TestReadWatermarkInvalid(t *testing.T) {
+	files := map[string]string{
+		"not json":      "nope",
+		"missing field": `{"database":"db","collection":"coll","value":{"$numberInt":"1"}}`,
+		"missing value": `{"database":"db","collection":"coll","field":"f"}`,
+	}
+	for name, content := range files {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "watermark.json")
+			if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := ReadWatermark(path); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
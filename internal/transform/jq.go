@@ -0,0 +1,109 @@
+package transform
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/itchyny/gojq"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Transformer applies a jq expression to documents. It is safe for
+// concurrent use.
+type Transformer struct {
+	code     *gojq.Code
+	modified int64
+	dropped  int64
+}
+
+// NewTransformer compiles a jq expression
+func NewTransformer(expr string) (*Transformer, error) {
+	query, err := gojq.Parse(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid jq expression: %w", err)
+	}
+
+	code, err := gojq.Compile(query)
+	if err != nil {
+		return nil, fmt.Errorf("invalid jq expression: %w", err)
+	}
+
+	return &Transformer{code: code}, nil
+}
+
+// Apply runs the expression against a document. The document is converted to
+// canonical extended JSON so BSON types survive the round trip. It returns
+// false when the expression produced no result and the document should be
+// skipped.
+func (t *Transformer) Apply(doc bson.D) (bson.D, bool, error) {
+	input, err := toJSONValue(doc)
+	if err != nil {
+		return nil, false, err
+	}
+
+	iter := t.code.Run(input)
+	result, ok := iter.Next()
+	if !ok {
+		atomic.AddInt64(&t.dropped, 1)
+		return nil, false, nil
+	}
+	if err, isErr := result.(error); isErr {
+		return nil, false, fmt.Errorf("jq expression failed: %w", err)
+	}
+	if _, more := iter.Next(); more {
+		return nil, false, fmt.Errorf("jq expression produced more than one result for a document")
+	}
+	if result == nil {
+		atomic.AddInt64(&t.dropped, 1)
+		return nil, false, nil
+	}
+	if _, isObject := result.(map[string]interface{}); !isObject {
+		return nil, false, fmt.Errorf("jq expression must produce an object, got %T", result)
+	}
+
+	// Detect changes by comparing the normalized JSON forms
+	inputBytes, err := json.Marshal(input)
+	if err != nil {
+		return nil, false, err
+	}
+	outputBytes, err := json.Marshal(result)
+	if err != nil {
+		return nil, false, err
+	}
+	if bytes.Equal(inputBytes, outputBytes) {
+		return doc, true, nil
+	}
+	atomic.AddInt64(&t.modified, 1)
+
+	var out bson.D
+	if err := bson.UnmarshalExtJSON(outputBytes, true, &out); err != nil {
+		return nil, false, fmt.Errorf("failed to convert jq result to BSON: %w", err)
+	}
+	return out, true, nil
+}
+
+// Modified returns the number of documents changed by the expression
+func (t *Transformer) Modified() int64 {
+	return atomic.LoadInt64(&t.modified)
+}
+
+// Dropped returns the number of documents filtered out by the expression
+func (t *Transformer) Dropped() int64 {
+	return atomic.LoadInt64(&t.dropped)
+}
+
+// toJSONValue converts a document to the generic form used by gojq
+func toJSONValue(doc bson.D) (interface{}, error) {
+	data, err := bson.MarshalExtJSON(doc, true, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert document to JSON: %w", err)
+	}
+
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
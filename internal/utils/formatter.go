@@ -3,6 +3,8 @@ package utils
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
 )
 
 // FormatByteSize converts bytes to a human-readable string
@@ -20,3 +22,26 @@ func FormatByteSize(bytes int64) string {
 
 	return fmt.Sprintf("%.1f %ciB", float64(bytes)/float64(div), "KMGTPE"[exp])
 }
+
+// ParseByteSize parses a size such as "512MB", "2GiB" or "1048576". Units
+// are binary, matching FormatByteSize.
+func ParseByteSize(s string) (int64, error) {
+	value := strings.ToUpper(strings.TrimSpace(s))
+	value = strings.TrimSuffix(strings.TrimSuffix(value, "IB"), "B")
+
+	multiplier := int64(1)
+	if n := len(value); n > 0 {
+		if exp := strings.IndexByte("KMGTPE", value[n-1]); exp >= 0 {
+			for i := 0; i <= exp; i++ {
+				multiplier *= 1024
+			}
+			value = value[:n-1]
+		}
+	}
+
+	number, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(number * float64(multiplier)), nil
+}
@@ -2,11 +2,26 @@
 package utils
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
+	"time"
 )
 
+// Log formats selectable with --log-format
+const (
+	LogFormatText = "text"
+	// LogFormatJSON writes every message as a JSON object on one line
+	LogFormatJSON = "json"
+)
+
+// ValidLogFormat reports whether s is a known log format
+func ValidLogFormat(s string) bool {
+	return s == LogFormatText || s == LogFormatJSON
+}
+
 // LogLevel represents the severity of a log message
 type LogLevel int
 
@@ -27,6 +42,7 @@ type Logger struct {
 	infoLog  *log.Logger
 	warnLog  *log.Logger
 	errorLog *log.Logger
+	json     bool
 }
 
 // NewLogger creates a new logger instance
@@ -39,6 +55,91 @@ func NewLogger() *Logger {
 	}
 }
 
+// SetColor enables or disables ANSI colors for the level prefixes of the
+// stdout and stderr loggers independently
+func (l *Logger) SetColor(stdout, stderr bool) {
+	l.debugLog.SetPrefix(levelPrefix("[DEBUG] ", colorGray, stdout))
+	l.infoLog.SetPrefix(levelPrefix("[INFO] ", colorGreen, stdout))
+	l.warnLog.SetPrefix(levelPrefix("[WARN] ", colorYellow, stderr))
+	l.errorLog.SetPrefix(levelPrefix("[ERROR] ", colorRed, stderr))
+}
+
+// SetFormat switches between text and JSON output. JSON lines carry the
+// time, level and message followed by the attributes, without colors.
+func (l *Logger) SetFormat(format string) {
+	l.json = format == LogFormatJSON
+	for _, lg := range []*log.Logger{l.debugLog, l.infoLog, l.warnLog, l.errorLog} {
+		if l.json {
+			lg.SetFlags(0)
+		} else {
+			lg.SetFlags(log.Ldate | log.Ltime)
+		}
+	}
+}
+
+// JSON reports whether messages are written as JSON
+func (l *Logger) JSON() bool {
+	return l.json
+}
+
+// print writes a message in the configured format
+func (l *Logger) print(lg *log.Logger, level, msg string, attrs []interface{}) {
+	if !l.json {
+		lg.Println(msg + formatAttrs(attrs...))
+		return
+	}
+	// Bypass the prefix, which may hold color codes
+	lg.Writer().Write(formatJSON(level, msg, attrs))
+}
+
+// formatJSON encodes a message and its key-value pairs as one JSON line,
+// keeping the order of the attributes
+func formatJSON(level, msg string, attrs []interface{}) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(`{"time":`)
+	buf.Write(jsonValue(time.Now().Format(time.RFC3339)))
+	buf.WriteString(`,"level":`)
+	buf.Write(jsonValue(level))
+	buf.WriteString(`,"msg":`)
+	buf.Write(jsonValue(msg))
+	for i := 0; i < len(attrs); i += 2 {
+		var val interface{} = "<missing>"
+		if i+1 < len(attrs) {
+			val = attrs[i+1]
+		}
+		buf.WriteByte(',')
+		buf.Write(jsonValue(fmt.Sprintf("%v", attrs[i])))
+		buf.WriteByte(':')
+		buf.Write(jsonValue(val))
+	}
+	buf.WriteString("}\n")
+	return buf.Bytes()
+}
+
+// jsonValue encodes a value for formatJSON. Errors and Stringers use their
+// text, and values JSON cannot encode fall back to their %v form.
+func jsonValue(v interface{}) []byte {
+	switch t := v.(type) {
+	case error:
+		v = t.Error()
+	case fmt.Stringer:
+		v = t.String()
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprintf("%v", v))
+	}
+	return data
+}
+
+// levelPrefix returns a log prefix, colored if requested
+func levelPrefix(prefix, color string, enabled bool) string {
+	if !enabled {
+		return prefix
+	}
+	return colorize(prefix, color)
+}
+
 // formatAttrs formats key-value pairs for logging
 func formatAttrs(attrs ...interface{}) string {
 	if len(attrs) == 0 {
@@ -67,20 +168,20 @@ func formatAttrs(attrs ...interface{}) string {
 
 // Debug logs a debug message
 func (l *Logger) Debug(msg string, attrs ...interface{}) {
-	l.debugLog.Println(msg + formatAttrs(attrs...))
+	l.print(l.debugLog, "debug", msg, attrs)
 }
 
 // Info logs an info message
 func (l *Logger) Info(msg string, attrs ...interface{}) {
-	l.infoLog.Println(msg + formatAttrs(attrs...))
+	l.print(l.infoLog, "info", msg, attrs)
 }
 
 // Warn logs a warning message
 func (l *Logger) Warn(msg string, attrs ...interface{}) {
-	l.warnLog.Println(msg + formatAttrs(attrs...))
+	l.print(l.warnLog, "warn", msg, attrs)
 }
 
 // Error logs an error message
 func (l *Logger) Error(msg string, attrs ...interface{}) {
-	l.errorLog.Println(msg + formatAttrs(attrs...))
+	l.print(l.errorLog, "error", msg, attrs)
 }
@@ -2,7 +2,9 @@
 package utils
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"strings"
 	"sync"
 	"time"
@@ -10,16 +12,67 @@ import (
 
 const (
 	progressBarWidth = 50
+	// DefaultProgressInterval is the minimum time between renders
+	DefaultProgressInterval = 100 * time.Millisecond
+	// etaSamples is the number of recent samples used for the ETA
+	etaSamples = 20
+	// etaSmoothing is the weight given to the newest rate in the moving average
+	etaSmoothing = 0.3
 )
 
+// Progress units selectable with --progress-unit
+const (
+	UnitDocs  = "docs"
+	UnitBytes = "bytes"
+	// UnitFile counts bytes of the input file consumed, for commands that
+	// read an MCBZ file; it is accurate even when the header counts are not
+	UnitFile = "file"
+	// UnitAuto picks the natural unit of the operation, documents for
+	// database transfers
+	UnitAuto = "auto"
+)
+
+// ValidProgressUnit reports whether s is a known progress unit
+func ValidProgressUnit(s string) bool {
+	return s == UnitDocs || s == UnitBytes || s == UnitFile || s == UnitAuto
+}
+
+// progressSample records progress at a point in time
+type progressSample struct {
+	at      time.Time
+	current int64
+}
+
 // ProgressBar provides a simple progress bar
 type ProgressBar struct {
 	mu         sync.Mutex
 	operation  string
 	total      int64
 	current    int64
+	initial    int64
+	bytes      bool
 	startTime  time.Time
 	lastUpdate time.Time
+	interval   time.Duration
+	color      bool
+	samples    [etaSamples]progressSample
+	sampleNext int
+	sampleLen  int
+	events     io.Writer
+}
+
+// ProgressEvent is one line of machine-readable progress written to the
+// event writer
+type ProgressEvent struct {
+	Operation string `json:"operation"`
+	Current   int64  `json:"current"`
+	// Total is 0 when unknown
+	Total int64 `json:"total"`
+	// Percent is 0-100, or -1 when the total is unknown
+	Percent   float64 `json:"percent"`
+	Rate      float64 `json:"rate"`
+	ElapsedMS int64   `json:"elapsed_ms"`
+	Done      bool    `json:"done"`
 }
 
 // NewProgressBar creates a new progress bar
@@ -28,9 +81,17 @@ func NewProgressBar(operation string) *ProgressBar {
 		operation:  operation,
 		startTime:  time.Now(),
 		lastUpdate: time.Now(),
+		interval:   DefaultProgressInterval,
 	}
 }
 
+// SetInterval sets the minimum time between renders
+func (p *ProgressBar) SetInterval(interval time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.interval = interval
+}
+
 // SetTotal sets the total number of items to process
 func (p *ProgressBar) SetTotal(total int64) {
 	p.mu.Lock()
@@ -45,21 +106,144 @@ func (p *ProgressBar) Add(n int64) {
 	defer p.mu.Unlock()
 	p.current += n
 
-	// Only update visually every 100ms to avoid terminal flicker
-	if time.Since(p.lastUpdate) > 100*time.Millisecond {
+	// Only update visually every interval to avoid terminal flicker
+	if time.Since(p.lastUpdate) > p.interval {
+		p.recordSample()
 		p.render()
 		p.lastUpdate = time.Now()
 	}
 }
 
-// render displays the progress bar
-func (p *ProgressBar) render() {
+// SetInitial records n items completed by an earlier run, e.g. when
+// resuming. They are shown as done and added to the total, but the rate and
+// ETA only reflect the work of this run. The total given to SetTotal then
+// covers only the remaining items.
+func (p *ProgressBar) SetInitial(n int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.initial = n
+}
+
+// SetBytes makes the bar count and display bytes instead of items
+func (p *ProgressBar) SetBytes(enabled bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.bytes = enabled
+}
+
+// SetEventWriter makes every render also write a ProgressEvent as a JSON
+// line to w, for front-ends that track progress programmatically
+func (p *ProgressBar) SetEventWriter(w io.Writer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.events = w
+}
+
+// SetColor enables or disables ANSI colors in the rendered bar
+func (p *ProgressBar) SetColor(enabled bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.color = enabled
+}
+
+// ProgressStats is a snapshot of a progress bar's state
+type ProgressStats struct {
+	Current int64
+	Total   int64
+	// Percent is 0-100, or -1 when the total is unknown
+	Percent float64
+	// Rate is the recent throughput in items per second
+	Rate    float64
+	Elapsed time.Duration
+}
+
+// Stats returns a snapshot of the current progress
+func (p *ProgressBar) Stats() ProgressStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	current, total := p.overall()
+	stats := ProgressStats{
+		Current: current,
+		Total:   total,
+		Percent: -1,
+		Rate:    p.rate(),
+		Elapsed: time.Since(p.startTime),
+	}
+	if total > 0 {
+		stats.Percent = float64(current) / float64(total) * 100
+	}
+	return stats
+}
+
+// overall returns the progress including the items of earlier runs. The
+// total stays 0 while unknown.
+func (p *ProgressBar) overall() (int64, int64) {
 	if p.total <= 0 {
-		fmt.Printf("\r%s: %d items... ", p.operation, p.current)
+		return p.initial + p.current, 0
+	}
+	return p.initial + p.current, p.initial + p.total
+}
+
+// Finish renders the final state and moves to a new line
+func (p *ProgressBar) Finish() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.writeEvent(true)
+	if p.total <= 0 && p.current == 0 && p.initial == 0 {
+		fmt.Printf("\r%s: 0 items (empty)\n", p.operation)
 		return
 	}
+	p.renderBar()
+	fmt.Println()
+}
+
+// render displays the progress bar and reports an event
+func (p *ProgressBar) render() {
+	p.writeEvent(false)
+	p.renderBar()
+}
 
-	percent := float64(p.current) / float64(p.total)
+// writeEvent writes the current progress to the event writer, if any.
+// Write errors are ignored so a closed reader never stops the operation.
+func (p *ProgressBar) writeEvent(done bool) {
+	if p.events == nil {
+		return
+	}
+	current, total := p.overall()
+	event := ProgressEvent{
+		Operation: p.operation,
+		Current:   current,
+		Total:     total,
+		Percent:   -1,
+		Rate:      p.rate(),
+		ElapsedMS: time.Since(p.startTime).Milliseconds(),
+		Done:      done,
+	}
+	if total > 0 {
+		event.Percent = float64(current) / float64(total) * 100
+	}
+	line, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	p.events.Write(append(line, '\n'))
+}
+
+// renderBar draws the progress bar on the terminal
+func (p *ProgressBar) renderBar() {
+	current, total := p.overall()
+	if total <= 0 {
+		if p.bytes {
+			fmt.Printf("\r%s: %s... ", p.operation, FormatByteSize(current))
+		} else {
+			fmt.Printf("\r%s: %d items... ", p.operation, current)
+		}
+		return
+	}
+
+	percent := float64(current) / float64(total)
 	if percent > 1.0 {
 		percent = 1.0
 	}
@@ -69,20 +253,70 @@ func (p *ProgressBar) render() {
 
 	// Calculate ETA
 	var eta string
-	if p.current > 0 {
-		elapsed := time.Since(p.startTime)
-		estimatedTotal := float64(elapsed) * float64(p.total) / float64(p.current)
-		remaining := time.Duration(estimatedTotal) - elapsed
+	if rate := p.rate(); rate > 0 {
+		remaining := time.Duration(float64(p.total-p.current) / rate * float64(time.Second))
+		if remaining < 0 {
+			remaining = 0
+		}
 		eta = fmt.Sprintf("ETA: %s", formatDuration(remaining))
 	} else {
 		eta = "ETA: --"
 	}
 
 	// Build progress bar
-	bar := strings.Repeat("=", width) + strings.Repeat(" ", progressBarWidth-width)
+	filled := strings.Repeat("=", width)
+	if p.color {
+		filled = colorize(filled, colorGreen)
+	}
+	bar := filled + strings.Repeat(" ", progressBarWidth-width)
 
-	fmt.Printf("\r%s: [%s] %.2f%% (%d/%d) %s",
-		p.operation, bar, percent*100, p.current, p.total, eta)
+	counts := fmt.Sprintf("%d/%d", current, total)
+	if p.bytes {
+		counts = FormatByteSize(current) + "/" + FormatByteSize(total)
+	}
+	fmt.Printf("\r%s: [%s] %.2f%% (%s) %s",
+		p.operation, bar, percent*100, counts, eta)
+}
+
+// recordSample stores the current progress in the sample ring buffer
+func (p *ProgressBar) recordSample() {
+	p.samples[p.sampleNext] = progressSample{at: time.Now(), current: p.current}
+	p.sampleNext = (p.sampleNext + 1) % etaSamples
+	if p.sampleLen < etaSamples {
+		p.sampleLen++
+	}
+}
+
+// rate returns the items per second used for the ETA. It is an exponentially
+// weighted moving average of the throughput between recent samples, falling
+// back to the whole-run average until enough samples are available.
+func (p *ProgressBar) rate() float64 {
+	if p.sampleLen < 2 {
+		elapsed := time.Since(p.startTime).Seconds()
+		if p.current <= 0 || elapsed <= 0 {
+			return 0
+		}
+		return float64(p.current) / elapsed
+	}
+
+	// Walk the samples from oldest to newest
+	oldest := (p.sampleNext - p.sampleLen + etaSamples) % etaSamples
+	var avg float64
+	prev := p.samples[oldest]
+	for i := 1; i < p.sampleLen; i++ {
+		sample := p.samples[(oldest+i)%etaSamples]
+		dt := sample.at.Sub(prev.at).Seconds()
+		if dt > 0 {
+			instant := float64(sample.current-prev.current) / dt
+			if i == 1 {
+				avg = instant
+			} else {
+				avg = etaSmoothing*instant + (1-etaSmoothing)*avg
+			}
+		}
+		prev = sample
+	}
+	return avg
 }
 
 // formatDuration formats a duration for display
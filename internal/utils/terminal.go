@@ -0,0 +1,47 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+)
+
+// ANSI escape codes used for colored output
+const (
+	colorReset  = "\033[0m"
+	colorRed    = "\033[31m"
+	colorGreen  = "\033[32m"
+	colorYellow = "\033[33m"
+	colorGray   = "\033[90m"
+)
+
+// IsTerminal reports whether f is connected to a terminal
+func IsTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// UseColor resolves a color mode (auto, always or never) for output written to f.
+// In auto mode colors are used only on a terminal and when NO_COLOR is unset.
+func UseColor(mode string, f *os.File) (bool, error) {
+	switch mode {
+	case "always":
+		return true, nil
+	case "never":
+		return false, nil
+	case "auto":
+		if _, ok := os.LookupEnv("NO_COLOR"); ok {
+			return false, nil
+		}
+		return IsTerminal(f), nil
+	default:
+		return false, fmt.Errorf("invalid color mode %q (expected auto, always or never)", mode)
+	}
+}
+
+// colorize wraps s in the given color code
+func colorize(s, color string) string {
+	return color + s + colorReset
+}
@@ -12,7 +12,7 @@ func main() {
 	logger := utils.NewLogger()
 
 	if err := cmd.Execute(logger); err != nil {
-		logger.Error(err.Error())
-		os.Exit(1)
+		cmd.ReportError(err)
+		os.Exit(cmd.ExitCode(err))
 	}
 }